@@ -12,11 +12,11 @@ import (
 	"github.com/dcarrillo/whatismyip/internal/httputils"
 	"github.com/dcarrillo/whatismyip/internal/metrics"
 	"github.com/dcarrillo/whatismyip/internal/setting"
+	"github.com/dcarrillo/whatismyip/internal/validator"
 	"github.com/dcarrillo/whatismyip/resolver"
 	"github.com/dcarrillo/whatismyip/server"
 	"github.com/dcarrillo/whatismyip/service"
 	"github.com/gin-contrib/secure"
-	"github.com/patrickmn/go-cache"
 
 	"github.com/dcarrillo/whatismyip/router"
 	"github.com/gin-gonic/gin"
@@ -34,16 +34,9 @@ func main() {
 	}
 
 	servers := []server.Server{}
+	var reloaders []server.Reloader
 	engine := setupEngine()
 
-	if setting.App.Resolver.Domain != "" {
-		store := cache.New(1*time.Minute, 10*time.Minute)
-		dnsEngine := resolver.Setup(store)
-		nameServer := server.NewDNSServer(context.Background(), dnsEngine.Handler())
-		servers = append(servers, nameServer)
-		engine.Use(router.GetDNSDiscoveryHandler(store, setting.App.Resolver.Domain, setting.App.Resolver.RedirectPort))
-	}
-
 	var geoSvc *service.Geo
 	if setting.App.GeodbPath.City != "" || setting.App.GeodbPath.ASN != "" {
 		if geoSvc, err = service.NewGeo(context.Background(), setting.App.GeodbPath.City, setting.App.GeodbPath.ASN); err != nil {
@@ -51,9 +44,108 @@ func main() {
 		}
 	}
 
+	// the tokens are issued by the landing pages and the DNS discovery
+	var (
+		tokens    *validator.Tokens
+		discovery *router.DiscoveryIssuer
+		redirect  = router.DiscoveryRedirect{
+			Scheme: setting.App.Resolver.RedirectScheme,
+			Port:   setting.App.Resolver.RedirectPort,
+		}
+	)
+	if setting.App.Resolver.Domain != "" {
+		conf := setting.App.Resolver.Tokens
+		if tokens, err = validator.NewTokens(conf.SecretBytes(), time.Duration(conf.TTL)*time.Second); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		discovery = router.NewDiscoveryIssuer(tokens, setting.App.Resolver.Domain, redirect)
+	}
+
 	router.SetupTemplate(engine)
-	router.Setup(engine, geoSvc)
-	servers = slices.Concat(servers, setupHTTPServers(context.Background(), engine.Handler()))
+	router.Setup(engine, geoSvc, discovery)
+	vhosts := router.NewVirtualHosts(engine.Handler())
+	// every host serves DNS over HTTPS
+	hostEngines := []*gin.Engine{engine}
+	for _, vh := range setting.App.VirtualHosts {
+		vhEngine := setupEngine()
+		hostEngines = append(hostEngines, vhEngine)
+		router.SetupVirtualHost(vhEngine, geoSvc, vh.Template, router.Features{
+			DisableTCPScan: vh.DisableTCPScan || setting.App.DisableTCPScan,
+			DisableGeo:     vh.DisableGeo,
+			DisableHeaders: vh.DisableHeaders,
+		}, discovery)
+		addVirtualHosts(vhosts, vhEngine, vh.Hosts...)
+	}
+
+	var store service.DiscoveryStore
+	if setting.App.Resolver.Domain != "" {
+		if store, err = setupDiscoveryStore(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		var dyn *service.DynDNS
+		if setting.App.Resolver.DynDNS.Enabled() {
+			conf := setting.App.Resolver.DynDNS
+			if dyn, err = service.NewDynDNS(conf.File); err == nil {
+				err = dyn.Prune(conf.Hosts(setting.App.Resolver.Domain))
+			}
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			router.SetupDynDNS(engine, dyn)
+		}
+		var acme *service.ACME
+		if conf := setting.App.Resolver.ACME; conf.Enabled() {
+			if acme, err = service.NewACME(conf.File); err == nil && conf.Apex != nil {
+				err = acme.SetAccount(conf.Apex.Username, conf.Apex.Password, "")
+			}
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			router.SetupACME(engine, acme)
+		}
+		dnsEngine, err := resolver.Setup(resolver.Config{
+			Store:  store,
+			Tokens: tokens,
+			Geo:    geoSvc,
+			DynDNS: dyn,
+			ACME:   acme,
+		})
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		reloaders = append(reloaders, dnsEngine)
+		nameServer := server.NewDNSServer(context.Background(), dnsEngine.Handler())
+		servers = append(servers, nameServer)
+
+		// the stack test hostnames are served along with the DNS discovery
+		// under *.<domain>
+		var stackHosts *router.StackTestHosts
+		if st := setting.App.Resolver.StackTest; st.Enabled() {
+			stackHosts = &router.StackTestHosts{
+				Domain:    setting.App.Resolver.Domain,
+				Redirect:  redirect,
+				IPv4:      st.Ipv4,
+				IPv6:      st.Ipv6,
+				DualStack: st.DualStack,
+			}
+			router.SetupStackTest(engine, store, tokens, *stackHosts)
+		}
+		discoveryEngine := setupEngine()
+		router.SetupDNSDiscovery(discoveryEngine, store, discovery, stackHosts)
+		addVirtualHosts(vhosts, discoveryEngine, setting.App.Resolver.Domain, "*."+setting.App.Resolver.Domain)
+		if setting.App.Resolver.Listen.DoH {
+			for _, e := range append(slices.Clone(hostEngines), discoveryEngine) {
+				router.SetupDoH(e, nameServer.Handler())
+			}
+		}
+	}
+
+	servers = slices.Concat(servers, setupHTTPServers(context.Background(), vhosts))
 
 	if setting.App.PrometheusAddress != "" {
 		prometheusServer := server.NewPrometheusServer(context.Background())
@@ -61,7 +153,23 @@ func main() {
 	}
 
 	whatismyip := server.Setup(servers, geoSvc)
+	for _, r := range reloaders {
+		whatismyip.AddReloader(r)
+	}
 	whatismyip.Run()
+	if store != nil {
+		_ = store.Close()
+	}
+}
+
+func setupDiscoveryStore() (service.DiscoveryStore, error) {
+	conf := setting.App.Resolver.DiscoveryStore
+	expiration := time.Duration(conf.Expiration) * time.Second
+	if conf.RedisURL != "" {
+		return service.NewRedisDiscoveryStore(conf.RedisURL, conf.Prefix, expiration)
+	}
+
+	return service.NewMemoryDiscoveryStore(expiration, conf.MaxEntries, conf.Quota()), nil
 }
 
 func setupEngine() *gin.Engine {
@@ -88,6 +196,15 @@ func setupEngine() *gin.Engine {
 	return engine
 }
 
+func addVirtualHosts(vhosts *router.VirtualHosts, engine *gin.Engine, hosts ...string) {
+	for _, host := range hosts {
+		if err := vhosts.Add(host, engine.Handler()); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+}
+
 func setupHTTPServers(ctx context.Context, handler http.Handler) []server.Server {
 	var servers []server.Server
 
@@ -0,0 +1,226 @@
+// Package cookie implements the server side of DNS cookies (RFC 7873). Server
+// cookies follow the interoperable layout of RFC 9018 (version, reserved,
+// timestamp and hash), with an HMAC-SHA256 hash keyed by a secret derived from
+// the configured one for every rotation period, so that instances sharing the
+// secret accept each other's cookies.
+package cookie
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"time"
+
+	"github.com/dcarrillo/whatismyip/internal/metrics"
+	"github.com/miekg/dns"
+)
+
+const (
+	version = 1
+	// clientLength is the length of a client cookie, server cookies are 8 to
+	// 32 bytes long
+	clientLength    = 8
+	serverLength    = 16
+	minServerLength = 8
+	maxServerLength = 32
+	// a server cookie is valid for an hour, and up to 5 minutes ahead to
+	// allow for clock skew between instances (RFC 9018, section 4.3)
+	maxAge  = time.Hour
+	maxSkew = 5 * time.Minute
+
+	defaultRotation = time.Hour
+	secretLength    = 32
+)
+
+// Config holds the secret the server cookies are derived from, random when it
+// is empty, and how often the derived secret changes
+type Config struct {
+	Secret   []byte
+	Rotation time.Duration
+}
+
+type Cookies struct {
+	secret   []byte
+	rotation time.Duration
+	now      func() time.Time
+}
+
+func New(cfg Config) (*Cookies, error) {
+	secret := cfg.Secret
+	if len(secret) == 0 {
+		secret = make([]byte, secretLength)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+	}
+	rotation := cfg.Rotation
+	if rotation < time.Second {
+		rotation = defaultRotation
+	}
+
+	return &Cookies{secret: secret, rotation: rotation, now: time.Now}, nil
+}
+
+// Generate returns a new server cookie for the client cookie of ip
+func (c *Cookies) Generate(client []byte, ip net.IP) []byte {
+	server := make([]byte, serverLength)
+	server[0] = version
+	binary.BigEndian.PutUint32(server[4:8], uint32(c.now().Unix()))
+	copy(server[8:], c.hash(client, server[:8], ip))
+
+	return server
+}
+
+// Valid reports whether server is a server cookie generated for the client
+// cookie of ip that has not expired
+func (c *Cookies) Valid(client []byte, server []byte, ip net.IP) bool {
+	if len(server) != serverLength || server[0] != version {
+		return false
+	}
+	timestamp := time.Unix(int64(binary.BigEndian.Uint32(server[4:8])), 0)
+	if age := c.now().Sub(timestamp); age > maxAge || age < -maxSkew {
+		return false
+	}
+
+	return hmac.Equal(server[8:], c.hash(client, server[:8], ip))
+}
+
+// hash returns the hash of a server cookie, keyed by the secret of the period
+// of its timestamp
+func (c *Cookies) hash(client []byte, header []byte, ip net.IP) []byte {
+	timestamp := int64(binary.BigEndian.Uint32(header[4:8]))
+	period := make([]byte, 8)
+	binary.BigEndian.PutUint64(period, uint64(timestamp/int64(c.rotation.Seconds())))
+	key := hmac.New(sha256.New, c.secret)
+	key.Write(period)
+
+	mac := hmac.New(sha256.New, key.Sum(nil))
+	mac.Write(client)
+	mac.Write(header)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	mac.Write(ip)
+
+	return mac.Sum(nil)[:serverLength-8]
+}
+
+// Handler answers the cookies of the queries served by next: every response to
+// a query with a cookie carries a fresh server cookie, and malformed cookies
+// are a format error. Queries without a valid server cookie are still answered,
+// the writer only tells next whether the client proved its address.
+func Handler(next dns.Handler, c *Cookies) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		opt := r.IsEdns0()
+		if opt == nil {
+			next.ServeDNS(w, r)
+			return
+		}
+		var option *dns.EDNS0_COOKIE
+		for _, o := range opt.Option {
+			if cookie, ok := o.(*dns.EDNS0_COOKIE); ok {
+				option = cookie
+				break
+			}
+		}
+		if option == nil {
+			next.ServeDNS(w, r)
+			return
+		}
+
+		cookie, err := hex.DecodeString(option.Cookie)
+		if n := len(cookie) - clientLength; err != nil || (n != 0 && (n < minServerLength || n > maxServerLength)) {
+			metrics.RecordDNSCookie("malformed")
+			msg := new(dns.Msg)
+			msg.SetRcode(r, dns.RcodeFormatError)
+			msg.SetEdns0(opt.UDPSize(), false)
+			_ = w.WriteMsg(msg)
+			return
+		}
+
+		host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+		cw := &cookieWriter{
+			ResponseWriter: w,
+			cookies:        c,
+			client:         cookie[:clientLength],
+			ip:             net.ParseIP(host),
+			size:           opt.UDPSize(),
+		}
+		cw.valid = c.Valid(cw.client, cookie[clientLength:], cw.ip)
+		switch {
+		case cw.valid:
+			metrics.RecordDNSCookie("valid")
+		case len(cookie) > clientLength:
+			metrics.RecordDNSCookie("invalid")
+		default:
+			metrics.RecordDNSCookie("client_only")
+		}
+		next.ServeDNS(cw, r)
+	})
+}
+
+type cookieWriter struct {
+	dns.ResponseWriter
+	cookies *Cookies
+	client  []byte
+	ip      net.IP
+	size    uint16
+	valid   bool
+}
+
+// ValidCookie reports whether the query carried a valid server cookie, i.e.
+// whether the client address has been verified
+func (w *cookieWriter) ValidCookie() bool {
+	return w.valid
+}
+
+// ConnectionState exposes the TLS state of the wrapped writer, it tells DNS
+// over TLS apart from plain TCP
+func (w *cookieWriter) ConnectionState() *tls.ConnectionState {
+	if cs, ok := w.ResponseWriter.(dns.ConnectionStater); ok {
+		return cs.ConnectionState()
+	}
+
+	return nil
+}
+
+// Transport exposes the transport of the wrapped writer, e.g. DNS over HTTPS,
+// empty if it does not tell
+func (w *cookieWriter) Transport() string {
+	if t, ok := w.ResponseWriter.(interface{ Transport() string }); ok {
+		return t.Transport()
+	}
+
+	return ""
+}
+
+// WriteMsg adds the cookie to the EDNS0 OPT record of msg. Over UDP msg is
+// truncated again if the cookie does not fit in the size the client advertised.
+func (w *cookieWriter) WriteMsg(msg *dns.Msg) error {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return w.ResponseWriter.WriteMsg(msg)
+	}
+
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if _, ok := o.(*dns.EDNS0_COOKIE); !ok {
+			options = append(options, o)
+		}
+	}
+	cookie := append(append([]byte{}, w.client...), w.cookies.Generate(w.client, w.ip)...)
+	opt.Option = append(options, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: hex.EncodeToString(cookie)})
+
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		size := min(max(int(w.size), dns.MinMsgSize), max(int(opt.UDPSize()), dns.MinMsgSize))
+		if msg.Len() > size {
+			msg.Truncate(size)
+		}
+	}
+
+	return w.ResponseWriter.WriteMsg(msg)
+}
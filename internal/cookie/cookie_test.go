@@ -0,0 +1,170 @@
+package cookie
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time          { return c.t }
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestCookies(t *testing.T, secret string) (*Cookies, *clock) {
+	t.Helper()
+	c := &clock{t: time.Unix(1700000000, 0)}
+	cookies, err := New(Config{Secret: []byte(secret), Rotation: time.Minute})
+	require.NoError(t, err)
+	cookies.now = c.now
+
+	return cookies, c
+}
+
+type testWriter struct {
+	dns.ResponseWriter
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *testWriter) RemoteAddr() net.Addr        { return w.remote }
+func (w *testWriter) WriteMsg(msg *dns.Msg) error { w.msg = msg; return nil }
+
+func TestValid(t *testing.T) {
+	cookies, c := newTestCookies(t, "secret-secret-secret")
+	client := []byte{0, 1, 2, 3, 4, 5, 6, 7}
+	ip := net.ParseIP("192.0.2.1")
+
+	server := cookies.Generate(client, ip)
+	require.Len(t, server, 16)
+	assert.Equal(t, byte(1), server[0], "version")
+	assert.True(t, cookies.Valid(client, server, ip))
+
+	assert.False(t, cookies.Valid([]byte{7, 6, 5, 4, 3, 2, 1, 0}, server, ip), "another client cookie")
+	assert.False(t, cookies.Valid(client, server, net.ParseIP("192.0.2.2")), "another address")
+	assert.False(t, cookies.Valid(client, server[:8], ip), "short cookie")
+
+	other, _ := newTestCookies(t, "another-secret")
+	assert.False(t, other.Valid(client, server, ip), "another secret")
+	shared, _ := newTestCookies(t, "secret-secret-secret")
+	assert.True(t, shared.Valid(client, server, ip), "instances sharing the secret")
+
+	c.advance(30 * time.Minute)
+	assert.True(t, cookies.Valid(client, server, ip), "after the rotation of the secret")
+	c.advance(31 * time.Minute)
+	assert.False(t, cookies.Valid(client, server, ip), "expired")
+
+	c.advance(-time.Hour - 10*time.Minute)
+	assert.False(t, cookies.Valid(client, server, ip), "from the future")
+}
+
+func TestHandler(t *testing.T) {
+	cookies, _ := newTestCookies(t, "secret-secret-secret")
+	var valid bool
+	answer := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		valid = false
+		if cw, ok := w.(interface{ ValidCookie() bool }); ok {
+			valid = cw.ValidCookie()
+		}
+		m := new(dns.Msg).SetReply(r)
+		if opt := r.IsEdns0(); opt != nil {
+			m.SetEdns0(1232, false)
+		}
+		_ = w.WriteMsg(m)
+	})
+	h := Handler(answer, cookies)
+	query := func(cookie string) *dns.Msg {
+		r := new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA)
+		r.SetEdns0(1232, false)
+		if cookie != "" {
+			r.IsEdns0().Option = append(r.IsEdns0().Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+		}
+		w := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+		h.ServeDNS(w, r)
+		return w.msg
+	}
+	responseCookie := func(msg *dns.Msg) string {
+		for _, o := range msg.IsEdns0().Option {
+			if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+				return c.Cookie
+			}
+		}
+		return ""
+	}
+
+	msg := query("")
+	assert.Empty(t, responseCookie(msg), "no cookie without a client cookie")
+	assert.False(t, valid)
+
+	msg = query("0011223344556677")
+	require.Equal(t, dns.RcodeSuccess, msg.Rcode)
+	cookie := responseCookie(msg)
+	require.Len(t, cookie, 48)
+	assert.Equal(t, "0011223344556677", cookie[:16], "the client cookie is echoed")
+	assert.False(t, valid, "client cookie only")
+
+	msg = query(cookie)
+	assert.True(t, valid, "valid server cookie")
+	assert.Len(t, responseCookie(msg), 48)
+
+	query("0011223344556677" + hex.EncodeToString(make([]byte, 16)))
+	assert.False(t, valid, "invalid server cookie")
+
+	for _, malformed := range []string{"00112233", "0011223344556677aabb", "not hex"} {
+		msg = query(malformed)
+		assert.Equal(t, dns.RcodeFormatError, msg.Rcode, malformed)
+	}
+}
+
+func TestHandlerTruncates(t *testing.T) {
+	cookies, _ := newTestCookies(t, "")
+	h := Handler(dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg).SetReply(r)
+		for i := range 64 {
+			a, _ := dns.NewRR(fmt.Sprintf("%s 60 IN A 192.0.2.%d", r.Question[0].Name, i))
+			m.Answer = append(m.Answer, a)
+		}
+		m.SetEdns0(1232, false)
+		m.Truncate(512)
+		_ = w.WriteMsg(m)
+	}), cookies)
+
+	r := new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA)
+	r.SetEdns0(512, false)
+	r.IsEdns0().Option = append(r.IsEdns0().Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0011223344556677"})
+	w := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+	h.ServeDNS(w, r)
+
+	assert.LessOrEqual(t, w.msg.Len(), 512)
+	assert.True(t, w.msg.Truncated)
+}
+
+type httpsWriter struct {
+	testWriter
+}
+
+func (w *httpsWriter) Transport() string { return "https" }
+
+func TestHandlerTransport(t *testing.T) {
+	cookies, _ := newTestCookies(t, "secret-secret-secret")
+	var transport string
+	h := Handler(dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		transport = w.(interface{ Transport() string }).Transport()
+		_ = w.WriteMsg(new(dns.Msg).SetReply(r))
+	}), cookies)
+
+	r := new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA)
+	r.SetEdns0(1232, false)
+	r.IsEdns0().Option = append(r.IsEdns0().Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0011223344556677"})
+	h.ServeDNS(&httpsWriter{testWriter{remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443}}}, r)
+
+	assert.Equal(t, "https", transport, "the transport of the wrapped writer is kept")
+}
@@ -0,0 +1,211 @@
+// Package dnstap logs the queries received and the responses sent by the DNS
+// server as dnstap (https://dnstap.info) AUTH_QUERY and AUTH_RESPONSE messages,
+// including the messages in wire format, to a frame streams Unix socket or file.
+package dnstap
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/dcarrillo/whatismyip/internal/core"
+	tap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"google.golang.org/protobuf/proto"
+)
+
+// Config holds the destination of the messages, either a Unix socket or a
+// file, and the values that identify the server in them
+type Config struct {
+	Socket   string
+	File     string
+	Identity string
+	// Zone is the zone the server is authoritative for
+	Zone string
+}
+
+// transportHTTPS is the transport of the writers of DNS over HTTPS queries
+const transportHTTPS = "https"
+
+type Tap struct {
+	output   tap.Output
+	frames   chan []byte
+	identity []byte
+	version  []byte
+	zone     []byte
+}
+
+// New opens the output of cfg and starts sending messages to it. A socket
+// output keeps reconnecting in the background until the collector is reachable.
+func New(cfg Config) (*Tap, error) {
+	var (
+		output tap.Output
+		err    error
+	)
+	switch {
+	case cfg.Socket != "":
+		output, err = tap.NewFrameStreamSockOutput(&net.UnixAddr{Name: cfg.Socket, Net: "unix"})
+	case cfg.File != "":
+		output, err = tap.NewFrameStreamOutputFromFilename(cfg.File)
+	default:
+		err = fmt.Errorf("dnstap socket or file is mandatory")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	identity := cfg.Identity
+	if identity == "" {
+		identity, _ = os.Hostname()
+	}
+	zone := make([]byte, 256)
+	n, err := dns.PackDomainName(dns.Fqdn(cfg.Zone), zone, 0, nil, false)
+	if err != nil {
+		return nil, err
+	}
+
+	go output.RunOutputLoop()
+
+	return &Tap{
+		output:   output,
+		frames:   output.GetOutputChannel(),
+		identity: []byte(identity),
+		version:  []byte("whatismyip " + core.Version),
+		zone:     zone[:n],
+	}, nil
+}
+
+// Close flushes the pending messages and closes the output
+func (t *Tap) Close() {
+	t.output.Close()
+}
+
+// Handler logs the queries served by next and its responses
+func (t *Tap) Handler(next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		tw := &tapWriter{ResponseWriter: w, tap: t, received: time.Now()}
+		tw.query, _ = r.Pack()
+		t.send(tw.message(tap.Message_AUTH_QUERY, nil))
+		next.ServeDNS(tw, r)
+	})
+}
+
+// send queues a message to the output, messages are discarded when the output
+// falls behind so that a slow collector never delays the responses
+func (t *Tap) send(msg *tap.Message) {
+	frame, err := proto.Marshal(&tap.Dnstap{
+		Type:     tap.Dnstap_MESSAGE.Enum(),
+		Identity: t.identity,
+		Version:  t.version,
+		Message:  msg,
+	})
+	if err != nil {
+		return
+	}
+
+	select {
+	case t.frames <- frame:
+	default:
+	}
+}
+
+type tapWriter struct {
+	dns.ResponseWriter
+	tap      *Tap
+	received time.Time
+	query    []byte
+}
+
+func (w *tapWriter) WriteMsg(msg *dns.Msg) error {
+	response, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+	if err := w.ResponseWriter.WriteMsg(msg); err != nil {
+		return err
+	}
+	w.tap.send(w.message(tap.Message_AUTH_RESPONSE, response))
+
+	return nil
+}
+
+// ConnectionState exposes the TLS state of the wrapped writer, it tells DNS
+// over TLS apart from plain TCP
+func (w *tapWriter) ConnectionState() *tls.ConnectionState {
+	if cs, ok := w.ResponseWriter.(dns.ConnectionStater); ok {
+		return cs.ConnectionState()
+	}
+
+	return nil
+}
+
+// Transport exposes the transport of the wrapped writer, e.g. DNS over HTTPS,
+// empty if it does not tell
+func (w *tapWriter) Transport() string {
+	if t, ok := w.ResponseWriter.(interface{ Transport() string }); ok {
+		return t.Transport()
+	}
+
+	return ""
+}
+
+// message returns a query message, or a response message when response is not
+// nil, about the exchange of w
+func (w *tapWriter) message(t tap.Message_Type, response []byte) *tap.Message {
+	msg := &tap.Message{
+		Type:           t.Enum(),
+		SocketProtocol: w.protocol().Enum(),
+		QueryZone:      w.tap.zone,
+		QueryTimeSec:   proto.Uint64(uint64(w.received.Unix())),
+		QueryTimeNsec:  proto.Uint32(uint32(w.received.Nanosecond())),
+	}
+	if response == nil {
+		msg.QueryMessage = w.query
+	} else {
+		now := time.Now()
+		msg.ResponseMessage = response
+		msg.ResponseTimeSec = proto.Uint64(uint64(now.Unix()))
+		msg.ResponseTimeNsec = proto.Uint32(uint32(now.Nanosecond()))
+	}
+
+	queryIP, queryPort := addrPort(w.RemoteAddr())
+	responseIP, responsePort := addrPort(w.LocalAddr())
+	family := tap.SocketFamily_INET6
+	if ip4 := queryIP.To4(); ip4 != nil {
+		family = tap.SocketFamily_INET
+		queryIP, responseIP = ip4, responseIP.To4()
+	}
+	msg.SocketFamily = family.Enum()
+	msg.QueryAddress = queryIP
+	msg.QueryPort = proto.Uint32(queryPort)
+	msg.ResponseAddress = responseIP
+	msg.ResponsePort = proto.Uint32(responsePort)
+
+	return msg
+}
+
+func (w *tapWriter) protocol() tap.SocketProtocol {
+	switch {
+	case w.Transport() == transportHTTPS:
+		return tap.SocketProtocol_DOH
+	case w.ConnectionState() != nil:
+		return tap.SocketProtocol_DOT
+	case w.RemoteAddr().Network() == "tcp":
+		return tap.SocketProtocol_TCP
+	default:
+		return tap.SocketProtocol_UDP
+	}
+}
+
+func addrPort(addr net.Addr) (net.IP, uint32) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP, uint32(a.Port)
+	case *net.TCPAddr:
+		return a.IP, uint32(a.Port)
+	default:
+		return nil, 0
+	}
+}
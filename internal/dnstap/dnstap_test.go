@@ -0,0 +1,135 @@
+package dnstap
+
+import (
+	"crypto/tls"
+	"net"
+	"path/filepath"
+	"testing"
+
+	tap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+type testWriter struct {
+	dns.ResponseWriter
+	remote net.Addr
+	local  net.Addr
+	msg    *dns.Msg
+}
+
+func (w *testWriter) RemoteAddr() net.Addr        { return w.remote }
+func (w *testWriter) LocalAddr() net.Addr         { return w.local }
+func (w *testWriter) WriteMsg(msg *dns.Msg) error { w.msg = msg; return nil }
+
+type tlsWriter struct {
+	testWriter
+}
+
+func (w *tlsWriter) ConnectionState() *tls.ConnectionState { return &tls.ConnectionState{} }
+
+type httpsWriter struct {
+	testWriter
+}
+
+func (w *httpsWriter) Transport() string { return "https" }
+
+// readMessages returns the dnstap messages written to path
+func readMessages(t *testing.T, path string) []*tap.Message {
+	t.Helper()
+	input, err := tap.NewFrameStreamInputFromFilename(path)
+	require.NoError(t, err)
+	frames := make(chan []byte, 8)
+	go func() {
+		input.ReadInto(frames)
+		close(frames)
+	}()
+
+	var msgs []*tap.Message
+	for frame := range frames {
+		d := &tap.Dnstap{}
+		require.NoError(t, proto.Unmarshal(frame, d))
+		assert.Equal(t, "test", string(d.Identity))
+		msgs = append(msgs, d.Message)
+	}
+
+	return msgs
+}
+
+func TestHandler(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnstap")
+	tp, err := New(Config{File: path, Identity: "test", Zone: "dns.example.com"})
+	require.NoError(t, err)
+
+	answer := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		_ = w.WriteMsg(new(dns.Msg).SetReply(r))
+	})
+	h := tp.Handler(answer)
+	r := new(dns.Msg).SetQuestion("www.dns.example.com.", dns.TypeA)
+
+	h.ServeDNS(&testWriter{
+		remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353},
+		local:  &net.UDPAddr{IP: net.ParseIP("198.51.100.53"), Port: 53},
+	}, r)
+	h.ServeDNS(&tlsWriter{testWriter{
+		remote: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 4242},
+		local:  &net.TCPAddr{IP: net.ParseIP("2001:db8::53"), Port: 853},
+	}}, r)
+	h.ServeDNS(&httpsWriter{testWriter{
+		remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 4443},
+		local:  &net.TCPAddr{IP: net.ParseIP("198.51.100.53"), Port: 443},
+	}}, r)
+	tp.Close()
+
+	msgs := readMessages(t, path)
+	require.Len(t, msgs, 6)
+
+	tests := []struct {
+		msgType  tap.Message_Type
+		family   tap.SocketFamily
+		protocol tap.SocketProtocol
+		query    string
+		port     uint32
+	}{
+		{msgType: tap.Message_AUTH_QUERY, family: tap.SocketFamily_INET, protocol: tap.SocketProtocol_UDP, query: "192.0.2.1", port: 5353},
+		{msgType: tap.Message_AUTH_RESPONSE, family: tap.SocketFamily_INET, protocol: tap.SocketProtocol_UDP, query: "192.0.2.1", port: 5353},
+		{msgType: tap.Message_AUTH_QUERY, family: tap.SocketFamily_INET6, protocol: tap.SocketProtocol_DOT, query: "2001:db8::1", port: 4242},
+		{msgType: tap.Message_AUTH_RESPONSE, family: tap.SocketFamily_INET6, protocol: tap.SocketProtocol_DOT, query: "2001:db8::1", port: 4242},
+		{msgType: tap.Message_AUTH_QUERY, family: tap.SocketFamily_INET, protocol: tap.SocketProtocol_DOH, query: "192.0.2.2", port: 4443},
+		{msgType: tap.Message_AUTH_RESPONSE, family: tap.SocketFamily_INET, protocol: tap.SocketProtocol_DOH, query: "192.0.2.2", port: 4443},
+	}
+
+	for i, tt := range tests {
+		msg := msgs[i]
+		assert.Equal(t, tt.msgType, msg.GetType())
+		assert.Equal(t, tt.family, msg.GetSocketFamily())
+		assert.Equal(t, tt.protocol, msg.GetSocketProtocol())
+		assert.Equal(t, tt.query, net.IP(msg.QueryAddress).String())
+		assert.Equal(t, tt.port, msg.GetQueryPort())
+		assert.NotZero(t, msg.GetQueryTimeSec())
+
+		zone, _, err := dns.UnpackDomainName(msg.QueryZone, 0)
+		require.NoError(t, err)
+		assert.Equal(t, "dns.example.com.", zone)
+
+		wire := msg.QueryMessage
+		if tt.msgType == tap.Message_AUTH_RESPONSE {
+			wire = msg.ResponseMessage
+			assert.NotZero(t, msg.GetResponseTimeSec())
+		}
+		m := new(dns.Msg)
+		require.NoError(t, m.Unpack(wire))
+		assert.Equal(t, r.Question, m.Question)
+		assert.Equal(t, tt.msgType == tap.Message_AUTH_RESPONSE, m.Response)
+	}
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(Config{})
+	assert.ErrorContains(t, err, "dnstap socket or file is mandatory")
+
+	_, err = New(Config{File: filepath.Join(t.TempDir(), "missing", "dnstap")})
+	assert.Error(t, err)
+}
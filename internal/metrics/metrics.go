@@ -19,6 +19,12 @@ var (
 	geoLookups       *prometheus.CounterVec
 	portScans        prometheus.Counter
 	dnsQueries       *prometheus.CounterVec
+	dnsRateLimited   *prometheus.CounterVec
+	dnsCookies       *prometheus.CounterVec
+	discoveryLookups *prometheus.CounterVec
+	discoveryEntries prometheus.Gauge
+	discoveryBytes   prometheus.Gauge
+	discoveryEvicted *prometheus.CounterVec
 )
 
 func Enable() {
@@ -71,6 +77,52 @@ func Enable() {
 			},
 			[]string{"query_type", "rcode"},
 		)
+
+		dnsRateLimited = promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "whatismyip_dns_rate_limited_responses_total",
+				Help: "Total number of DNS responses dropped or slipped by rate limiting",
+			},
+			[]string{"action"},
+		)
+
+		dnsCookies = promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "whatismyip_dns_cookies_total",
+				Help: "Total number of DNS queries with a cookie by result",
+			},
+			[]string{"result"},
+		)
+
+		discoveryLookups = promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "whatismyip_discovery_store_lookups_total",
+				Help: "Total number of discovery store lookups by result",
+			},
+			[]string{"result"},
+		)
+
+		discoveryEntries = promauto.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "whatismyip_discovery_store_entries",
+				Help: "Current number of entries in the in-memory discovery store",
+			},
+		)
+
+		discoveryBytes = promauto.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "whatismyip_discovery_store_bytes",
+				Help: "Approximate memory used by the entries of the in-memory discovery store",
+			},
+		)
+
+		discoveryEvicted = promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "whatismyip_discovery_store_evictions_total",
+				Help: "Total number of entries evicted from the in-memory discovery store before expiring by reason",
+			},
+			[]string{"reason"},
+		)
 	})
 }
 
@@ -120,3 +172,39 @@ func RecordDNSQuery(queryType string, rcode string) {
 	}
 	dnsQueries.WithLabelValues(queryType, rcode).Inc()
 }
+
+func RecordDNSRateLimit(action string) {
+	if !enabled {
+		return
+	}
+	dnsRateLimited.WithLabelValues(action).Inc()
+}
+
+func RecordDNSCookie(result string) {
+	if !enabled {
+		return
+	}
+	dnsCookies.WithLabelValues(result).Inc()
+}
+
+func RecordDiscoveryStoreLookup(result string) {
+	if !enabled {
+		return
+	}
+	discoveryLookups.WithLabelValues(result).Inc()
+}
+
+func AddDiscoveryStoreUsage(entries int, bytes int) {
+	if !enabled {
+		return
+	}
+	discoveryEntries.Add(float64(entries))
+	discoveryBytes.Add(float64(bytes))
+}
+
+func RecordDiscoveryStoreEviction(reason string) {
+	if !enabled {
+		return
+	}
+	discoveryEvicted.WithLabelValues(reason).Inc()
+}
@@ -58,6 +58,47 @@ func TestDisabledMetrics_DNSQuery(t *testing.T) {
 	})
 }
 
+func TestDisabledMetrics_DNSRateLimit(t *testing.T) {
+	if enabled {
+		t.Skip("Skipping disabled test - metrics already enabled")
+	}
+
+	assert.NotPanics(t, func() {
+		RecordDNSRateLimit("dropped")
+	})
+}
+
+func TestDisabledMetrics_DNSCookie(t *testing.T) {
+	if enabled {
+		t.Skip("Skipping disabled test - metrics already enabled")
+	}
+
+	assert.NotPanics(t, func() {
+		RecordDNSCookie("valid")
+	})
+}
+
+func TestDisabledMetrics_DiscoveryStoreLookup(t *testing.T) {
+	if enabled {
+		t.Skip("Skipping disabled test - metrics already enabled")
+	}
+
+	assert.NotPanics(t, func() {
+		RecordDiscoveryStoreLookup("hit")
+	})
+}
+
+func TestDisabledMetrics_DiscoveryStoreUsage(t *testing.T) {
+	if enabled {
+		t.Skip("Skipping disabled test - metrics already enabled")
+	}
+
+	assert.NotPanics(t, func() {
+		AddDiscoveryStoreUsage(1, 256)
+		RecordDiscoveryStoreEviction("capacity")
+	})
+}
+
 func TestEnable(t *testing.T) {
 	Enable()
 
@@ -68,6 +109,12 @@ func TestEnable(t *testing.T) {
 	assert.NotNil(t, geoLookups, "geoLookups should be initialized")
 	assert.NotNil(t, portScans, "portScans should be initialized")
 	assert.NotNil(t, dnsQueries, "dnsQueries should be initialized")
+	assert.NotNil(t, dnsRateLimited, "dnsRateLimited should be initialized")
+	assert.NotNil(t, dnsCookies, "dnsCookies should be initialized")
+	assert.NotNil(t, discoveryLookups, "discoveryLookups should be initialized")
+	assert.NotNil(t, discoveryEntries, "discoveryEntries should be initialized")
+	assert.NotNil(t, discoveryBytes, "discoveryBytes should be initialized")
+	assert.NotNil(t, discoveryEvicted, "discoveryEvicted should be initialized")
 }
 
 func TestEnableIdempotent(t *testing.T) {
@@ -198,3 +245,20 @@ func TestRecordDNSQuery(t *testing.T) {
 	nxdomainCount := testutil.ToFloat64(dnsQueries.WithLabelValues("A", "NXDOMAIN"))
 	assert.Equal(t, initialNXDOMAINCount+1, nxdomainCount, "Expected A NXDOMAIN queries to increase by 1")
 }
+
+func TestRecordDNSRateLimit(t *testing.T) {
+	Enable()
+
+	initialDropped := testutil.ToFloat64(dnsRateLimited.WithLabelValues("dropped"))
+	initialSlipped := testutil.ToFloat64(dnsRateLimited.WithLabelValues("slipped"))
+
+	RecordDNSRateLimit("dropped")
+	RecordDNSRateLimit("dropped")
+	RecordDNSRateLimit("slipped")
+
+	droppedCount := testutil.ToFloat64(dnsRateLimited.WithLabelValues("dropped"))
+	assert.Equal(t, initialDropped+2, droppedCount, "Expected dropped responses to increase by 2")
+
+	slippedCount := testutil.ToFloat64(dnsRateLimited.WithLabelValues("slipped"))
+	assert.Equal(t, initialSlipped+1, slippedCount, "Expected slipped responses to increase by 1")
+}
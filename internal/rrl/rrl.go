@@ -0,0 +1,323 @@
+// Package rrl implements DNS response rate limiting in the way BIND does: the
+// responses sent to a network prefix are accounted per response class and
+// name, and the ones over the limit are dropped or, every few of them, slipped
+// as a truncated response so that legitimate clients retry over TCP.
+//
+// The answers synthesized for the names below the zone that are not part of it,
+// such as the discovery tokens, are accounted to its wildcard so that a flood of
+// random names shares a single rate. The other names keep their own. The accounting table is bounded and spread over shards
+// with their own lock, the least recently used entries are evicted when full.
+package rrl
+
+import (
+	"container/list"
+	"hash/maphash"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dcarrillo/whatismyip/internal/metrics"
+	"github.com/miekg/dns"
+)
+
+type Action int
+
+const (
+	Allow Action = iota
+	Drop
+	Slip
+)
+
+// Response classes, every class has its own rate
+const (
+	ClassResponse = "response"
+	ClassNodata   = "nodata"
+	ClassNXDomain = "nxdomain"
+	ClassReferral = "referral"
+	ClassError    = "error"
+)
+
+const (
+	defaultWindow           = 15
+	defaultIPv4PrefixLength = 24
+	defaultIPv6PrefixLength = 56
+	defaultMaxBuckets       = 100000
+
+	shardCount = 32
+)
+
+// Config holds the limits, rates are responses per second. The rates of the
+// classes other than responses default to ResponsesPerSecond, which disables
+// the limits when zero.
+type Config struct {
+	ResponsesPerSecond int
+	NodataPerSecond    int
+	NXDomainsPerSecond int
+	ReferralsPerSecond int
+	ErrorsPerSecond    int
+	// Window is the number of seconds of excess responses accounted, a client
+	// has to slow down for that long to be answered again
+	Window int
+	// Slip sends one truncated response every Slip limited responses, 0
+	// drops all of them
+	Slip             int
+	IPv4PrefixLength int
+	IPv6PrefixLength int
+	// Zone is the name the server is authoritative for, the responses for the
+	// names below it Synthesized reports are accounted to its wildcard
+	Zone        string
+	Synthesized func(name string) bool
+	// MaxBuckets is the number of client, class and name tuples accounted at
+	// the same time
+	MaxBuckets int
+}
+
+type Limiter struct {
+	cfg    Config
+	rates  map[string]float64
+	zone   string
+	seed   maphash.Seed
+	shards [shardCount]shard
+	now    func() time.Time
+}
+
+type shard struct {
+	mu       sync.Mutex
+	capacity int
+	buckets  map[string]*bucket
+	// lru is ordered by the last response, the front is the most recent one
+	lru *list.List
+}
+
+// bucket holds the credit of a client, it is refilled at the rate of its class
+// up to one second worth of responses, and every response takes one
+type bucket struct {
+	key     string
+	balance float64
+	last    time.Time
+	limited int
+	elem    *list.Element
+}
+
+func New(cfg Config) *Limiter {
+	if cfg.Window <= 0 {
+		cfg.Window = defaultWindow
+	}
+	if cfg.IPv4PrefixLength <= 0 || cfg.IPv4PrefixLength > 32 {
+		cfg.IPv4PrefixLength = defaultIPv4PrefixLength
+	}
+	if cfg.IPv6PrefixLength <= 0 || cfg.IPv6PrefixLength > 128 {
+		cfg.IPv6PrefixLength = defaultIPv6PrefixLength
+	}
+	if cfg.MaxBuckets <= 0 {
+		cfg.MaxBuckets = defaultMaxBuckets
+	}
+
+	rate := func(r int) float64 {
+		if r <= 0 {
+			r = cfg.ResponsesPerSecond
+		}
+		return float64(r)
+	}
+
+	l := &Limiter{
+		cfg: cfg,
+		rates: map[string]float64{
+			ClassResponse: float64(cfg.ResponsesPerSecond),
+			ClassNodata:   rate(cfg.NodataPerSecond),
+			ClassNXDomain: rate(cfg.NXDomainsPerSecond),
+			ClassReferral: rate(cfg.ReferralsPerSecond),
+			ClassError:    rate(cfg.ErrorsPerSecond),
+		},
+		seed: maphash.MakeSeed(),
+		now:  time.Now,
+	}
+	if cfg.Zone != "" {
+		l.zone = dns.Fqdn(strings.ToLower(cfg.Zone))
+	}
+	for i := range l.shards {
+		l.shards[i] = shard{
+			capacity: max(cfg.MaxBuckets/shardCount, 1),
+			buckets:  map[string]*bucket{},
+			lru:      list.New(),
+		}
+	}
+
+	return l
+}
+
+// Check accounts a response of class about name sent to ip and returns what
+// to do with it
+func (l *Limiter) Check(ip net.IP, class string, name string) Action {
+	rate := l.rates[class]
+	if rate <= 0 || ip == nil {
+		return Allow
+	}
+
+	key := l.prefix(ip) + "/" + class + "/" + l.account(class, strings.ToLower(name))
+	now := l.now()
+	window := time.Duration(l.cfg.Window) * time.Second
+
+	s := &l.shards[maphash.String(l.seed, key)%shardCount]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.purge(now, window)
+	b, ok := s.buckets[key]
+	if !ok {
+		if len(s.buckets) >= s.capacity {
+			s.remove(s.lru.Back().Value.(*bucket))
+		}
+		b = &bucket{key: key, balance: rate, last: now}
+		b.elem = s.lru.PushFront(b)
+		s.buckets[key] = b
+	} else {
+		s.lru.MoveToFront(b.elem)
+	}
+	elapsed := now.Sub(b.last).Seconds()
+	b.last = now
+	b.balance = max(min(b.balance+elapsed*rate, rate)-1, -rate*float64(l.cfg.Window))
+	if b.balance >= 0 {
+		b.limited = 0
+		return Allow
+	}
+
+	b.limited++
+	if l.cfg.Slip > 0 && b.limited%l.cfg.Slip == 0 {
+		return Slip
+	}
+
+	return Drop
+}
+
+// account returns the name the responses of class about name are accounted
+// to: the wildcard of the zone for the answers synthesized for the names below it
+func (l *Limiter) account(class string, name string) string {
+	if class != ClassResponse || l.zone == "" || l.cfg.Synthesized == nil {
+		return name
+	}
+	qname, qtype, _ := strings.Cut(name, "/")
+	if qname != l.zone && dns.IsSubDomain(l.zone, qname) && l.cfg.Synthesized(qname) {
+		return "*." + l.zone + "/" + qtype
+	}
+
+	return name
+}
+
+// Len returns the number of buckets
+func (l *Limiter) Len() int {
+	n := 0
+	for i := range l.shards {
+		s := &l.shards[i]
+		s.mu.Lock()
+		n += len(s.buckets)
+		s.mu.Unlock()
+	}
+
+	return n
+}
+
+// purge removes the buckets of the clients that have been quiet longer than
+// the window, their credit is full again. They are at the back of the list.
+func (s *shard) purge(now time.Time, window time.Duration) {
+	for elem := s.lru.Back(); elem != nil; elem = s.lru.Back() {
+		b := elem.Value.(*bucket)
+		if now.Sub(b.last) <= window {
+			return
+		}
+		s.remove(b)
+	}
+}
+
+func (s *shard) remove(b *bucket) {
+	delete(s.buckets, b.key)
+	s.lru.Remove(b.elem)
+}
+
+func (l *Limiter) prefix(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(l.cfg.IPv4PrefixLength, 32)).String()
+	}
+
+	return ip.Mask(net.CIDRMask(l.cfg.IPv6PrefixLength, 128)).String()
+}
+
+// Classify returns the response class of msg and the name it is accounted to:
+// the query name and type for answers, the zone for negative answers and the
+// delegation for referrals
+func Classify(msg *dns.Msg) (class string, name string) {
+	zone := func() string {
+		for _, rr := range msg.Ns {
+			if t := rr.Header().Rrtype; t == dns.TypeSOA || t == dns.TypeNS {
+				return rr.Header().Name
+			}
+		}
+		if len(msg.Question) > 0 {
+			return msg.Question[0].Name
+		}
+		return ""
+	}
+
+	switch {
+	case msg.Rcode == dns.RcodeNameError:
+		return ClassNXDomain, zone()
+	case msg.Rcode != dns.RcodeSuccess || len(msg.Question) == 0:
+		return ClassError, ""
+	case len(msg.Answer) > 0 || msg.Truncated:
+		q := msg.Question[0]
+		return ClassResponse, q.Name + "/" + dns.TypeToString[q.Qtype]
+	case !msg.Authoritative && len(msg.Ns) > 0:
+		return ClassReferral, zone()
+	default:
+		return ClassNodata, zone()
+	}
+}
+
+// Handler limits the UDP responses of next, responses over TCP are never
+// limited as the source address of the client has been verified. So is the
+// address of a client that sent a valid DNS server cookie (RFC 7873).
+func Handler(next dns.Handler, l *Limiter) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		addr, ok := w.RemoteAddr().(*net.UDPAddr)
+		if cw, verified := w.(interface{ ValidCookie() bool }); !ok || (verified && cw.ValidCookie()) {
+			next.ServeDNS(w, r)
+			return
+		}
+		next.ServeDNS(&limitedWriter{ResponseWriter: w, limiter: l, ip: addr.IP}, r)
+	})
+}
+
+type limitedWriter struct {
+	dns.ResponseWriter
+	limiter *Limiter
+	ip      net.IP
+}
+
+func (w *limitedWriter) WriteMsg(msg *dns.Msg) error {
+	class, name := Classify(msg)
+	switch w.limiter.Check(w.ip, class, name) {
+	case Drop:
+		metrics.RecordDNSRateLimit("dropped")
+		return nil
+	case Slip:
+		metrics.RecordDNSRateLimit("slipped")
+		return w.ResponseWriter.WriteMsg(slip(msg))
+	default:
+		return w.ResponseWriter.WriteMsg(msg)
+	}
+}
+
+// slip returns an empty truncated copy of msg, the client can get the full
+// response over TCP
+func slip(msg *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.MsgHdr = msg.MsgHdr
+	m.Question = msg.Question
+	m.Truncated = true
+	if opt := msg.IsEdns0(); opt != nil {
+		m.Extra = []dns.RR{opt}
+	}
+
+	return m
+}
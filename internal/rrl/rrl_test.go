@@ -0,0 +1,207 @@
+package rrl
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time          { return c.t }
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestLimiter(cfg Config) (*Limiter, *clock) {
+	c := &clock{t: time.Unix(1700000000, 0)}
+	l := New(cfg)
+	l.now = c.now
+
+	return l, c
+}
+
+func TestCheck(t *testing.T) {
+	l, c := newTestLimiter(Config{ResponsesPerSecond: 2, Window: 2, Slip: 2})
+	ip := net.ParseIP("192.0.2.1")
+
+	assert.Equal(t, Allow, l.Check(ip, ClassResponse, "a"))
+	assert.Equal(t, Allow, l.Check(ip, ClassResponse, "a"))
+	assert.Equal(t, Drop, l.Check(ip, ClassResponse, "a"))
+	assert.Equal(t, Slip, l.Check(ip, ClassResponse, "a"))
+	assert.Equal(t, Drop, l.Check(ip, ClassResponse, "a"))
+
+	assert.Equal(t, Allow, l.Check(ip, ClassResponse, "b"), "names are accounted apart")
+	assert.Equal(t, Allow, l.Check(net.ParseIP("192.0.3.1"), ClassResponse, "a"), "prefixes are accounted apart")
+	assert.NotEqual(t, Allow, l.Check(net.ParseIP("192.0.2.200"), ClassResponse, "a"), "the /24 prefix is shared")
+
+	// the debt is limited by the window, two seconds worth of responses
+	c.advance(2 * time.Second)
+	assert.NotEqual(t, Allow, l.Check(ip, ClassResponse, "a"))
+	c.advance(3 * time.Second)
+	assert.Equal(t, Allow, l.Check(ip, ClassResponse, "a"))
+}
+
+func TestCheckClasses(t *testing.T) {
+	l, _ := newTestLimiter(Config{ResponsesPerSecond: 1, NXDomainsPerSecond: 3})
+	ip := net.ParseIP("2001:db8::1")
+
+	for range 3 {
+		assert.Equal(t, Allow, l.Check(ip, ClassNXDomain, "example.com."))
+	}
+	assert.NotEqual(t, Allow, l.Check(ip, ClassNXDomain, "example.com."))
+	assert.Equal(t, Allow, l.Check(ip, ClassError, ""))
+	assert.NotEqual(t, Allow, l.Check(net.ParseIP("2001:db8::ff"), ClassError, ""), "the /56 prefix is shared")
+}
+
+func TestCheckDisabled(t *testing.T) {
+	l, _ := newTestLimiter(Config{})
+	for range 100 {
+		assert.Equal(t, Allow, l.Check(net.ParseIP("192.0.2.1"), ClassResponse, "a"))
+	}
+}
+
+func TestCheckZone(t *testing.T) {
+	synthesized := func(name string) bool { return name != "www.dns.example.com." }
+	l, _ := newTestLimiter(Config{ResponsesPerSecond: 2, Slip: 0, Zone: "dns.example.com", Synthesized: synthesized})
+	ip := net.ParseIP("192.0.2.1")
+
+	assert.Equal(t, Allow, l.Check(ip, ClassResponse, "a1.dns.example.com./A"))
+	assert.Equal(t, Allow, l.Check(ip, ClassResponse, "b2.DNS.example.com./A"))
+	assert.Equal(t, Drop, l.Check(ip, ClassResponse, "c3.dns.example.com./A"), "random names share the wildcard")
+	assert.Equal(t, Allow, l.Check(ip, ClassResponse, "d4.dns.example.com./AAAA"), "types are accounted apart")
+	assert.Equal(t, Allow, l.Check(ip, ClassResponse, "dns.example.com./A"), "the apex is not the wildcard")
+	assert.Equal(t, Allow, l.Check(ip, ClassResponse, "www.example.com./A"), "names out of the zone")
+	assert.Equal(t, Allow, l.Check(ip, ClassResponse, "www.dns.example.com./A"), "static names keep their own bucket")
+	assert.Equal(t, Allow, l.Check(ip, ClassResponse, "www.dns.example.com./A"))
+	assert.Equal(t, Drop, l.Check(ip, ClassResponse, "www.dns.example.com./A"))
+}
+
+func TestPurge(t *testing.T) {
+	l, c := newTestLimiter(Config{ResponsesPerSecond: 1, Window: 5})
+	l.Check(net.ParseIP("192.0.2.1"), ClassResponse, "a")
+	require.Equal(t, 1, l.Len())
+
+	c.advance(6 * time.Second)
+	for i := range shardCount * 4 {
+		l.Check(net.ParseIP("198.51.100.1"), ClassResponse, fmt.Sprintf("name-%d", i))
+	}
+	assert.Equal(t, shardCount*4, l.Len(), "quiet clients are purged")
+}
+
+func TestCapacity(t *testing.T) {
+	l, c := newTestLimiter(Config{ResponsesPerSecond: 1, MaxBuckets: shardCount * 2})
+
+	for i := range 1000 {
+		l.Check(net.ParseIP(fmt.Sprintf("2001:db8:%x::1", i)), ClassResponse, "a")
+		c.advance(time.Millisecond)
+	}
+	assert.LessOrEqual(t, l.Len(), shardCount*2)
+	assert.Equal(t, Drop, l.Check(net.ParseIP("2001:db8:3e7::1"), ClassResponse, "a"), "recent clients are kept")
+}
+
+func TestClassify(t *testing.T) {
+	q := new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA)
+	soa, _ := dns.NewRR("example.com. 60 IN SOA ns. host. 1 2 3 4 5")
+	ns, _ := dns.NewRR("sub.example.com. 60 IN NS ns.sub.example.com.")
+	a, _ := dns.NewRR("www.example.com. 60 IN A 192.0.2.1")
+
+	tests := []struct {
+		name  string
+		msg   func() *dns.Msg
+		class string
+		zone  string
+	}{
+		{
+			name:  "answer",
+			msg:   func() *dns.Msg { m := new(dns.Msg).SetReply(q); m.Answer = []dns.RR{a}; return m },
+			class: ClassResponse,
+			zone:  "www.example.com./A",
+		},
+		{
+			name:  "nxdomain",
+			msg:   func() *dns.Msg { m := new(dns.Msg).SetRcode(q, dns.RcodeNameError); m.Ns = []dns.RR{soa}; return m },
+			class: ClassNXDomain,
+			zone:  "example.com.",
+		},
+		{
+			name:  "nodata",
+			msg:   func() *dns.Msg { m := new(dns.Msg).SetReply(q); m.Authoritative = true; m.Ns = []dns.RR{soa}; return m },
+			class: ClassNodata,
+			zone:  "example.com.",
+		},
+		{
+			name:  "referral",
+			msg:   func() *dns.Msg { m := new(dns.Msg).SetReply(q); m.Ns = []dns.RR{ns}; return m },
+			class: ClassReferral,
+			zone:  "sub.example.com.",
+		},
+		{
+			name:  "error",
+			msg:   func() *dns.Msg { return new(dns.Msg).SetRcode(q, dns.RcodeRefused) },
+			class: ClassError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			class, zone := Classify(tt.msg())
+			assert.Equal(t, tt.class, class)
+			assert.Equal(t, tt.zone, zone)
+		})
+	}
+}
+
+type testWriter struct {
+	dns.ResponseWriter
+	remote net.Addr
+	msgs   []*dns.Msg
+}
+
+func (w *testWriter) RemoteAddr() net.Addr        { return w.remote }
+func (w *testWriter) WriteMsg(msg *dns.Msg) error { w.msgs = append(w.msgs, msg); return nil }
+
+type cookieWriter struct {
+	testWriter
+}
+
+func (w *cookieWriter) ValidCookie() bool { return true }
+
+func TestHandler(t *testing.T) {
+	answer := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg).SetReply(r)
+		a, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 192.0.2.1")
+		m.Answer = []dns.RR{a}
+		_ = w.WriteMsg(m)
+	})
+	h := Handler(answer, New(Config{ResponsesPerSecond: 1, Slip: 1}))
+	r := new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA)
+
+	udp := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53}}
+	h.ServeDNS(udp, r)
+	h.ServeDNS(udp, r)
+	require.Len(t, udp.msgs, 2)
+	assert.Len(t, udp.msgs[0].Answer, 1)
+	assert.True(t, udp.msgs[1].Truncated, "slipped response")
+	assert.Empty(t, udp.msgs[1].Answer)
+
+	tcp := &testWriter{remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53}}
+	for range 3 {
+		h.ServeDNS(tcp, r)
+	}
+	require.Len(t, tcp.msgs, 3, "TCP is not limited")
+
+	cookie := &cookieWriter{testWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53}}}
+	for range 3 {
+		h.ServeDNS(cookie, r)
+	}
+	require.Len(t, cookie.msgs, 3, "a valid server cookie is not limited")
+	for _, msg := range cookie.msgs {
+		assert.Len(t, msg.Answer, 1)
+	}
+}
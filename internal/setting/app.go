@@ -2,13 +2,19 @@ package setting
 
 import (
 	"bytes"
+	"encoding/base64"
 	"errors"
 	"flag"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/dcarrillo/whatismyip/internal/core"
+	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/yaml.v3"
 )
 
@@ -22,12 +28,291 @@ type serverSettings struct {
 	WriteTimeout time.Duration
 }
 
+type stackTest struct {
+	Ipv4      string `yaml:"ipv4"`
+	Ipv6      string `yaml:"ipv6"`
+	DualStack string `yaml:"dual_stack"`
+}
+
+type dnsListen struct {
+	Ipv4      []string `yaml:"ipv4,omitempty"`
+	Ipv6      []string `yaml:"ipv6,omitempty"`
+	ReusePort int      `yaml:"reuse_port,omitempty"`
+	UDPSize   int      `yaml:"udp_size,omitempty"`
+	DoT       []string `yaml:"dot,omitempty"`
+	DoH       bool     `yaml:"doh,omitempty"`
+}
+
 type resolver struct {
-	Domain          string   `yaml:"domain"`
-	ResourceRecords []string `yaml:"resource_records"`
-	RedirectPort    string   `yaml:"redirect_port,omitempty"`
-	Ipv4            []string `yaml:"ipv4,omitempty"`
-	Ipv6            []string `yaml:"ipv6,omitempty"`
+	Domain          string         `yaml:"domain"`
+	ResourceRecords []string       `yaml:"resource_records"`
+	ZoneFile        string         `yaml:"zone_file,omitempty"`
+	RedirectPort    string         `yaml:"redirect_port,omitempty"`
+	RedirectScheme  string         `yaml:"redirect_scheme,omitempty"`
+	TLS             discoveryTLS   `yaml:"tls,omitempty"`
+	Ipv4            []string       `yaml:"ipv4,omitempty"`
+	Ipv6            []string       `yaml:"ipv6,omitempty"`
+	StackTest       stackTest      `yaml:"stack_test,omitempty"`
+	Listen          dnsListen      `yaml:"listen,omitempty"`
+	Whoami          []string       `yaml:"whoami"`
+	DNSSEC          dnssec         `yaml:"dnssec,omitempty"`
+	RRL             rrl            `yaml:"rrl,omitempty"`
+	Dnstap          dnstap         `yaml:"dnstap,omitempty"`
+	GeoDNS          geoDNS         `yaml:"geodns,omitempty"`
+	DynDNS          dynDNS         `yaml:"dyndns,omitempty"`
+	ACME            acme           `yaml:"acme,omitempty"`
+	Transfer        transfer       `yaml:"transfer,omitempty"`
+	Identity        identity       `yaml:"identity,omitempty"`
+	Cookies         cookies        `yaml:"cookies,omitempty"`
+	DiscoveryStore  discoveryStore `yaml:"discovery_store,omitempty"`
+	Tokens          tokens         `yaml:"tokens,omitempty"`
+}
+
+// discoveryTLS is the certificate of the discovery hosts, <domain> and
+// *.<domain>, served by the TLS listener besides the -tls-crt one. Clients get
+// the certificate that matches the server name they ask for.
+type discoveryTLS struct {
+	Crt string `yaml:"crt"`
+	Key string `yaml:"key"`
+}
+
+func (t discoveryTLS) Enabled() bool {
+	return t.Crt != ""
+}
+
+// tokens configures the signed discovery tokens. The secret they are signed
+// with is random when it is not set, it has to be shared by the replicas
+// sharing a discovery store.
+type tokens struct {
+	Secret string `yaml:"secret,omitempty"`
+	// TTL is the number of seconds a token is accepted
+	TTL int `yaml:"ttl,omitempty"`
+}
+
+// SecretBytes returns the decoded secret
+func (t tokens) SecretBytes() []byte {
+	secret, _ := base64.StdEncoding.DecodeString(t.Secret)
+	return secret
+}
+
+// discoveryStore configures where the discovery results are kept. They are local to
+// the process unless a Redis URL is set, which lets replicas share them.
+type discoveryStore struct {
+	// Expiration is the number of seconds the results are kept
+	Expiration int    `yaml:"expiration,omitempty"`
+	RedisURL   string `yaml:"redis_url,omitempty"`
+	// Prefix prefixes the Redis keys
+	Prefix string `yaml:"prefix,omitempty"`
+	// MaxEntries bounds the in-memory store, PrefixQuota the entries created
+	// for the clients of a /24 IPv4 or /56 IPv6 network
+	MaxEntries  int  `yaml:"max_entries,omitempty"`
+	PrefixQuota *int `yaml:"prefix_quota,omitempty"`
+}
+
+// Quota returns the prefix_quota setting, 0 disables the quota so it defaults
+// to 1000 when it is not set
+func (s discoveryStore) Quota() int {
+	if s.PrefixQuota == nil {
+		return defaultStoreQuota
+	}
+
+	return *s.PrefixQuota
+}
+
+// cookies configures the DNS server cookies (RFC 7873), which are always sent.
+// The secret they are derived from is random when it is not set, it has to be
+// shared by the instances behind the same address.
+type cookies struct {
+	Secret string `yaml:"secret,omitempty"`
+	// Rotation is the number of seconds the secret derived from Secret is used
+	Rotation int `yaml:"rotation,omitempty"`
+}
+
+// SecretBytes returns the decoded secret
+func (c cookies) SecretBytes() []byte {
+	secret, _ := base64.StdEncoding.DecodeString(c.Secret)
+	return secret
+}
+
+// identity configures the answers that tell which instance answered: the TXT
+// records of class CHAOS and the EDNS NSID option (RFC 5001). Every empty value
+// is disabled.
+type identity struct {
+	// Version is the answer to version.bind
+	Version string `yaml:"version,omitempty"`
+	// Hostname is the answer to hostname.bind
+	Hostname string `yaml:"hostname,omitempty"`
+	// ID is the answer to id.server (RFC 4892)
+	ID   string `yaml:"id,omitempty"`
+	NSID string `yaml:"nsid,omitempty"`
+}
+
+// transfer configures the zone transfers of the static zone to secondary
+// servers, they are notified when the zone is reloaded
+type transfer struct {
+	// AllowFrom are the networks allowed to transfer the zone
+	AllowFrom []string `yaml:"allow_from"`
+	// TSIG are the keys transfers must be signed with, if any
+	TSIG []tsigKey `yaml:"tsig,omitempty"`
+	// Notify are the addresses (host[:port]) of the secondaries
+	Notify []string `yaml:"notify,omitempty"`
+}
+
+type tsigKey struct {
+	Name      string `yaml:"name"`
+	Algorithm string `yaml:"algorithm"`
+	Secret    string `yaml:"secret"`
+}
+
+func (t transfer) Enabled() bool {
+	return len(t.AllowFrom) > 0
+}
+
+// TsigSecrets returns the secrets of the TSIG keys indexed by key name, as
+// expected by the DNS server
+func (t transfer) TsigSecrets() map[string]string {
+	if len(t.TSIG) == 0 {
+		return nil
+	}
+	secrets := map[string]string{}
+	for _, key := range t.TSIG {
+		secrets[fqdn(key.Name)] = key.Secret
+	}
+
+	return secrets
+}
+
+// acme configures the acme-dns compatible API that answers the DNS-01
+// challenges of the registered accounts
+type acme struct {
+	File string `yaml:"file"`
+	// RegisterFrom are the networks allowed to register accounts, registration
+	// is closed if empty
+	RegisterFrom []string `yaml:"register_from,omitempty"`
+	// Apex is the account of the challenges of the domain itself
+	Apex *acmeAccount `yaml:"apex,omitempty"`
+}
+
+type acmeAccount struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+func (a acme) Enabled() bool {
+	return a.File != ""
+}
+
+// dynDNS configures the dyndns2 compatible update service, users can publish
+// the addresses of their hostnames (relative to the domain)
+type dynDNS struct {
+	File  string       `yaml:"file"`
+	Users []dynDNSUser `yaml:"users"`
+}
+
+type dynDNSUser struct {
+	Username string `yaml:"username"`
+	// PasswordHash is the bcrypt hash of the password
+	PasswordHash string   `yaml:"password_hash"`
+	Hostnames    []string `yaml:"hostnames"`
+}
+
+func (d dynDNS) Enabled() bool {
+	return len(d.Users) > 0
+}
+
+// Hosts returns the fully qualified hostnames of every user under domain
+func (d dynDNS) Hosts(domain string) []string {
+	var hosts []string
+	for _, u := range d.Users {
+		for _, h := range u.Hostnames {
+			hosts = append(hosts, h+"."+strings.TrimSuffix(domain, "."))
+		}
+	}
+
+	return hosts
+}
+
+// geoDNS configures the addresses the apex and names (relative to the domain)
+// resolve to depending on the location of the client. The most specific match
+// wins: ASN, then country and then continent.
+type geoDNS struct {
+	Names     []string             `yaml:"names,omitempty"`
+	ASN       map[uint]geoAnswer   `yaml:"asn,omitempty"`
+	Country   map[string]geoAnswer `yaml:"country,omitempty"`
+	Continent map[string]geoAnswer `yaml:"continent,omitempty"`
+	// Default is the answer when nothing matches, the resolver addresses when
+	// it is empty
+	Default geoAnswer `yaml:"default,omitempty"`
+}
+
+type geoAnswer struct {
+	Ipv4 []string `yaml:"ipv4,omitempty"`
+	Ipv6 []string `yaml:"ipv6,omitempty"`
+}
+
+func (g geoDNS) Enabled() bool {
+	return len(g.ASN) > 0 || len(g.Country) > 0 || len(g.Continent) > 0
+}
+
+// dnstap configures the dnstap output of the DNS server, a frame streams Unix
+// socket or file
+type dnstap struct {
+	Socket   string `yaml:"socket,omitempty"`
+	File     string `yaml:"file,omitempty"`
+	Identity string `yaml:"identity,omitempty"`
+}
+
+func (d dnstap) Enabled() bool {
+	return d.Socket != "" || d.File != ""
+}
+
+// rrl configures the response rate limiting of the DNS server over UDP
+type rrl struct {
+	ResponsesPerSecond int  `yaml:"responses_per_second"`
+	NodataPerSecond    int  `yaml:"nodata_per_second"`
+	NXDomainsPerSecond int  `yaml:"nxdomains_per_second"`
+	ReferralsPerSecond int  `yaml:"referrals_per_second"`
+	ErrorsPerSecond    int  `yaml:"errors_per_second"`
+	Window             int  `yaml:"window"`
+	Slip               *int `yaml:"slip"`
+	IPv4PrefixLength   int  `yaml:"ipv4_prefix_length"`
+	IPv6PrefixLength   int  `yaml:"ipv6_prefix_length"`
+	// MaxTableSize is the number of clients and names accounted at the same
+	// time, as BIND max-table-size
+	MaxTableSize int `yaml:"max_table_size"`
+}
+
+func (r rrl) Enabled() bool {
+	return r.ResponsesPerSecond > 0
+}
+
+// SlipRate returns the slip setting, 0 disables slipping so it defaults to 2
+// when it is not set
+func (r rrl) SlipRate() int {
+	if r.Slip == nil {
+		return defaultRRLSlip
+	}
+
+	return *r.Slip
+}
+
+type dnssec struct {
+	// Keys are the paths of the keys in BIND format without the .key and
+	// .private extensions
+	Keys []string `yaml:"keys"`
+}
+
+// Enabled reports whether the dual-stack connectivity test hostnames are configured
+func (s stackTest) Enabled() bool {
+	return s.Ipv4 != "" && s.Ipv6 != "" && s.DualStack != ""
+}
+
+type virtualHost struct {
+	Hosts          []string `yaml:"hosts"`
+	Template       string   `yaml:"template,omitempty"`
+	DisableTCPScan bool     `yaml:"disable_scan,omitempty"`
+	DisableGeo     bool     `yaml:"disable_geo,omitempty"`
+	DisableHeaders bool     `yaml:"disable_headers,omitempty"`
 }
 
 type settings struct {
@@ -45,10 +330,23 @@ type settings struct {
 	DisableTCPScan      bool
 	Server              serverSettings
 	Resolver            resolver
+	VirtualHosts        []virtualHost
 	version             bool
 }
 
-const defaultAddress = ":8080"
+const (
+	defaultAddress    = ":8080"
+	defaultDNSUDPSize = 1232
+	defaultRRLSlip    = 2
+
+	defaultStoreExpiration = 60
+	defaultStorePrefix     = "whatismyip:"
+	defaultStoreMaxEntries = 100000
+	defaultStoreQuota      = 1000
+	defaultTokenTTL        = 300
+)
+
+var defaultWhoami = []string{"whoami", "o-o.myaddr"}
 
 var ErrVersion = errors.New("setting: version requested")
 
@@ -64,6 +362,7 @@ func Setup(args []string) (output string, err error) {
 	flags := flag.NewFlagSet("whatismyip", flag.ContinueOnError)
 	var buf bytes.Buffer
 	var resolverConf string
+	var vhostsConf string
 	flags.SetOutput(&buf)
 
 	flags.StringVar(&App.GeodbPath.City, "geoip2-city", "", "Path to GeoIP2 city database. Enables geo information (--geoip2-asn becomes mandatory)")
@@ -74,6 +373,11 @@ func Setup(args []string) (output string, err error) {
 		"resolver",
 		"",
 		"Path to the resolver configuration. It actually enables the resolver for DNS client discovery.")
+	flags.StringVar(
+		&vhostsConf,
+		"vhosts",
+		"",
+		"Path to the virtual hosts configuration. Every virtual host has its own template and features, requests for unknown hosts are served by the default one.")
 	flags.StringVar(
 		&App.BindAddress,
 		"bind",
@@ -152,30 +456,395 @@ func Setup(args []string) (output string, err error) {
 	}
 
 	if App.TemplatePath != "" {
-		info, err := os.Stat(App.TemplatePath)
-		if os.IsNotExist(err) {
-			return "", fmt.Errorf("%s no such file or directory", App.TemplatePath)
+		if err := checkFile(App.TemplatePath); err != nil {
+			return "", err
+		}
+	}
+
+	if vhostsConf != "" {
+		App.VirtualHosts = nil
+		if err := readYAML(vhostsConf, &App.VirtualHosts); err != nil {
+			return "", fmt.Errorf("error reading virtual hosts configuration %w", err)
 		}
-		if info.IsDir() {
-			return "", fmt.Errorf("%s must be a file", App.TemplatePath)
+		for _, vh := range App.VirtualHosts {
+			if len(vh.Hosts) == 0 {
+				return "", fmt.Errorf("hosts is mandatory for every virtual host")
+			}
+			if vh.Template != "" {
+				if err := checkFile(vh.Template); err != nil {
+					return "", err
+				}
+			}
 		}
 	}
 
 	if resolverConf != "" {
-		var err error
-		App.Resolver, err = readYAML(resolverConf)
-		if err != nil {
+		App.Resolver = resolver{}
+		if err := readYAML(resolverConf, &App.Resolver); err != nil {
 			return "", fmt.Errorf("error reading resolver configuration %w", err)
 		}
+		if App.Resolver.ZoneFile != "" {
+			if err := checkFile(App.Resolver.ZoneFile); err != nil {
+				return "", err
+			}
+		}
+		if err := checkRRL(App.Resolver.RRL); err != nil {
+			return "", err
+		}
+		if App.Resolver.Dnstap.Socket != "" && App.Resolver.Dnstap.File != "" {
+			return "", fmt.Errorf("dnstap socket and file are mutually exclusive")
+		}
+		if err := checkGeoDNS(App.Resolver.GeoDNS); err != nil {
+			return "", err
+		}
+		if err := checkDynDNS(App.Resolver.DynDNS); err != nil {
+			return "", err
+		}
+		if err := checkACME(App.Resolver.ACME); err != nil {
+			return "", err
+		}
+		if err := checkTransfer(App.Resolver.Transfer); err != nil {
+			return "", err
+		}
+		// the zone is signed online, secondaries would serve it unsigned
+		if App.Resolver.Transfer.Enabled() && len(App.Resolver.DNSSEC.Keys) > 0 {
+			return "", fmt.Errorf("transfer and dnssec are mutually exclusive")
+		}
+		if err := checkIdentity(App.Resolver.Identity); err != nil {
+			return "", err
+		}
+		if err := checkCookies(App.Resolver.Cookies); err != nil {
+			return "", err
+		}
+		if err := checkStore(App.Resolver.DiscoveryStore); err != nil {
+			return "", err
+		}
+		if err := checkTokens(App.Resolver.Tokens, App.Resolver.DiscoveryStore); err != nil {
+			return "", err
+		}
+		if App.Resolver.Tokens.TTL == 0 {
+			App.Resolver.Tokens.TTL = defaultTokenTTL
+		}
+		if App.Resolver.DiscoveryStore.Expiration == 0 {
+			App.Resolver.DiscoveryStore.Expiration = defaultStoreExpiration
+		}
+		if App.Resolver.DiscoveryStore.RedisURL != "" && App.Resolver.DiscoveryStore.Prefix == "" {
+			App.Resolver.DiscoveryStore.Prefix = defaultStorePrefix
+		}
+		if App.Resolver.DiscoveryStore.MaxEntries == 0 {
+			App.Resolver.DiscoveryStore.MaxEntries = defaultStoreMaxEntries
+		}
+		for _, key := range App.Resolver.DNSSEC.Keys {
+			for _, ext := range []string{".key", ".private"} {
+				if err := checkFile(key + ext); err != nil {
+					return "", err
+				}
+			}
+		}
+		// an empty list disables the whoami names
+		if App.Resolver.Whoami == nil {
+			App.Resolver.Whoami = defaultWhoami
+		}
+		if App.Resolver.Listen.UDPSize == 0 {
+			App.Resolver.Listen.UDPSize = defaultDNSUDPSize
+		}
+		if App.Resolver.Listen.UDPSize < 512 || App.Resolver.Listen.UDPSize > 65535 {
+			return "", fmt.Errorf("udp_size must be between 512 and 65535")
+		}
+		if App.Resolver.Listen.ReusePort < 0 {
+			return "", fmt.Errorf("reuse_port must be a positive number of sockets")
+		}
+		if len(App.Resolver.Listen.DoT) > 0 && (App.TLSCrtPath == "" || App.TLSKeyPath == "") {
+			return "", fmt.Errorf("in order to use DNS over TLS, the -tls-crt and -tls-key flags are mandatory")
+		}
+		if s := App.Resolver.RedirectScheme; s != "" && s != "http" && s != "https" {
+			return "", fmt.Errorf("redirect_scheme must be http or https")
+		}
+		if err := checkDiscoveryTLS(App.Resolver.TLS); err != nil {
+			return "", err
+		}
+		st := App.Resolver.StackTest
+		if (st.Ipv4 != "" || st.Ipv6 != "" || st.DualStack != "") && !st.Enabled() {
+			return "", fmt.Errorf("ipv4, ipv6 and dual_stack are mandatory to enable the stack test")
+		}
+		if st.Enabled() && (len(App.Resolver.Ipv4) == 0 || len(App.Resolver.Ipv6) == 0) {
+			return "", fmt.Errorf("resolver ipv4 and ipv6 addresses are mandatory to enable the stack test")
+		}
+		// the hostnames prefixed by a token, <token>-<label>.<domain>, have to be
+		// covered by the certificate of *.<domain>
+		for _, label := range []string{st.Ipv4, st.Ipv6, st.DualStack} {
+			if strings.Contains(label, ".") {
+				return "", fmt.Errorf("stack test hostname %q must be a single label", label)
+			}
+		}
 	}
 
 	return buf.String(), nil
 }
 
-func readYAML(path string) (resolver resolver, err error) {
+func checkRRL(r rrl) error {
+	for _, v := range []int{r.ResponsesPerSecond, r.NodataPerSecond, r.NXDomainsPerSecond, r.ReferralsPerSecond, r.ErrorsPerSecond, r.Window, r.MaxTableSize} {
+		if v < 0 {
+			return fmt.Errorf("rrl rates, window and max_table_size must be positive numbers")
+		}
+	}
+	if r.SlipRate() < 0 || r.SlipRate() > 10 {
+		return fmt.Errorf("rrl slip must be between 0 and 10")
+	}
+	if r.IPv4PrefixLength < 0 || r.IPv4PrefixLength > 32 || r.IPv6PrefixLength < 0 || r.IPv6PrefixLength > 128 {
+		return fmt.Errorf("rrl prefix lengths must be valid IPv4 and IPv6 prefix lengths")
+	}
+
+	return nil
+}
+
+var continents = []string{"AF", "AN", "AS", "EU", "NA", "OC", "SA"}
+
+func checkGeoDNS(g geoDNS) error {
+	if !g.Enabled() {
+		return nil
+	}
+	// the country and continent rules look up the city database, the asn
+	// rules the ASN one
+	if App.GeodbPath.City == "" || App.GeodbPath.ASN == "" {
+		return fmt.Errorf("geodns requires the --geoip2-city and --geoip2-asn databases")
+	}
+
+	answers := []geoAnswer{g.Default}
+	for _, a := range g.ASN {
+		answers = append(answers, a)
+	}
+	for country, a := range g.Country {
+		if len(country) != 2 || strings.ToUpper(country) != country {
+			return fmt.Errorf("geodns country %q is not an ISO 3166 alpha-2 code", country)
+		}
+		answers = append(answers, a)
+	}
+	for continent, a := range g.Continent {
+		if !slices.Contains(continents, continent) {
+			return fmt.Errorf("geodns continent %q must be one of %s", continent, strings.Join(continents, ", "))
+		}
+		answers = append(answers, a)
+	}
+	for _, a := range answers {
+		for _, ip := range a.Ipv4 {
+			if addr := net.ParseIP(ip); addr == nil || addr.To4() == nil {
+				return fmt.Errorf("geodns ipv4 address %q is not valid", ip)
+			}
+		}
+		for _, ip := range a.Ipv6 {
+			if addr := net.ParseIP(ip); addr == nil || addr.To4() != nil {
+				return fmt.Errorf("geodns ipv6 address %q is not valid", ip)
+			}
+		}
+	}
+
+	return nil
+}
+
+func checkDynDNS(d dynDNS) error {
+	if !d.Enabled() {
+		return nil
+	}
+	if d.File == "" {
+		return fmt.Errorf("dyndns file is mandatory")
+	}
+
+	usernames := map[string]struct{}{}
+	for _, u := range d.Users {
+		if u.Username == "" || u.PasswordHash == "" || len(u.Hostnames) == 0 {
+			return fmt.Errorf("dyndns username, password_hash and hostnames are mandatory for every user")
+		}
+		if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+			return fmt.Errorf("dyndns password_hash of %q is not a bcrypt hash: %w", u.Username, err)
+		}
+		if strings.Contains(u.Username, ":") {
+			return fmt.Errorf("dyndns username %q cannot contain a colon", u.Username)
+		}
+		if _, ok := usernames[u.Username]; ok {
+			return fmt.Errorf("dyndns username %q is duplicated", u.Username)
+		}
+		usernames[u.Username] = struct{}{}
+	}
+
+	return nil
+}
+
+func checkACME(a acme) error {
+	for _, cidr := range a.RegisterFrom {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("acme register_from: %w", err)
+		}
+	}
+	if a.Apex != nil && (a.Apex.Username == "" || a.Apex.Password == "") {
+		return fmt.Errorf("acme apex username and password are mandatory")
+	}
+
+	return nil
+}
+
+// tsigAlgorithms are the supported TSIG algorithms
+var tsigAlgorithms = []string{"hmac-sha1.", "hmac-sha224.", "hmac-sha256.", "hmac-sha384.", "hmac-sha512."}
+
+// fqdn returns the lowercased fully qualified form of name
+func fqdn(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, ".")) + "."
+}
+
+func checkTransfer(t transfer) error {
+	for _, cidr := range t.AllowFrom {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("transfer allow_from: %w", err)
+		}
+	}
+	for _, key := range t.TSIG {
+		if key.Name == "" || key.Secret == "" {
+			return fmt.Errorf("transfer tsig name and secret are mandatory")
+		}
+		if !slices.Contains(tsigAlgorithms, fqdn(key.Algorithm)) {
+			return fmt.Errorf("transfer tsig %s: unsupported algorithm %q", key.Name, key.Algorithm)
+		}
+		if _, err := base64.StdEncoding.DecodeString(key.Secret); err != nil {
+			return fmt.Errorf("transfer tsig %s: invalid secret: %w", key.Name, err)
+		}
+	}
+	if len(t.Notify) > 0 && !t.Enabled() {
+		return fmt.Errorf("transfer allow_from is mandatory to notify secondaries")
+	}
+	for _, addr := range t.Notify {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		if net.ParseIP(host) == nil {
+			return fmt.Errorf("transfer notify: invalid address %q", addr)
+		}
+	}
+
+	return nil
+}
+
+// maxIdentityLength is the length of a TXT character string
+const maxIdentityLength = 255
+
+func checkIdentity(i identity) error {
+	for name, v := range map[string]string{"version": i.Version, "hostname": i.Hostname, "id": i.ID, "nsid": i.NSID} {
+		if len(v) > maxIdentityLength {
+			return fmt.Errorf("identity %s must be at most %d bytes", name, maxIdentityLength)
+		}
+	}
+
+	return nil
+}
+
+// minCookieSecretLength is the minimum length of the cookie secret (RFC 7873,
+// section 7.1 recommends at least 64 bits)
+const minCookieSecretLength = 16
+
+func checkCookies(c cookies) error {
+	if c.Secret != "" {
+		secret, err := base64.StdEncoding.DecodeString(c.Secret)
+		if err != nil {
+			return fmt.Errorf("cookies secret: %w", err)
+		}
+		if len(secret) < minCookieSecretLength {
+			return fmt.Errorf("cookies secret must be at least %d bytes long", minCookieSecretLength)
+		}
+	}
+	if c.Rotation < 0 {
+		return fmt.Errorf("cookies rotation must be a positive number of seconds")
+	}
+
+	return nil
+}
+
+func checkDiscoveryTLS(t discoveryTLS) error {
+	if t.Crt == "" && t.Key == "" {
+		return nil
+	}
+	if t.Crt == "" || t.Key == "" {
+		return fmt.Errorf("tls crt and key are mandatory")
+	}
+	if App.TLSAddress == "" {
+		return fmt.Errorf("in order to use the tls certificate, the -tls-bind flag is mandatory")
+	}
+	for _, path := range []string{t.Crt, t.Key} {
+		if err := checkFile(path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// minTokenSecretLength is the minimum length of the secret the discovery tokens
+// are signed with
+const minTokenSecretLength = 16
+
+// checkTokens requires a secret when the discovery store is shared through
+// Redis, so that every instance validates the tokens issued by the others
+func checkTokens(t tokens, s discoveryStore) error {
+	if s.RedisURL != "" && t.Secret == "" {
+		return fmt.Errorf("tokens secret is mandatory when the discovery store is shared through redis")
+	}
+	if t.Secret != "" {
+		secret, err := base64.StdEncoding.DecodeString(t.Secret)
+		if err != nil {
+			return fmt.Errorf("tokens secret: %w", err)
+		}
+		if len(secret) < minTokenSecretLength {
+			return fmt.Errorf("tokens secret must be at least %d bytes long", minTokenSecretLength)
+		}
+	}
+	if t.TTL < 0 {
+		return fmt.Errorf("tokens ttl must be a positive number of seconds")
+	}
+
+	return nil
+}
+
+func checkStore(s discoveryStore) error {
+	if s.Expiration < 0 {
+		return fmt.Errorf("discovery_store expiration must be a positive number of seconds")
+	}
+	if s.MaxEntries < 0 {
+		return fmt.Errorf("discovery_store max_entries must be a positive number")
+	}
+	if s.Quota() < 0 {
+		return fmt.Errorf("discovery_store prefix_quota must be a positive number")
+	}
+	if s.RedisURL != "" {
+		u, err := url.Parse(s.RedisURL)
+		if err != nil {
+			return fmt.Errorf("discovery_store redis_url: %w", err)
+		}
+		if !slices.Contains([]string{"redis", "rediss", "unix"}, u.Scheme) {
+			return fmt.Errorf("discovery_store redis_url: unsupported scheme %q", u.Scheme)
+		}
+	}
+
+	return nil
+}
+
+func readYAML(path string, out any) error {
 	yamlFile, err := os.ReadFile(path)
 	if err != nil {
-		return resolver, err
+		return err
 	}
-	return resolver, yaml.Unmarshal(yamlFile, &resolver)
+	return yaml.Unmarshal(yamlFile, out)
+}
+
+func checkFile(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s no such file or directory", path)
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s must be a file", path)
+	}
+
+	return nil
 }
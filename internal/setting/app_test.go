@@ -2,6 +2,8 @@ package setting
 
 import (
 	"flag"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -215,3 +217,495 @@ func TestParseFlagTemplate(t *testing.T) {
 		})
 	}
 }
+
+func TestParseVirtualHosts(t *testing.T) {
+	dir := t.TempDir()
+	template := filepath.Join(dir, "template.tmpl")
+	require.NoError(t, os.WriteFile(template, []byte("{{ .IP }}"), 0o600))
+
+	testCases := []struct {
+		name   string
+		conf   string
+		errMsg string
+	}{
+		{
+			name:   "Virtual host without hosts",
+			conf:   "- template: " + template + "\n",
+			errMsg: "hosts is mandatory",
+		},
+		{
+			name:   "Virtual host with an invalid template",
+			conf:   "- hosts: [example.com]\n  template: /template-path\n",
+			errMsg: "no such file or directory",
+		},
+		{
+			name: "Valid virtual hosts",
+			conf: "- hosts: [example.com, '*.example.com']\n  template: " + template + "\n  disable_scan: true\n" +
+				"- hosts: [example.org]\n  disable_geo: true\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, "vhosts.yml")
+			require.NoError(t, os.WriteFile(path, []byte(tc.conf), 0o600))
+
+			_, err := Setup([]string{"-vhosts", path})
+			if tc.errMsg == "" {
+				require.NoError(t, err)
+				assert.Equal(t, []virtualHost{
+					{Hosts: []string{"example.com", "*.example.com"}, Template: template, DisableTCPScan: true},
+					{Hosts: []string{"example.org"}, DisableGeo: true},
+				}, App.VirtualHosts)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.errMsg)
+		})
+	}
+	App.VirtualHosts = nil
+}
+
+const (
+	testBcryptHash   = "$2a$10$w6RCKD5DOEB.NOqQKrk3fO6r3Bew/sT6LSwSur8sGarN.IDvUVQlG"
+	testSharedSecret = "tokens:\n  secret: c2VjcmV0LXNlY3JldC1zZWNyZXQ=\n"
+)
+
+var testTLSFlags = []string{"-tls-bind", ":8443", "-tls-crt", "../../test/server.pem", "-tls-key", "../../test/server.key"}
+
+func TestParseResolver(t *testing.T) {
+	zone := filepath.Join(t.TempDir(), "dns.example.com.zone")
+	require.NoError(t, os.WriteFile(zone, []byte("www 60 IN A 192.0.2.1\n"), 0o600))
+	geoFlags := []string{"-geoip2-city", "city", "-geoip2-asn", "asn"}
+	t.Cleanup(func() { App.GeodbPath = geodbConf{} })
+
+	testCases := []struct {
+		name  string
+		conf  string
+		flags []string
+		check func(t *testing.T, r resolver)
+	}{
+		{
+			name: "Defaults",
+			check: func(t *testing.T, r resolver) {
+				assert.Equal(t, 1232, r.Listen.UDPSize)
+				assert.Equal(t, []string{"whoami", "o-o.myaddr"}, r.Whoami)
+				assert.Equal(t, tokens{TTL: 300}, r.Tokens)
+				assert.Equal(t, discoveryStore{Expiration: 60, MaxEntries: 100000}, r.DiscoveryStore)
+				assert.Equal(t, 1000, r.DiscoveryStore.Quota())
+				assert.False(t, r.RRL.Enabled())
+			},
+		},
+		{
+			name: "Listen",
+			conf: "listen:\n  ipv4: [127.0.0.1]\n  reuse_port: 4\n  udp_size: 4096\n",
+			check: func(t *testing.T, r resolver) {
+				assert.Equal(t, 4096, r.Listen.UDPSize)
+				assert.Equal(t, 4, r.Listen.ReusePort)
+			},
+		},
+		{
+			name:  "Zone file",
+			conf:  "zone_file: " + zone + "\n",
+			check: func(t *testing.T, r resolver) { assert.Equal(t, zone, r.ZoneFile) },
+		},
+		{
+			name:  "Stack test",
+			conf:  "ipv4: [127.0.0.1]\nipv6: ['::1']\nstack_test:\n  ipv4: v4\n  ipv6: v6\n  dual_stack: ds\n",
+			check: func(t *testing.T, r resolver) { assert.True(t, r.StackTest.Enabled()) },
+		},
+		{
+			name: "RRL",
+			conf: "rrl:\n  responses_per_second: 5\n",
+			check: func(t *testing.T, r resolver) {
+				assert.True(t, r.RRL.Enabled())
+				assert.Equal(t, 2, r.RRL.SlipRate())
+			},
+		},
+		{
+			name:  "RRL without slip",
+			conf:  "rrl:\n  responses_per_second: 5\n  slip: 0\n",
+			check: func(t *testing.T, r resolver) { assert.Equal(t, 0, r.RRL.SlipRate()) },
+		},
+		{
+			name:  "Dnstap",
+			conf:  "dnstap:\n  socket: /run/dnstap.sock\n",
+			check: func(t *testing.T, r resolver) { assert.True(t, r.Dnstap.Enabled()) },
+		},
+		{
+			name:  "GeoDNS",
+			conf:  "geodns:\n  names: [www]\n  country:\n    ES: {ipv4: [192.0.2.1], ipv6: [\"2001:db8::1\"]}\n  continent:\n    EU: {ipv4: [192.0.2.2]}\n",
+			flags: geoFlags,
+			check: func(t *testing.T, r resolver) { assert.True(t, r.GeoDNS.Enabled()) },
+		},
+		{
+			name: "DynDNS",
+			conf: "dyndns:\n  file: /tmp/dyndns.json\n  users:\n    - {username: alice, password_hash: '" + testBcryptHash + "', hostnames: [home, lab]}\n",
+			check: func(t *testing.T, r resolver) {
+				assert.True(t, r.DynDNS.Enabled())
+				assert.Equal(t, []string{"home.dns.example.com", "lab.dns.example.com"}, r.DynDNS.Hosts("dns.example.com."))
+			},
+		},
+		{
+			name:  "ACME",
+			conf:  "acme:\n  file: /tmp/acme.json\n  register_from: [192.0.2.0/24]\n  apex:\n    username: apex\n    password: secret\n",
+			check: func(t *testing.T, r resolver) { assert.True(t, r.ACME.Enabled()) },
+		},
+		{
+			name: "Transfer",
+			conf: "transfer:\n  allow_from: [192.0.2.0/24, 2001:db8::/32]\n  tsig:\n    - name: XFR.example.com\n      algorithm: HMAC-SHA256.\n      secret: c2VjcmV0\n  notify: [192.0.2.2, \"[2001:db8::2]:5353\"]\n",
+			check: func(t *testing.T, r resolver) {
+				assert.True(t, r.Transfer.Enabled())
+				assert.Equal(t, map[string]string{"xfr.example.com.": "c2VjcmV0"}, r.Transfer.TsigSecrets())
+			},
+		},
+		{
+			name: "Identity",
+			conf: "identity:\n  version: whatismyip\n  id: mad1\n",
+			check: func(t *testing.T, r resolver) {
+				assert.Equal(t, "whatismyip", r.Identity.Version)
+				assert.Equal(t, "mad1", r.Identity.ID)
+				assert.Empty(t, r.Identity.NSID)
+			},
+		},
+		{
+			name: "Cookies",
+			conf: "cookies:\n  secret: c2VjcmV0LXNlY3JldC1zZWNyZXQ=\n  rotation: 86400\n",
+			check: func(t *testing.T, r resolver) {
+				assert.Equal(t, []byte("secret-secret-secret"), r.Cookies.SecretBytes())
+				assert.Equal(t, 86400, r.Cookies.Rotation)
+			},
+		},
+		{
+			name: "Redis store defaults",
+			conf: testSharedSecret + "discovery_store:\n  redis_url: redis://127.0.0.1:6379/0\n",
+			check: func(t *testing.T, r resolver) {
+				assert.Equal(t, 1000, r.DiscoveryStore.Quota())
+				assert.Equal(t, discoveryStore{Expiration: 60, RedisURL: "redis://127.0.0.1:6379/0", Prefix: "whatismyip:", MaxEntries: 100000}, r.DiscoveryStore)
+			},
+		},
+		{
+			name: "Discovery store",
+			conf: testSharedSecret + "discovery_store:\n  expiration: 300\n  redis_url: rediss://redis.example.com:6380\n  prefix: \"dns:\"\n  max_entries: 5000\n  prefix_quota: 50\n",
+			check: func(t *testing.T, r resolver) {
+				assert.Equal(t, 50, r.DiscoveryStore.Quota())
+				r.DiscoveryStore.PrefixQuota = nil
+				assert.Equal(t, discoveryStore{Expiration: 300, RedisURL: "rediss://redis.example.com:6380", Prefix: "dns:", MaxEntries: 5000}, r.DiscoveryStore)
+			},
+		},
+		{
+			name: "Disabled prefix quota",
+			conf: "discovery_store:\n  prefix_quota: 0\n",
+			check: func(t *testing.T, r resolver) {
+				assert.Equal(t, 0, r.DiscoveryStore.Quota())
+				r.DiscoveryStore.PrefixQuota = nil
+				assert.Equal(t, discoveryStore{Expiration: 60, MaxEntries: 100000}, r.DiscoveryStore)
+			},
+		},
+		{
+			name: "Tokens",
+			conf: "tokens:\n  secret: c2VjcmV0LXNlY3JldC1zZWNyZXQ=\n  ttl: 600\n",
+			check: func(t *testing.T, r resolver) {
+				assert.Equal(t, tokens{Secret: "c2VjcmV0LXNlY3JldC1zZWNyZXQ=", TTL: 600}, r.Tokens)
+			},
+		},
+		{
+			name:  "Redirect",
+			conf:  "redirect_scheme: https\nredirect_port: \":8443\"\ntls:\n  crt: ../../test/server.pem\n  key: ../../test/server.key\n",
+			flags: testTLSFlags,
+			check: func(t *testing.T, r resolver) {
+				assert.Equal(t, "https", r.RedirectScheme)
+				assert.Equal(t, ":8443", r.RedirectPort)
+				assert.True(t, r.TLS.Enabled())
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.NoError(t, setupResolverYAML(t, "domain: dns.example.com\n"+tc.conf, tc.flags...))
+			tc.check(t, App.Resolver)
+		})
+	}
+}
+
+func TestParseResolverErrors(t *testing.T) {
+	t.Cleanup(func() { App.GeodbPath = geodbConf{} })
+	geoFlags := []string{"-geoip2-city", "city", "-geoip2-asn", "asn"}
+
+	testCases := []struct {
+		name   string
+		conf   string
+		flags  []string
+		errMsg string
+	}{
+		{
+			name:   "UDP size too small",
+			conf:   "listen:\n  udp_size: 100\n",
+			errMsg: "udp_size must be between 512 and 65535",
+		},
+		{
+			name:   "Negative number of sockets",
+			conf:   "listen:\n  reuse_port: -1\n",
+			errMsg: "reuse_port must be a positive number",
+		},
+		{
+			name:   "Missing zone file",
+			conf:   "zone_file: /nonexistent/dns.example.com.zone\n",
+			errMsg: "no such file or directory",
+		},
+		{
+			name:   "Missing DNSSEC key files",
+			conf:   "dnssec:\n  keys: [/nonexistent/Kdns.example.com.+013+12345]\n",
+			errMsg: "no such file or directory",
+		},
+		{
+			name:   "Incomplete stack test hosts",
+			conf:   "ipv4: [127.0.0.1]\nipv6: ['::1']\nstack_test:\n  ipv4: v4\n",
+			errMsg: "ipv4, ipv6 and dual_stack are mandatory",
+		},
+		{
+			name:   "Stack test without resolver addresses",
+			conf:   "ipv4: [127.0.0.1]\nstack_test:\n  ipv4: v4\n  ipv6: v6\n  dual_stack: ds\n",
+			errMsg: "ipv4 and ipv6 addresses are mandatory",
+		},
+		{
+			name:   "Stack test hostname of several labels",
+			conf:   "ipv4: [127.0.0.1]\nipv6: ['::1']\nstack_test:\n  ipv4: v4.test\n  ipv6: v6\n  dual_stack: ds\n",
+			errMsg: "stack test hostname \"v4.test\" must be a single label",
+		},
+		{
+			name:   "Negative RRL rate",
+			conf:   "rrl:\n  responses_per_second: -1\n",
+			errMsg: "rrl rates, window and max_table_size must be positive numbers",
+		},
+		{
+			name:   "Invalid RRL slip",
+			conf:   "rrl:\n  responses_per_second: 5\n  slip: 11\n",
+			errMsg: "rrl slip must be between 0 and 10",
+		},
+		{
+			name:   "Invalid RRL prefix length",
+			conf:   "rrl:\n  responses_per_second: 5\n  ipv4_prefix_length: 33\n",
+			errMsg: "rrl prefix lengths",
+		},
+		{
+			name:   "Dnstap socket and file",
+			conf:   "dnstap:\n  socket: /run/dnstap.sock\n  file: /var/log/dnstap\n",
+			errMsg: "dnstap socket and file are mutually exclusive",
+		},
+		{
+			name:   "Missing geo databases",
+			conf:   "geodns:\n  country:\n    ES: {ipv4: [192.0.2.1]}\n",
+			errMsg: "geodns requires the --geoip2-city and --geoip2-asn databases",
+		},
+		{
+			name:   "Invalid GeoDNS country",
+			conf:   "geodns:\n  country:\n    spain: {ipv4: [192.0.2.1]}\n",
+			flags:  geoFlags,
+			errMsg: "geodns country \"spain\" is not an ISO 3166 alpha-2 code",
+		},
+		{
+			name:   "Invalid GeoDNS continent",
+			conf:   "geodns:\n  continent:\n    XX: {ipv4: [192.0.2.1]}\n",
+			flags:  geoFlags,
+			errMsg: "geodns continent \"XX\" must be one of",
+		},
+		{
+			name:   "Invalid GeoDNS address family",
+			conf:   "geodns:\n  asn:\n    3352: {ipv4: [\"2001:db8::1\"]}\n",
+			flags:  geoFlags,
+			errMsg: "geodns ipv4 address \"2001:db8::1\" is not valid",
+		},
+		{
+			name:   "Invalid GeoDNS default address",
+			conf:   "geodns:\n  asn:\n    3352: {ipv4: [192.0.2.1]}\n  default: {ipv6: [192.0.2.1]}\n",
+			flags:  geoFlags,
+			errMsg: "geodns ipv6 address \"192.0.2.1\" is not valid",
+		},
+		{
+			name:   "Missing DynDNS file",
+			conf:   "dyndns:\n  users:\n    - {username: alice, password_hash: '" + testBcryptHash + "', hostnames: [home]}\n",
+			errMsg: "dyndns file is mandatory",
+		},
+		{
+			name:   "Missing DynDNS password",
+			conf:   "dyndns:\n  file: /tmp/dyndns.json\n  users:\n    - {username: alice, hostnames: [home]}\n",
+			errMsg: "dyndns username, password_hash and hostnames are mandatory for every user",
+		},
+		{
+			name:   "Duplicated DynDNS user",
+			conf:   "dyndns:\n  file: /tmp/dyndns.json\n  users:\n    - {username: alice, password_hash: '" + testBcryptHash + "', hostnames: [home]}\n    - {username: alice, password_hash: '" + testBcryptHash + "', hostnames: [lab]}\n",
+			errMsg: "dyndns username \"alice\" is duplicated",
+		},
+		{
+			name:   "Invalid DynDNS username",
+			conf:   "dyndns:\n  file: /tmp/dyndns.json\n  users:\n    - {username: \"a:b\", password_hash: '" + testBcryptHash + "', hostnames: [home]}\n",
+			errMsg: "cannot contain a colon",
+		},
+		{
+			name:   "Plain text DynDNS password",
+			conf:   "dyndns:\n  file: /tmp/dyndns.json\n  users:\n    - {username: alice, password_hash: secret, hostnames: [home]}\n",
+			errMsg: "dyndns password_hash of \"alice\" is not a bcrypt hash",
+		},
+		{
+			name:   "Invalid ACME register network",
+			conf:   "acme:\n  file: /tmp/acme.json\n  register_from: [192.0.2.1]\n",
+			errMsg: "acme register_from",
+		},
+		{
+			name:   "Missing ACME apex password",
+			conf:   "acme:\n  file: /tmp/acme.json\n  apex:\n    username: apex\n",
+			errMsg: "acme apex username and password are mandatory",
+		},
+		{
+			name:   "Invalid transfer network",
+			conf:   "transfer:\n  allow_from: [192.0.2.1]\n",
+			errMsg: "transfer allow_from",
+		},
+		{
+			name:   "Missing TSIG secret",
+			conf:   "transfer:\n  allow_from: [192.0.2.0/24]\n  tsig:\n    - name: xfr\n      algorithm: hmac-sha256\n",
+			errMsg: "transfer tsig name and secret are mandatory",
+		},
+		{
+			name:   "Unsupported TSIG algorithm",
+			conf:   "transfer:\n  allow_from: [192.0.2.0/24]\n  tsig:\n    - name: xfr\n      algorithm: hmac-md5\n      secret: c2VjcmV0\n",
+			errMsg: `unsupported algorithm "hmac-md5"`,
+		},
+		{
+			name:   "Invalid TSIG secret",
+			conf:   "transfer:\n  allow_from: [192.0.2.0/24]\n  tsig:\n    - name: xfr\n      algorithm: hmac-sha256\n      secret: not base64\n",
+			errMsg: "transfer tsig xfr: invalid secret",
+		},
+		{
+			name:   "Notify without transfers",
+			conf:   "transfer:\n  notify: [192.0.2.2]\n",
+			errMsg: "transfer allow_from is mandatory to notify secondaries",
+		},
+		{
+			name:   "Invalid notify address",
+			conf:   "transfer:\n  allow_from: [192.0.2.0/24]\n  notify: [ns2.example.com:53]\n",
+			errMsg: `transfer notify: invalid address "ns2.example.com:53"`,
+		},
+		{
+			name:   "Transfer of a signed zone",
+			conf:   "dnssec:\n  keys: [Kdns.example.com.+013+12345]\ntransfer:\n  allow_from: [192.0.2.0/24]\n",
+			errMsg: "transfer and dnssec are mutually exclusive",
+		},
+		{
+			name:   "Long NSID",
+			conf:   "identity:\n  nsid: " + strings.Repeat("a", 256) + "\n",
+			errMsg: "identity nsid must be at most 255 bytes",
+		},
+		{
+			name:   "Invalid cookies secret",
+			conf:   "cookies:\n  secret: not base64\n",
+			errMsg: "cookies secret",
+		},
+		{
+			name:   "Short cookies secret",
+			conf:   "cookies:\n  secret: c2VjcmV0\n",
+			errMsg: "cookies secret must be at least 16 bytes long",
+		},
+		{
+			name:   "Negative cookies rotation",
+			conf:   "cookies:\n  rotation: -1\n",
+			errMsg: "cookies rotation must be a positive number of seconds",
+		},
+		{
+			name:   "Negative store expiration",
+			conf:   "discovery_store:\n  expiration: -1\n",
+			errMsg: "discovery_store expiration must be a positive number of seconds",
+		},
+		{
+			name:   "Negative store max entries",
+			conf:   "discovery_store:\n  max_entries: -1\n",
+			errMsg: "discovery_store max_entries must be a positive number",
+		},
+		{
+			name:   "Negative store prefix quota",
+			conf:   "discovery_store:\n  prefix_quota: -1\n",
+			errMsg: "discovery_store prefix_quota must be a positive number",
+		},
+		{
+			name:   "Unsupported store scheme",
+			conf:   testSharedSecret + "discovery_store:\n  redis_url: http://127.0.0.1:6379\n",
+			errMsg: "discovery_store redis_url: unsupported scheme \"http\"",
+		},
+		{
+			name:   "Redis store without a shared secret",
+			conf:   "discovery_store:\n  redis_url: redis://127.0.0.1:6379/0\n",
+			errMsg: "tokens secret is mandatory when the discovery store is shared through redis",
+		},
+		{
+			name:   "Invalid tokens secret",
+			conf:   "tokens:\n  secret: not base64\n",
+			errMsg: "tokens secret",
+		},
+		{
+			name:   "Short tokens secret",
+			conf:   "tokens:\n  secret: c2VjcmV0\n",
+			errMsg: "tokens secret must be at least 16 bytes long",
+		},
+		{
+			name:   "Negative tokens ttl",
+			conf:   "tokens:\n  ttl: -1\n",
+			errMsg: "tokens ttl must be a positive number of seconds",
+		},
+		{
+			name:   "Invalid redirect scheme",
+			conf:   "redirect_scheme: ftp\n",
+			errMsg: "redirect_scheme must be http or https",
+		},
+		{
+			name:   "Certificate without key",
+			conf:   "tls:\n  crt: ../../test/server.pem\n",
+			flags:  testTLSFlags,
+			errMsg: "tls crt and key are mandatory",
+		},
+		{
+			name:   "Certificate without the TLS listener",
+			conf:   "tls:\n  crt: ../../test/server.pem\n  key: ../../test/server.key\n",
+			errMsg: "the -tls-bind flag is mandatory",
+		},
+		{
+			name:   "Missing certificate",
+			conf:   "tls:\n  crt: /missing.pem\n  key: ../../test/server.key\n",
+			flags:  testTLSFlags,
+			errMsg: "/missing.pem no such file or directory",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := setupResolverYAML(t, "domain: dns.example.com\n"+tc.conf, tc.flags...)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.errMsg)
+		})
+	}
+}
+
+func TestCheckGeoDNSDatabases(t *testing.T) {
+	t.Cleanup(func() { App.GeodbPath = geodbConf{} })
+	asn := geoDNS{ASN: map[uint]geoAnswer{3352: {Ipv4: []string{"192.0.2.1"}}}}
+
+	App.GeodbPath = geodbConf{City: "city"}
+	assert.ErrorContains(t, checkGeoDNS(asn), "geodns requires the --geoip2-city and --geoip2-asn databases")
+
+	App.GeodbPath = geodbConf{City: "city", ASN: "asn"}
+	assert.NoError(t, checkGeoDNS(asn))
+}
+
+// setupResolverYAML runs Setup with conf as the resolver configuration, along
+// with flags. The resolver settings are reset when the test ends.
+func setupResolverYAML(t *testing.T, conf string, flags ...string) error {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "resolver.yml")
+	require.NoError(t, os.WriteFile(path, []byte(conf), 0o600))
+	t.Cleanup(func() { App.Resolver = resolver{} })
+
+	_, err := Setup(append(flags, "-resolver", path))
+
+	return err
+}
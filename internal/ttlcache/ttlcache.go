@@ -0,0 +1,260 @@
+// Package ttlcache implements a bounded cache of expiring values, safe to fill
+// from untrusted queries. Keys are spread over shards with their own lock, every
+// shard holds at most its share of the entries and evicts the least recently
+// written one when full. As all the entries live for the same time, it is also
+// the next to expire. The entries created for a network prefix are bounded as
+// well, so that a single client can not take the whole cache: they are listed
+// in shards of their own, spread by prefix, which are locked after the shard of
+// a key and never before.
+package ttlcache
+
+import (
+	"container/list"
+	"hash/maphash"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dcarrillo/whatismyip/internal/metrics"
+)
+
+const (
+	shardCount = 64
+	// entryOverhead approximates the memory taken by an entry besides its key
+	// and value: the entry itself, its list elements and map slots
+	entryOverhead = 200
+
+	ipv4PrefixLength = 24
+	ipv6PrefixLength = 56
+)
+
+// Config holds the limits of the cache. Quota is the number of entries the
+// clients of a network prefix (/24 for IPv4, /56 for IPv6) can create, 0
+// disables it.
+type Config struct {
+	Expiration time.Duration
+	MaxEntries int
+	Quota      int
+}
+
+type Cache struct {
+	expiration time.Duration
+	quota      int
+	seed       maphash.Seed
+	shards     [shardCount]shard
+	owners     [shardCount]ownerShard
+	now        func() time.Time
+}
+
+type shard struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[string]*entry
+	// lru is ordered by the last write, the front is the most recent one
+	lru *list.List
+}
+
+// ownerShard lists the entries of the prefixes, most recently written first
+type ownerShard struct {
+	mu      sync.Mutex
+	entries map[string]*list.List
+}
+
+type entry struct {
+	key     string
+	owner   string
+	value   []byte
+	expires time.Time
+	lruElem *list.Element
+	// ownerElem is guarded by the lock of the owner shard
+	ownerElem *list.Element
+}
+
+func New(cfg Config) *Cache {
+	c := &Cache{expiration: cfg.Expiration, quota: max(cfg.Quota, 0), seed: maphash.MakeSeed(), now: time.Now}
+	for i := range c.shards {
+		c.shards[i] = shard{
+			capacity: max(cfg.MaxEntries/shardCount, 1),
+			entries:  map[string]*entry{},
+			lru:      list.New(),
+		}
+		c.owners[i] = ownerShard{entries: map[string]*list.List{}}
+	}
+
+	return c
+}
+
+func (c *Cache) shard(key string) *shard {
+	return &c.shards[maphash.String(c.seed, key)%shardCount]
+}
+
+func (c *Cache) ownerShard(owner string) *ownerShard {
+	return &c.owners[maphash.String(c.seed, owner)%shardCount]
+}
+
+// Get returns the value of key, if it has not expired
+func (c *Cache) Get(key string) ([]byte, bool) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok || !c.now().Before(e.expires) {
+		return nil, false
+	}
+
+	return e.value, true
+}
+
+// Update calls update with the value of key, nil when it is not found, and
+// stores the value it returns. The entry is charged to the prefix of owner, the
+// address of the client it is created for, when it does not exist.
+func (c *Cache) Update(key string, owner string, update func([]byte) ([]byte, error)) error {
+	victim, err := c.update(key, owner, update)
+	if victim != nil {
+		// the oldest entry of the prefix may live in another shard, whose lock
+		// can only be taken once the one of key is released
+		c.evict(victim)
+	}
+
+	return err
+}
+
+func (c *Cache) update(key string, owner string, update func([]byte) ([]byte, error)) (*entry, error) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := c.now()
+	c.purge(s, now)
+	var current []byte
+	e, ok := s.entries[key]
+	if ok {
+		current = e.value
+	}
+	value, err := update(current)
+	if err != nil {
+		return nil, err
+	}
+
+	if ok {
+		metrics.AddDiscoveryStoreUsage(0, len(value)-len(e.value))
+		e.value = value
+		e.expires = now.Add(c.expiration)
+		s.lru.MoveToFront(e.lruElem)
+		c.own(e)
+		return nil, nil
+	}
+
+	e = &entry{key: key, owner: prefix(owner), value: value, expires: now.Add(c.expiration)}
+	victim := c.own(e)
+	if len(s.entries) >= s.capacity {
+		c.remove(s, s.lru.Back().Value.(*entry))
+		metrics.RecordDiscoveryStoreEviction("capacity")
+	}
+	e.lruElem = s.lru.PushFront(e)
+	s.entries[key] = e
+	metrics.AddDiscoveryStoreUsage(1, entryOverhead+len(key)+len(value))
+
+	return victim, nil
+}
+
+// own moves e to the front of the entries of its prefix, and returns the oldest
+// one when the prefix is over its quota. The returned entry is no longer listed
+// and has to be evicted.
+func (c *Cache) own(e *entry) *entry {
+	if e.owner == "" || c.quota == 0 {
+		return nil
+	}
+
+	o := c.ownerShard(e.owner)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if e.ownerElem != nil {
+		o.entries[e.owner].MoveToFront(e.ownerElem)
+		return nil
+	}
+	owned := o.entries[e.owner]
+	if owned == nil {
+		owned = list.New()
+		o.entries[e.owner] = owned
+	}
+	var victim *entry
+	if owned.Len() >= c.quota {
+		victim = owned.Remove(owned.Back()).(*entry)
+		victim.ownerElem = nil
+	}
+	e.ownerElem = owned.PushFront(e)
+
+	return victim
+}
+
+// evict removes e, unless it has been removed meanwhile
+func (c *Cache) evict(e *entry) {
+	s := c.shard(e.key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.entries[e.key] == e {
+		c.remove(s, e)
+		metrics.RecordDiscoveryStoreEviction("quota")
+	}
+}
+
+// Len returns the number of entries, including the expired ones not purged yet
+func (c *Cache) Len() int {
+	n := 0
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		n += len(s.entries)
+		s.mu.Unlock()
+	}
+
+	return n
+}
+
+// purge removes the expired entries, which are at the back of the list
+func (c *Cache) purge(s *shard, now time.Time) {
+	for elem := s.lru.Back(); elem != nil; elem = s.lru.Back() {
+		e := elem.Value.(*entry)
+		if now.Before(e.expires) {
+			return
+		}
+		c.remove(s, e)
+	}
+}
+
+// remove deletes e from s, whose lock is held, and from the entries of its prefix
+func (c *Cache) remove(s *shard, e *entry) {
+	delete(s.entries, e.key)
+	s.lru.Remove(e.lruElem)
+	if e.owner != "" && c.quota > 0 {
+		o := c.ownerShard(e.owner)
+		o.mu.Lock()
+		if e.ownerElem != nil {
+			owned := o.entries[e.owner]
+			owned.Remove(e.ownerElem)
+			e.ownerElem = nil
+			if owned.Len() == 0 {
+				delete(o.entries, e.owner)
+			}
+		}
+		o.mu.Unlock()
+	}
+	metrics.AddDiscoveryStoreUsage(-1, -(entryOverhead + len(e.key) + len(e.value)))
+}
+
+// prefix returns the network prefix of the address ip, empty if it is not valid
+func prefix(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ""
+	}
+	if ip4 := addr.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(ipv4PrefixLength, 32)).String()
+	}
+
+	return addr.Mask(net.CIDRMask(ipv6PrefixLength, 128)).String()
+}
@@ -0,0 +1,157 @@
+package ttlcache
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time          { return c.t }
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestCache(cfg Config) (*Cache, *clock) {
+	c := &clock{t: time.Unix(1700000000, 0)}
+	cache := New(cfg)
+	cache.now = c.now
+
+	return cache, c
+}
+
+func set(t *testing.T, c *Cache, key string, owner string, value string) {
+	t.Helper()
+	require.NoError(t, c.Update(key, owner, func([]byte) ([]byte, error) { return []byte(value), nil }))
+}
+
+func TestUpdate(t *testing.T) {
+	cache, clock := newTestCache(Config{Expiration: time.Minute, MaxEntries: 1000})
+
+	_, found := cache.Get("token")
+	assert.False(t, found)
+
+	require.NoError(t, cache.Update("token", "192.0.2.1", func(b []byte) ([]byte, error) {
+		assert.Nil(t, b)
+		return []byte("1"), nil
+	}))
+	require.NoError(t, cache.Update("token", "192.0.2.1", func(b []byte) ([]byte, error) {
+		return append(b, '2'), nil
+	}))
+	v, found := cache.Get("token")
+	assert.True(t, found)
+	assert.Equal(t, "12", string(v))
+
+	assert.Error(t, cache.Update("token", "192.0.2.1", func([]byte) ([]byte, error) {
+		return nil, fmt.Errorf("invalid")
+	}))
+	v, _ = cache.Get("token")
+	assert.Equal(t, "12", string(v), "failed updates are discarded")
+
+	clock.advance(59 * time.Second)
+	set(t, cache, "token", "192.0.2.1", "3")
+	clock.advance(59 * time.Second)
+	_, found = cache.Get("token")
+	assert.True(t, found, "writes extend the expiration")
+	clock.advance(time.Second)
+	_, found = cache.Get("token")
+	assert.False(t, found, "expired")
+
+	require.NoError(t, cache.Update("token", "192.0.2.1", func(b []byte) ([]byte, error) {
+		assert.Nil(t, b, "expired entries are not updated")
+		return []byte("4"), nil
+	}))
+	assert.Equal(t, 1, cache.Len())
+}
+
+func TestCapacity(t *testing.T) {
+	cache, clock := newTestCache(Config{Expiration: time.Minute, MaxEntries: shardCount * 2})
+
+	for i := range 1000 {
+		set(t, cache, fmt.Sprintf("token-%d", i), fmt.Sprintf("2001:db8:%x::1", i), "1")
+		clock.advance(time.Millisecond)
+	}
+	assert.LessOrEqual(t, cache.Len(), shardCount*2)
+	_, found := cache.Get("token-999")
+	assert.True(t, found, "the last entries are kept")
+	_, found = cache.Get("token-0")
+	assert.False(t, found, "the oldest entries are evicted")
+}
+
+func TestQuota(t *testing.T) {
+	cache, _ := newTestCache(Config{Expiration: time.Minute, MaxEntries: 100000, Quota: 10})
+
+	for i := range 10000 {
+		set(t, cache, fmt.Sprintf("flood-%d", i), fmt.Sprintf("192.0.2.%d", i%256), "1")
+	}
+	assert.Equal(t, 10, cache.Len(), "a /24 is bounded by its quota")
+	for i := 9990; i < 10000; i++ {
+		_, found := cache.Get(fmt.Sprintf("flood-%d", i))
+		assert.True(t, found, "the network keeps its latest entries")
+	}
+
+	set(t, cache, "token", "198.51.100.1", "1")
+	_, found := cache.Get("token")
+	assert.True(t, found, "other networks are not affected")
+
+	for i := range 1000 {
+		set(t, cache, fmt.Sprintf("unowned-%d", i), "", "1")
+	}
+	assert.Greater(t, cache.Len(), 1000, "entries without an owner are not bounded by the quota")
+}
+
+func TestQuotaBelowLimit(t *testing.T) {
+	cache, _ := newTestCache(Config{Expiration: time.Minute, MaxEntries: 100000, Quota: 1000})
+
+	for i := range 900 {
+		set(t, cache, fmt.Sprintf("token-%d", i), "2001:db8::1", "1")
+	}
+	assert.Equal(t, 900, cache.Len(), "the entries of a network below its quota are kept")
+
+	for i := range 200 {
+		set(t, cache, fmt.Sprintf("more-%d", i), "2001:db8::2", "1")
+	}
+	assert.Equal(t, 1000, cache.Len())
+	_, found := cache.Get("token-99")
+	assert.False(t, found, "the oldest entries of the network are evicted")
+	_, found = cache.Get("token-100")
+	assert.True(t, found)
+
+	cache, _ = newTestCache(Config{Expiration: time.Minute, MaxEntries: 100000})
+	for i := range 5000 {
+		set(t, cache, fmt.Sprintf("token-%d", i), "2001:db8::1", "1")
+	}
+	assert.Equal(t, 5000, cache.Len(), "a zero quota is disabled")
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	cache := New(Config{Expiration: time.Minute, MaxEntries: 1000, Quota: 100})
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				require.NoError(t, cache.Update("token", "192.0.2.1", func(b []byte) ([]byte, error) {
+					return append(b, '1'), nil
+				}))
+			}
+		}()
+	}
+	wg.Wait()
+
+	v, _ := cache.Get("token")
+	assert.Len(t, v, 800)
+}
+
+func TestPrefix(t *testing.T) {
+	assert.Equal(t, "192.0.2.0", prefix("192.0.2.123"))
+	assert.Equal(t, "2001:db8:0:ff00::", prefix("2001:db8:0:ffab::1"))
+	assert.Equal(t, "", prefix("not an ip"))
+}
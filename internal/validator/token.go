@@ -0,0 +1,131 @@
+package validator
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"net"
+	"strings"
+	"time"
+)
+
+// A token is a DNS label of 32 base32 characters encoding 20 bytes: its expiry
+// time, a hash of the network of the client it was issued to, a random nonce
+// and the HMAC-SHA256 of the rest, truncated.
+const (
+	tokenLength  = 20
+	expiryLength = 4
+	ipHashLength = 4
+	nonceLength  = 4
+	macOffset    = expiryLength + ipHashLength + nonceLength
+
+	secretLength = 32
+
+	// the clients are identified by their network, as browsers switch between
+	// the temporary IPv6 addresses of their network
+	ipv4PrefixLength = 24
+	ipv6PrefixLength = 56
+)
+
+var tokenEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Tokens issues and validates the discovery tokens. The resolver can only check
+// their signature and expiry, the HTTP server also checks that the client is
+// in the network the token was issued to.
+type Tokens struct {
+	secret []byte
+	ttl    time.Duration
+	now    func() time.Time
+}
+
+// NewTokens returns a token issuer whose tokens are signed with secret, random
+// when it is empty, and are valid for ttl
+func NewTokens(secret []byte, ttl time.Duration) (*Tokens, error) {
+	if len(secret) == 0 {
+		secret = make([]byte, secretLength)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Tokens{secret: secret, ttl: ttl, now: time.Now}, nil
+}
+
+// New returns a new token for the client at ip
+func (t *Tokens) New(ip string) string {
+	b := make([]byte, tokenLength)
+	binary.BigEndian.PutUint32(b, uint32(t.now().Add(t.ttl).Unix()))
+	copy(b[expiryLength:], t.ipHash(net.ParseIP(ip)))
+	_, _ = rand.Read(b[expiryLength+ipHashLength : macOffset])
+	copy(b[macOffset:], t.mac(b[:macOffset]))
+
+	return strings.ToLower(tokenEncoding.EncodeToString(b))
+}
+
+// Valid reports whether token is a token signed with the secret that has not
+// expired
+func (t *Tokens) Valid(token string) bool {
+	_, ok := t.decode(token)
+	return ok
+}
+
+// ValidFor reports whether token is valid and was issued to the network of the
+// client at ip. The network of a dual-stack client can only be checked for the
+// address family the token was issued to, a client of the other family is not
+// checked.
+func (t *Tokens) ValidFor(token string, ip string) bool {
+	addr := net.ParseIP(ip)
+	b, ok := t.decode(token)
+	if !ok || addr == nil {
+		return false
+	}
+	issued, hash := b[expiryLength:expiryLength+ipHashLength], t.ipHash(addr)
+	if family(issued) != family(hash) {
+		return true
+	}
+
+	return hmac.Equal(issued, hash)
+}
+
+func (t *Tokens) decode(token string) ([]byte, bool) {
+	if tokenEncoding.EncodedLen(tokenLength) != len(token) {
+		return nil, false
+	}
+	b, err := tokenEncoding.DecodeString(strings.ToUpper(token))
+	if err != nil || !hmac.Equal(b[macOffset:], t.mac(b[:macOffset])) {
+		return nil, false
+	}
+	expiry := time.Unix(int64(binary.BigEndian.Uint32(b)), 0)
+
+	return b, t.now().Before(expiry)
+}
+
+func (t *Tokens) mac(b []byte) []byte {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte("token"))
+	mac.Write(b)
+
+	return mac.Sum(nil)[:tokenLength-macOffset]
+}
+
+// ipHash returns a keyed hash of the network of ip, which does not reveal the
+// address. Its last bit is the address family, 1 for IPv6.
+func (t *Tokens) ipHash(ip net.IP) []byte {
+	prefix, bit := ip.Mask(net.CIDRMask(ipv6PrefixLength, 128)), byte(1)
+	if ip4 := ip.To4(); ip4 != nil {
+		prefix, bit = ip4.Mask(net.CIDRMask(ipv4PrefixLength, 32)), 0
+	}
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte("ip"))
+	mac.Write(prefix.To16())
+	hash := mac.Sum(nil)[:ipHashLength]
+	hash[ipHashLength-1] = hash[ipHashLength-1]&^1 | bit
+
+	return hash
+}
+
+func family(hash []byte) byte {
+	return hash[ipHashLength-1] & 1
+}
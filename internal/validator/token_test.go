@@ -0,0 +1,55 @@
+package validator
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokens(t *testing.T) {
+	tokens, err := NewTokens([]byte("secret-secret-secret"), 5*time.Minute)
+	require.NoError(t, err)
+	now := time.Unix(1700000000, 0)
+	tokens.now = func() time.Time { return now }
+
+	token := tokens.New("192.0.2.1")
+	assert.Len(t, token, 32)
+	assert.Equal(t, strings.ToLower(token), token)
+	assert.NotEqual(t, token, tokens.New("192.0.2.1"), "tokens are unique")
+
+	assert.True(t, tokens.Valid(token))
+	assert.True(t, tokens.Valid(strings.ToUpper(token)), "labels are case insensitive")
+	assert.True(t, tokens.ValidFor(token, "192.0.2.1"))
+	assert.True(t, tokens.ValidFor(token, "::ffff:192.0.2.1"))
+	assert.True(t, tokens.ValidFor(token, "192.0.2.2"), "another client of the network")
+	assert.False(t, tokens.ValidFor(token, "198.51.100.1"), "another network")
+	assert.True(t, tokens.ValidFor(token, "2001:db8::1"), "the other address family can not be checked")
+	assert.False(t, tokens.ValidFor(token, "not an ip"))
+
+	token6 := tokens.New("2001:db8:0:1:aaaa::1")
+	assert.True(t, tokens.ValidFor(token6, "2001:db8:0:1:bbbb::2"), "temporary addresses of the network")
+	assert.True(t, tokens.ValidFor(token6, "2001:db8:0:ff::1"), "the /56 of the network")
+	assert.False(t, tokens.ValidFor(token6, "2001:db8:0:100::1"), "another network")
+	assert.True(t, tokens.ValidFor(token6, "192.0.2.1"), "the other address family can not be checked")
+
+	forged := []byte(token)
+	forged[0] ^= 1
+	assert.False(t, tokens.Valid(string(forged)), "modified token")
+	assert.False(t, tokens.Valid(token[:31]), "short token")
+	assert.False(t, tokens.Valid("3b241101-e2bb-4255-8caf-4136c566a964"), "uuid")
+	assert.False(t, tokens.Valid(strings.Repeat("1", 32)), "not base32")
+
+	other, err := NewTokens([]byte("another-secret-secret"), 5*time.Minute)
+	require.NoError(t, err)
+	assert.False(t, other.Valid(token), "another secret")
+
+	random, err := NewTokens(nil, 5*time.Minute)
+	require.NoError(t, err)
+	assert.True(t, random.Valid(random.New("2001:db8::1")), "random secret")
+
+	now = now.Add(5 * time.Minute)
+	assert.False(t, tokens.Valid(token), "expired")
+}
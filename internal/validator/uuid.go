@@ -1,10 +1,10 @@
-package uuid
+package validator
 
 import (
 	"github.com/google/uuid"
 )
 
-func IsValid(u string) bool {
+func IsUUID(u string) bool {
 	_, err := uuid.Parse(u)
 	return err == nil
 }
@@ -1,4 +1,4 @@
-package uuid
+package validator
 
 import (
 	"testing"
@@ -6,7 +6,7 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-func TestIsValid(t *testing.T) {
+func TestIsUUID(t *testing.T) {
 	tests := []struct {
 		name string
 		u    string
@@ -31,7 +31,7 @@ func TestIsValid(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			assert.True(t, IsValid(tt.u) == tt.want)
+			assert.True(t, IsUUID(tt.u) == tt.want)
 		})
 	}
 }
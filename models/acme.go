@@ -0,0 +1,50 @@
+package models
+
+import (
+	"net"
+	"slices"
+	"time"
+)
+
+// maxACMERecords is the number of TXT values kept for an account, the last two
+// so that a certificate for a name and its wildcard can be validated at once
+const maxACMERecords = 2
+
+// ACMEAccount is an acme-dns account, it can update the TXT records of the
+// DNS-01 challenge of its subdomain
+type ACMEAccount struct {
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"password_hash"`
+	Subdomain    string    `json:"subdomain"`
+	AllowFrom    []string  `json:"allowfrom,omitempty"`
+	TXT          []string  `json:"txt,omitempty"`
+	Updated      time.Time `json:"updated,omitzero"`
+}
+
+// Allowed reports whether the account can be updated from ip, any address is
+// allowed if the account has no networks
+func (a ACMEAccount) Allowed(ip net.IP) bool {
+	if len(a.AllowFrom) == 0 {
+		return true
+	}
+	for _, cidr := range a.AllowFrom {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AddTXT returns a copy of a with txt as its latest TXT value, the oldest one
+// is discarded when there are already two of them
+func (a ACMEAccount) AddTXT(txt string) ACMEAccount {
+	records := append(slices.Clone(a.TXT), txt)
+	if len(records) > maxACMERecords {
+		records = records[len(records)-maxACMERecords:]
+	}
+	a.TXT = records
+	a.Updated = time.Now().UTC()
+
+	return a
+}
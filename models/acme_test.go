@@ -0,0 +1,27 @@
+package models
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestACMEAccountAllowed(t *testing.T) {
+	assert.True(t, ACMEAccount{}.Allowed(net.ParseIP("192.0.2.1")))
+
+	a := ACMEAccount{AllowFrom: []string{"192.0.2.0/24", "2001:db8::/32"}}
+	assert.True(t, a.Allowed(net.ParseIP("192.0.2.1")))
+	assert.True(t, a.Allowed(net.ParseIP("2001:db8::1")))
+	assert.False(t, a.Allowed(net.ParseIP("198.51.100.1")))
+}
+
+func TestACMEAccountAddTXT(t *testing.T) {
+	a := ACMEAccount{}.AddTXT("first")
+	assert.Equal(t, []string{"first"}, a.TXT)
+	assert.False(t, a.Updated.IsZero())
+
+	b := a.AddTXT("second").AddTXT("third")
+	assert.Equal(t, []string{"second", "third"}, b.TXT)
+	assert.Equal(t, []string{"first"}, a.TXT, "the account is not modified")
+}
@@ -0,0 +1,146 @@
+package models
+
+import (
+	"slices"
+	"time"
+)
+
+// BogusPrefix prefixes the token in the names of the DNSSEC validation test,
+// bogus-<uuid>.<domain>, which are served with a broken signature
+const BogusPrefix = "bogus-"
+
+// BogusQueryKey is the store key that flags that a resolver queried the bogus
+// name of token
+func BogusQueryKey(token string) string {
+	return BogusPrefix + "query-" + token
+}
+
+// BogusFetchKey is the store key that flags that a client reached the bogus
+// host of token, i.e. its resolver does not validate DNSSEC signatures
+func BogusFetchKey(token string) string {
+	return BogusPrefix + "fetch-" + token
+}
+
+// BogusFailKey is the store key that flags that the request of a client to
+// the bogus host of token failed, rather than timed out
+func BogusFailKey(token string) string {
+	return BogusPrefix + "fail-" + token
+}
+
+// DNSQuery holds the properties of a discovery query received by the resolver
+type DNSQuery struct {
+	IP           string
+	Transport    string
+	ClientSubnet string
+	EDNS         bool
+	UDPSize      uint16
+	DNSSECOK     bool
+	ClientCookie string
+	ServerCookie string
+	// ValidCookie is set when the server cookie was generated by the server,
+	// i.e. the resolver keeps the cookies of the servers it queries
+	ValidCookie bool
+	Case0x20    bool
+	Time        time.Time
+}
+
+// DNSResolver is a resolver that queried a discovery token. The query holds the
+// properties of its first query.
+type DNSResolver struct {
+	DNSQuery
+	Hits       int
+	QueryTypes []string
+}
+
+// maxResolvers limits the resolvers recorded for a discovery token
+const maxResolvers = 32
+
+// DNSDiscovery holds the resolvers that queried a discovery token
+type DNSDiscovery struct {
+	Resolvers []DNSResolver
+}
+
+// Add returns a copy of d including query of type qtype. Resolvers are
+// identified by their IP, a known resolver only gets its hits and query types
+// updated. Once maxResolvers are known, d is returned as is for new ones.
+func (d DNSDiscovery) Add(query DNSQuery, qtype string) DNSDiscovery {
+	resolvers := slices.Clone(d.Resolvers)
+	for i, r := range resolvers {
+		if r.IP != query.IP {
+			continue
+		}
+		r.Hits++
+		if !slices.Contains(r.QueryTypes, qtype) {
+			r.QueryTypes = append(slices.Clone(r.QueryTypes), qtype)
+		}
+		resolvers[i] = r
+
+		return DNSDiscovery{Resolvers: resolvers}
+	}
+	if len(resolvers) >= maxResolvers {
+		return d
+	}
+
+	return DNSDiscovery{Resolvers: append(resolvers, DNSResolver{
+		DNSQuery:   query,
+		Hits:       1,
+		QueryTypes: []string{qtype},
+	})}
+}
+
+// Capability probes, every probe is a name in the form <probe>-<token>.<domain>
+const (
+	ProbeTC   = "tc"
+	ProbeBig  = "big"
+	ProbeV6NS = "v6ns"
+	ProbeQM   = "qm"
+)
+
+// ProbeHosts returns the hostnames, relative to the domain, the discovery page
+// requests to run the capability probes of token. The QNAME minimisation probe
+// needs a few labels below it.
+func ProbeHosts(token string) []string {
+	return []string{
+		ProbeTC + "-" + token,
+		ProbeBig + "-" + token,
+		ProbeV6NS + "-" + token,
+		"a.b." + ProbeQM + "-" + token,
+	}
+}
+
+// maxProbeQNames limits the names recorded by the QNAME minimisation probe
+const maxProbeQNames = 16
+
+// ProbesKey is the store key of the capability probe results of token
+func ProbesKey(token string) string {
+	return "probes-" + token
+}
+
+// DNSProbes holds what the capability probes of a discovery token revealed
+// about the resolver
+type DNSProbes struct {
+	// Truncated is set when a truncated answer was sent over UDP and TCPRetry
+	// when the same name was queried over TCP
+	Truncated bool
+	TCPRetry  bool
+	// the large answer was sent over UDP, truncated or sent over TCP
+	LargeUDP       bool
+	LargeTruncated bool
+	LargeTCP       bool
+	// V6Referral is set when the resolver got the referral to the IPv6-only
+	// name server and IPv6 when it queried it
+	V6Referral bool
+	IPv6       bool
+	// QNames holds the names queried under the QNAME minimisation probe,
+	// relative to the domain
+	QNames []string
+}
+
+// AddQName records name once, the QNames slice is copied as probes are shared
+// through the store
+func (p *DNSProbes) AddQName(name string) {
+	if slices.Contains(p.QNames, name) || len(p.QNames) >= maxProbeQNames {
+		return
+	}
+	p.QNames = append(slices.Clone(p.QNames), name)
+}
@@ -0,0 +1,50 @@
+package models
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDNSDiscoveryAdd(t *testing.T) {
+	first := DNSQuery{IP: "192.0.2.1", Transport: "udp"}
+	second := DNSQuery{IP: "192.0.2.2", Transport: "tcp"}
+
+	d := DNSDiscovery{}.Add(first, "A")
+	retried := d.Add(first, "A").Add(first, "AAAA").Add(second, "AAAA")
+
+	assert.Equal(t, []DNSResolver{{DNSQuery: first, Hits: 1, QueryTypes: []string{"A"}}}, d.Resolvers, "the original is not modified")
+	assert.Equal(t, []DNSResolver{
+		{DNSQuery: first, Hits: 3, QueryTypes: []string{"A", "AAAA"}},
+		{DNSQuery: second, Hits: 1, QueryTypes: []string{"AAAA"}},
+	}, retried.Resolvers)
+}
+
+func TestDNSDiscoveryAddLimit(t *testing.T) {
+	d := DNSDiscovery{}
+	for i := range maxResolvers + 10 {
+		d = d.Add(DNSQuery{IP: fmt.Sprintf("2001:db8::%x", i)}, "A")
+	}
+	assert.Len(t, d.Resolvers, maxResolvers)
+
+	d = d.Add(DNSQuery{IP: "2001:db8::1"}, "AAAA")
+	assert.Equal(t, 2, d.Resolvers[1].Hits, "known resolvers are still updated")
+	assert.Equal(t, []string{"A", "AAAA"}, d.Resolvers[1].QueryTypes)
+}
+
+func TestDNSProbesAddQName(t *testing.T) {
+	p := DNSProbes{}
+	p.AddQName("qm-x")
+	stored := p
+	p.AddQName("a.qm-x")
+	p.AddQName("qm-x")
+
+	assert.Equal(t, []string{"qm-x"}, stored.QNames, "the stored copy is not modified")
+	assert.Equal(t, []string{"qm-x", "a.qm-x"}, p.QNames)
+
+	for i := range maxProbeQNames {
+		p.AddQName(string(rune('a'+i)) + ".qm-x")
+	}
+	assert.Len(t, p.QNames, maxProbeQNames)
+}
@@ -0,0 +1,31 @@
+package models
+
+import (
+	"net"
+	"time"
+)
+
+// DynDNSHost holds the addresses a dynamic DNS client published for a
+// hostname
+type DynDNSHost struct {
+	IPv4    net.IP    `json:"ipv4,omitempty"`
+	IPv6    net.IP    `json:"ipv6,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+// Update returns a copy of h with the address of the family of every ip
+// replaced, and whether any of them changed
+func (h DynDNSHost) Update(ips []net.IP) (DynDNSHost, bool) {
+	changed := false
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			changed = changed || !ip4.Equal(h.IPv4)
+			h.IPv4 = ip4
+			continue
+		}
+		changed = changed || !ip.Equal(h.IPv6)
+		h.IPv6 = ip
+	}
+
+	return h, changed
+}
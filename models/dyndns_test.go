@@ -0,0 +1,23 @@
+package models
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDynDNSHostUpdate(t *testing.T) {
+	h, changed := DynDNSHost{}.Update([]net.IP{net.ParseIP("192.0.2.1")})
+	assert.True(t, changed)
+	assert.Equal(t, "192.0.2.1", h.IPv4.String())
+	assert.Nil(t, h.IPv6)
+
+	_, changed = h.Update([]net.IP{net.ParseIP("::ffff:192.0.2.1")})
+	assert.False(t, changed, "IPv4-mapped addresses are IPv4 addresses")
+
+	h, changed = h.Update([]net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")})
+	assert.True(t, changed)
+	assert.Equal(t, "192.0.2.1", h.IPv4.String())
+	assert.Equal(t, "2001:db8::1", h.IPv6.String())
+}
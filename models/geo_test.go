@@ -11,6 +11,11 @@ import (
 
 func TestModels(t *testing.T) {
 	expectedCity := &GeoRecord{
+		Continent: struct {
+			Code string "maxminddb:\"code\""
+		}{
+			Code: "EU",
+		},
 		Country: struct {
 			ISOCode string            "maxminddb:\"iso_code\""
 			Names   map[string]string "maxminddb:\"names\""
@@ -0,0 +1,62 @@
+package resolver
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// acmeTTL is the TTL of the DNS-01 challenge records, which are short lived
+const acmeTTL = 1
+
+// acmeChallenge returns the TXT records of name if it is the DNS-01 challenge
+// name of an ACME account: _acme-challenge.<subdomain>.<domain>, or
+// _acme-challenge.<domain> for the apex account
+func (rsv *Resolver) acmeChallenge(name string) ([]string, bool) {
+	if rsv.acme == nil {
+		return nil, false
+	}
+	rel, found := strings.CutPrefix(name, "_acme-challenge.")
+	if !found {
+		return nil, false
+	}
+
+	subdomain := ""
+	if rel != rsv.domain {
+		subdomain, found = strings.CutSuffix(rel, "."+rsv.domain)
+		if !found || strings.Contains(subdomain, ".") {
+			return nil, false
+		}
+	}
+
+	return rsv.acme.TXT(subdomain)
+}
+
+func (rsv *Resolver) isACMEChallenge(name string) bool {
+	_, ok := rsv.acmeChallenge(name)
+	return ok
+}
+
+// acmeTXT answers with the current values of the challenge, the name has no
+// data until the account updates it
+func (rsv *Resolver) acmeTXT(q dns.Question, msg *dns.Msg, name string) {
+	if q.Qtype != dns.TypeTXT {
+		return
+	}
+	records, _ := rsv.acmeChallenge(name)
+	for _, txt := range records {
+		msg.Answer = append(msg.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: acmeTTL},
+			Txt: []string{txt},
+		})
+	}
+}
+
+// acmeTypes returns the types of the challenge name
+func (rsv *Resolver) acmeTypes(name string) []uint16 {
+	if records, _ := rsv.acmeChallenge(name); len(records) > 0 {
+		return []uint16{dns.TypeTXT}
+	}
+
+	return nil
+}
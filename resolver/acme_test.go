@@ -0,0 +1,55 @@
+package resolver
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dcarrillo/whatismyip/service"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestACMEChallenge(t *testing.T) {
+	newTestResolver(t)
+	acme, err := service.NewACME(filepath.Join(t.TempDir(), "acme.json"))
+	require.NoError(t, err)
+	rsv, err := Setup(Config{Store: service.NewMemoryDiscoveryStore(time.Minute, 1000, 0), Tokens: testTokens, ACME: acme})
+	require.NoError(t, err)
+
+	account, _, err := acme.Register(nil)
+	require.NoError(t, err)
+	require.NoError(t, acme.SetAccount("apex", "secret", ""))
+	require.NoError(t, acme.Update(account.Subdomain, "first"))
+	require.NoError(t, acme.Update(account.Subdomain, "second"))
+	require.NoError(t, acme.Update("", "apex"))
+
+	tests := []struct {
+		name     string
+		qtype    uint16
+		rcode    int
+		expected []string
+	}{
+		{name: "_acme-challenge." + account.Subdomain + "." + domain + ".", qtype: dns.TypeTXT, expected: []string{"first", "second"}},
+		{name: "_ACME-challenge." + account.Subdomain + "." + domain + ".", qtype: dns.TypeTXT, expected: []string{"first", "second"}},
+		{name: "_acme-challenge." + domain + ".", qtype: dns.TypeTXT, expected: []string{"apex"}},
+		{name: "_acme-challenge." + account.Subdomain + "." + domain + ".", qtype: dns.TypeA},
+		{name: "_acme-challenge.8b241101-e2bb-4255-8caf-4136c566a964." + domain + ".", qtype: dns.TypeTXT, rcode: dns.RcodeNameError},
+		{name: "_acme-challenge.a." + account.Subdomain + "." + domain + ".", qtype: dns.TypeTXT, rcode: dns.RcodeNameError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name+"/"+dns.TypeToString[tt.qtype], func(t *testing.T) {
+			msg := query(rsv, "udp", new(dns.Msg).SetQuestion(tt.name, tt.qtype))
+			require.Equal(t, tt.rcode, msg.Rcode)
+			var records []string
+			for _, rr := range msg.Answer {
+				txt := rr.(*dns.TXT)
+				assert.Equal(t, uint32(acmeTTL), txt.Hdr.Ttl)
+				records = append(records, txt.Txt...)
+			}
+			assert.Equal(t, tt.expected, records)
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package resolver
+
+import (
+	"encoding/hex"
+	"strings"
+
+	"github.com/dcarrillo/whatismyip/internal/metrics"
+	"github.com/dcarrillo/whatismyip/internal/setting"
+	"github.com/miekg/dns"
+)
+
+// newChaosNames returns the identification names of class CHAOS and their
+// answer, the names without a value are not answered
+func newChaosNames() map[string]string {
+	conf := setting.App.Resolver.Identity
+	names := map[string]string{}
+	for name, value := range map[string]string{
+		"version.bind.":  conf.Version,
+		"hostname.bind.": conf.Hostname,
+		"id.server.":     conf.ID,
+	} {
+		if value != "" {
+			names[name] = value
+		}
+	}
+
+	return names
+}
+
+// chaos answers the identification queries of class CHAOS: version.bind,
+// hostname.bind and id.server. Any other name is refused.
+func (rsv *Resolver) chaos(w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	msg := startReply(r)
+
+	value, ok := rsv.chaosNames[strings.ToLower(q.Name)]
+	switch {
+	case !ok:
+		msg.Authoritative = false
+		msg.SetRcode(r, dns.RcodeRefused)
+	case q.Qtype == dns.TypeTXT || q.Qtype == dns.TypeANY:
+		msg.Answer = append(msg.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 0},
+			Txt: []string{value},
+		})
+	}
+
+	rsv.reply(w, r, msg)
+	logger(w, q, msg.Rcode)
+	metrics.RecordDNSQuery(dns.TypeToString[q.Qtype], dns.RcodeToString[msg.Rcode])
+}
+
+// nsid returns the NSID option (RFC 5001) of the reply when the query asks for
+// it, nil otherwise
+func (rsv *Resolver) nsid(opt *dns.OPT) *dns.EDNS0_NSID {
+	if rsv.nsidValue == "" {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if _, ok := o.(*dns.EDNS0_NSID); ok {
+			return &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: hex.EncodeToString([]byte(rsv.nsidValue))}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package resolver
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/dcarrillo/whatismyip/internal/setting"
+	"github.com/dcarrillo/whatismyip/service"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestIdentityResolver(t *testing.T) *Resolver {
+	t.Helper()
+	newTestResolver(t)
+	setting.App.Resolver.Identity.Version = "whatismyip"
+	setting.App.Resolver.Identity.ID = "mad1"
+	setting.App.Resolver.Identity.NSID = "mad1.example.com"
+
+	rsv, err := Setup(Config{Store: service.NewMemoryDiscoveryStore(time.Minute, 1000, 0), Tokens: testTokens})
+	require.NoError(t, err)
+
+	return rsv
+}
+
+func chaosQuestion(name string, qtype uint16) *dns.Msg {
+	r := new(dns.Msg).SetQuestion(name, qtype)
+	r.Question[0].Qclass = dns.ClassCHAOS
+
+	return r
+}
+
+func TestChaos(t *testing.T) {
+	rsv := newTestIdentityResolver(t)
+
+	tests := []struct {
+		name     string
+		r        *dns.Msg
+		rcode    int
+		expected string
+	}{
+		{name: "version", r: chaosQuestion("version.bind.", dns.TypeTXT), expected: "whatismyip"},
+		{name: "id", r: chaosQuestion("ID.Server.", dns.TypeTXT), expected: "mad1"},
+		{name: "any", r: chaosQuestion("id.server.", dns.TypeANY), expected: "mad1"},
+		{name: "no data", r: chaosQuestion("id.server.", dns.TypeA)},
+		{name: "disabled", r: chaosQuestion("hostname.bind.", dns.TypeTXT), rcode: dns.RcodeRefused},
+		{name: "unknown name", r: chaosQuestion("authors.bind.", dns.TypeTXT), rcode: dns.RcodeRefused},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := query(rsv, "udp", tt.r)
+			require.Equal(t, tt.rcode, msg.Rcode)
+			if tt.expected == "" {
+				assert.Empty(t, msg.Answer)
+				return
+			}
+			require.Len(t, msg.Answer, 1)
+			txt := msg.Answer[0].(*dns.TXT)
+			assert.Equal(t, uint16(dns.ClassCHAOS), txt.Hdr.Class)
+			assert.Equal(t, tt.r.Question[0].Name, txt.Hdr.Name)
+			assert.Equal(t, []string{tt.expected}, txt.Txt)
+		})
+	}
+}
+
+func TestNSID(t *testing.T) {
+	withNSID := func(r *dns.Msg) *dns.Msg {
+		r.SetEdns0(1232, false)
+		r.IsEdns0().Option = append(r.IsEdns0().Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+		return r
+	}
+	nsid := func(msg *dns.Msg) string {
+		for _, o := range msg.IsEdns0().Option {
+			if o, ok := o.(*dns.EDNS0_NSID); ok {
+				b, _ := hex.DecodeString(o.Nsid)
+				return string(b)
+			}
+		}
+		return ""
+	}
+
+	rsv := newTestResolver(t)
+	assert.Empty(t, nsid(query(rsv, "udp", withNSID(new(dns.Msg).SetQuestion(domain+".", dns.TypeA)))), "NSID disabled")
+
+	rsv = newTestIdentityResolver(t)
+	msg := query(rsv, "udp", withNSID(new(dns.Msg).SetQuestion(domain+".", dns.TypeA)))
+	assert.Equal(t, "mad1.example.com", nsid(msg))
+
+	msg = query(rsv, "udp", withNSID(new(dns.Msg).SetQuestion("example.org.", dns.TypeA)))
+	assert.Equal(t, dns.RcodeRefused, msg.Rcode)
+	assert.Equal(t, "mad1.example.com", nsid(msg), "every response carries the NSID")
+
+	r := new(dns.Msg).SetQuestion(domain+".", dns.TypeA)
+	r.SetEdns0(1232, false)
+	assert.Empty(t, nsid(query(rsv, "udp", r)), "the NSID was not requested")
+}
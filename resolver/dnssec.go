@@ -0,0 +1,373 @@
+package resolver
+
+import (
+	"crypto"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dcarrillo/whatismyip/models"
+	"github.com/miekg/dns"
+	"github.com/patrickmn/go-cache"
+)
+
+const (
+	// signatures are valid for sigValidity and reused for sigRefresh, so every
+	// signature handed out is valid for at least sigValidity - sigRefresh
+	sigValidity = 24 * time.Hour
+	sigRefresh  = 1 * time.Hour
+	// sigInception backdates signatures to allow for clock skew
+	sigInception = 1 * time.Hour
+)
+
+// signer signs the responses of the zone online. RRsets are signed by the
+// zone signing keys, the DNSKEY RRset by the key signing keys. A single key
+// signing key with no zone signing keys is used as a combined signing key
+// (CSK).
+type signer struct {
+	zone  string
+	ksk   []signingKey
+	zsk   []signingKey
+	cache *cache.Cache
+	// cacheable reports whether the signatures of the RRsets owned by name are
+	// cached. The records synthesized for every query name (tokens, denials of
+	// random names) are not, so that a flood of random names does not grow
+	// the cache.
+	cacheable func(name string) bool
+}
+
+type signingKey struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+	tag  uint16
+}
+
+// loadSigner reads the keys in BIND format, every path is the common prefix of
+// the public (.key) and private (.private) key files
+func loadSigner(zone string, paths []string) (*signer, error) {
+	s := &signer{
+		zone:  strings.ToLower(dns.Fqdn(zone)),
+		cache: cache.New(sigRefresh, 2*sigRefresh),
+	}
+	for _, path := range paths {
+		k, err := readKey(path)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.EqualFold(k.key.Hdr.Name, s.zone) {
+			return nil, fmt.Errorf("key %s belongs to %s, not to %s", path, k.key.Hdr.Name, s.zone)
+		}
+		if k.key.Flags&dns.SEP != 0 {
+			s.ksk = append(s.ksk, k)
+		} else {
+			s.zsk = append(s.zsk, k)
+		}
+	}
+	if len(s.ksk) == 0 {
+		return nil, fmt.Errorf("at least one key signing key is mandatory to sign %s", s.zone)
+	}
+	if len(s.zsk) == 0 {
+		s.zsk = s.ksk
+	}
+
+	return s, nil
+}
+
+func readKey(path string) (signingKey, error) {
+	pub, err := os.Open(path + ".key")
+	if err != nil {
+		return signingKey{}, err
+	}
+	defer pub.Close()
+	rr, err := dns.ReadRR(pub, path+".key")
+	if err != nil {
+		return signingKey{}, err
+	}
+	key, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return signingKey{}, fmt.Errorf("%s.key is not a DNSKEY record", path)
+	}
+
+	private, err := os.Open(path + ".private")
+	if err != nil {
+		return signingKey{}, err
+	}
+	defer private.Close()
+	priv, err := key.ReadPrivateKey(private, path+".private")
+	if err != nil {
+		return signingKey{}, err
+	}
+	cs, ok := priv.(crypto.Signer)
+	if !ok {
+		return signingKey{}, fmt.Errorf("%s.private cannot be used for signing", path)
+	}
+
+	return signingKey{key: key, priv: cs, tag: key.KeyTag()}, nil
+}
+
+// dnskeys returns the DNSKEY records published at the apex
+func (s *signer) dnskeys() []dns.RR {
+	var rrs []dns.RR
+	for _, k := range slices.Concat(s.ksk, s.zsk) {
+		if !slices.ContainsFunc(rrs, func(rr dns.RR) bool { return rr == dns.RR(k.key) }) {
+			rrs = append(rrs, k.key)
+		}
+	}
+
+	return rrs
+}
+
+// signMsg adds the signatures of every RRset in the answer and authority
+// sections of msg
+func (s *signer) signMsg(msg *dns.Msg) error {
+	var err error
+	if msg.Answer, err = s.signSection(msg.Answer); err != nil {
+		return err
+	}
+	msg.Ns, err = s.signSection(msg.Ns)
+
+	return err
+}
+
+func (s *signer) signSection(section []dns.RR) ([]dns.RR, error) {
+	var signed []dns.RR
+	for _, rrset := range rrsets(section) {
+		signed = append(signed, rrset...)
+		// the NS records of a delegation are not authoritative data
+		if rrset[0].Header().Rrtype == dns.TypeNS && !strings.EqualFold(rrset[0].Header().Name, s.zone) {
+			continue
+		}
+		sigs, err := s.sign(rrset)
+		if err != nil {
+			return nil, err
+		}
+		signed = append(signed, sigs...)
+	}
+
+	return signed, nil
+}
+
+// sign returns the signatures of rrset, signatures are cached by the contents
+// of the RRset
+func (s *signer) sign(rrset []dns.RR) ([]dns.RR, error) {
+	cacheable := s.cacheable == nil || s.cacheable(strings.ToLower(rrset[0].Header().Name))
+	var id strings.Builder
+	if cacheable {
+		for _, rr := range rrset {
+			id.WriteString(strings.ToLower(rr.String()))
+			id.WriteByte('\n')
+		}
+		if v, found := s.cache.Get(id.String()); found {
+			return v.([]dns.RR), nil
+		}
+	}
+
+	keys := s.zsk
+	if rrset[0].Header().Rrtype == dns.TypeDNSKEY {
+		keys = s.ksk
+	}
+	now := time.Now()
+	var sigs []dns.RR
+	for _, k := range keys {
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+			Algorithm:  k.key.Algorithm,
+			KeyTag:     k.tag,
+			SignerName: s.zone,
+			Inception:  uint32(now.Add(-sigInception).Unix()),
+			Expiration: uint32(now.Add(sigValidity).Unix()),
+		}
+		if err := sig.Sign(k.priv, rrset); err != nil {
+			return nil, fmt.Errorf("error signing %s %s: %w", rrset[0].Header().Name, dns.TypeToString[rrset[0].Header().Rrtype], err)
+		}
+		sigs = append(sigs, sig)
+	}
+	if cacheable {
+		s.cache.Set(id.String(), sigs, cache.DefaultExpiration)
+	}
+
+	return sigs, nil
+}
+
+// denial returns the NSEC record that proves name has none of the types but
+// types, using compact denial of existence (RFC 9824): the NSEC record only
+// covers name itself. A name that does not exist is flagged with the NXNAME
+// pseudo type.
+func (s *signer) denial(name string, types []uint16, ttl uint32) *dns.NSEC {
+	bitmap := append([]uint16{dns.TypeRRSIG, dns.TypeNSEC}, types...)
+	slices.Sort(bitmap)
+
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: ttl},
+		NextDomain: "\\000." + name,
+		TypeBitMap: slices.Compact(bitmap),
+	}
+}
+
+// secure adds the DNSSEC records to msg when the client asked for them with
+// the DO bit. Negative answers are proven by compact denial of existence, so
+// names that do not exist are answered with NOERROR.
+func (rsv *Resolver) secure(w dns.ResponseWriter, r *dns.Msg, msg *dns.Msg) {
+	if rsv.signer == nil || r.IsEdns0() == nil || !r.IsEdns0().Do() || !msg.Authoritative || msg.Truncated {
+		return
+	}
+
+	q := r.Question[0]
+	ttl := uint32(anyTTL)
+	if soa := rsv.zone.Load().negative(); soa != nil {
+		ttl = soa[0].Header().Ttl
+	}
+	switch {
+	case msg.Rcode == dns.RcodeNameError:
+		msg.Rcode = dns.RcodeSuccess
+		msg.Ns = append(msg.Ns, rsv.signer.denial(q.Name, []uint16{dns.TypeNXNAME}, ttl))
+	case msg.Rcode == dns.RcodeSuccess && len(msg.Answer) == 0:
+		msg.Ns = append(msg.Ns, rsv.signer.denial(q.Name, rsv.types(w, strings.ToLower(q.Name)), ttl))
+	}
+
+	if err := rsv.signer.signMsg(msg); err != nil {
+		msg.SetRcode(r, dns.RcodeServerFailure)
+		msg.Answer, msg.Ns, msg.Extra = nil, nil, nil
+		logger(w, q, msg.Rcode, err.Error())
+		return
+	}
+	if rsv.bogusToken(strings.ToLower(q.Name)) != "" {
+		breakSignatures(msg.Answer)
+	}
+}
+
+// bogusToken returns the token of a name of the DNSSEC validation test,
+// bogus-<token>.<domain>, or an empty string if name is not one of them
+func (rsv *Resolver) bogusToken(name string) string {
+	rel, found := strings.CutSuffix(name, "."+rsv.domain)
+	if !found || strings.Contains(rel, ".") {
+		return ""
+	}
+	token, found := strings.CutPrefix(rel, models.BogusPrefix)
+	if !found || !rsv.tokens.Valid(token) {
+		return ""
+	}
+
+	return token
+}
+
+// breakSignatures corrupts the signatures in section, so that validating
+// resolvers reject the answer as bogus. Signatures are copied as they are
+// shared with the signature cache.
+func breakSignatures(section []dns.RR) {
+	for i, rr := range section {
+		sig, ok := rr.(*dns.RRSIG)
+		if !ok {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(sig.Signature)
+		if err != nil || len(b) == 0 {
+			continue
+		}
+		b[len(b)/2] ^= 0xff
+		broken := dns.Copy(sig).(*dns.RRSIG)
+		broken.Signature = base64.StdEncoding.EncodeToString(b)
+		section[i] = broken
+	}
+}
+
+// secureDelegation adds to a referral the DS records of the delegated zone or,
+// if there are none, the proof that the delegation is not signed
+func (rsv *Resolver) secureDelegation(r *dns.Msg, msg *dns.Msg, cut []dns.RR) {
+	if rsv.signer == nil || r.IsEdns0() == nil || !r.IsEdns0().Do() {
+		return
+	}
+
+	name := cut[0].Header().Name
+	z := rsv.zone.Load()
+	var ds []dns.RR
+	for _, rr := range z.records[strings.ToLower(name)] {
+		if rr.Header().Rrtype == dns.TypeDS {
+			ds = append(ds, rr)
+		}
+	}
+	if len(ds) == 0 {
+		ds = []dns.RR{rsv.signer.denial(name, append(z.types(name), dns.TypeNS), cut[0].Header().Ttl)}
+	}
+	msg.Ns = append(msg.Ns, ds...)
+	if sigs, err := rsv.signer.signSection(ds); err == nil {
+		msg.Ns = append(msg.Ns, sigs[len(ds):]...)
+	}
+}
+
+// types returns the types of the records name owns, to build the type bitmap
+// of NSEC records
+func (rsv *Resolver) types(w dns.ResponseWriter, name string) []uint16 {
+	var types []uint16
+	addresses := func(f family) {
+		if f.ipv4 && len(rsv.ipv4) > 0 {
+			types = append(types, dns.TypeA)
+		}
+		if f.ipv6 && len(rsv.ipv6) > 0 {
+			types = append(types, dns.TypeAAAA)
+		}
+	}
+
+	probe, token := rsv.probeToken(name)
+	switch {
+	case rsv.isStackName(name):
+		f, _ := rsv.stackFamily(name)
+		addresses(f)
+	case rsv.isWhoami(name):
+		types = append(types, dns.TypeTXT, dns.TypeAAAA)
+		if host, _, _ := net.SplitHostPort(w.RemoteAddr().String()); net.ParseIP(host).To4() != nil {
+			types[1] = dns.TypeA
+		}
+	case rsv.isV6NSHost(name):
+		addresses(family{ipv6: true})
+	case rsv.tokens.Valid(strings.Split(name, ".")[0]), rsv.signer != nil && rsv.bogusToken(name) != "":
+		addresses(family{ipv4: true, ipv6: true})
+	case probe == probeBig:
+		head := probe + "-" + token + "." + rsv.domain
+		if hop, _ := rsv.bigHop(head, name); hop < rsv.bigHops(head) {
+			types = append(types, dns.TypeCNAME)
+		} else {
+			addresses(family{ipv4: true, ipv6: true})
+		}
+	case probe != "":
+		addresses(family{ipv4: true, ipv6: true})
+	case rsv.isACMEChallenge(name):
+		types = rsv.acmeTypes(name)
+	case rsv.isDynHost(name):
+		types = rsv.dynTypes(name)
+	case rsv.geo.isName(name):
+		types = append([]uint16{dns.TypeA, dns.TypeAAAA}, rsv.zone.Load().types(name)...)
+	case name == rsv.domain:
+		addresses(family{ipv4: true, ipv6: true})
+		types = append(types, rsv.zone.Load().types(name)...)
+	default:
+		types = rsv.zone.Load().types(name)
+	}
+
+	return types
+}
+
+// rrsets groups the records of a section by owner name and type, keeping the
+// order of the section
+func rrsets(section []dns.RR) [][]dns.RR {
+	var sets [][]dns.RR
+	index := map[string]int{}
+	for _, rr := range section {
+		if rr.Header().Rrtype == dns.TypeRRSIG {
+			continue
+		}
+		key := strings.ToLower(rr.Header().Name) + "/" + dns.TypeToString[rr.Header().Rrtype]
+		if i, ok := index[key]; ok {
+			sets[i] = append(sets[i], rr)
+			continue
+		}
+		index[key] = len(sets)
+		sets = append(sets, []dns.RR{rr})
+	}
+
+	return sets
+}
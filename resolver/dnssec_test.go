@@ -0,0 +1,231 @@
+package resolver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dcarrillo/whatismyip/internal/setting"
+	"github.com/dcarrillo/whatismyip/models"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestKey generates a key for the test domain and writes it in BIND
+// format, it returns the path prefix of the key files
+func writeTestKey(t *testing.T, flags uint16) string {
+	t.Helper()
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: domain + ".", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), fmt.Sprintf("K%s.+%03d+%05d", key.Hdr.Name, key.Algorithm, key.KeyTag()))
+	require.NoError(t, os.WriteFile(path+".key", []byte(key.String()+"\n"), 0o600))
+	require.NoError(t, os.WriteFile(path+".private", []byte(key.PrivateKeyString(priv)), 0o600))
+
+	return path
+}
+
+func newTestSignedResolver(t *testing.T, keys ...string) *Resolver {
+	t.Helper()
+	saved := setting.App.Resolver
+	t.Cleanup(func() { setting.App.Resolver = saved })
+	setting.App.Resolver.DNSSEC.Keys = keys
+
+	return newTestResolver(t)
+}
+
+func signedQuery(rsv *Resolver, name string, qtype uint16) *dns.Msg {
+	r := new(dns.Msg).SetQuestion(name, qtype)
+	r.SetEdns0(4096, true)
+
+	return query(rsv, "tcp", r)
+}
+
+// verify checks that every RRset of section is signed by one of keys
+func verify(t *testing.T, section []dns.RR, keys []dns.RR) {
+	t.Helper()
+	for _, rrset := range rrsets(section) {
+		var sig *dns.RRSIG
+		for _, rr := range section {
+			if s, ok := rr.(*dns.RRSIG); ok && s.TypeCovered == rrset[0].Header().Rrtype && s.Hdr.Name == rrset[0].Header().Name {
+				sig = s
+			}
+		}
+		require.NotNil(t, sig, "RRset %s %s is not signed", rrset[0].Header().Name, dns.TypeToString[rrset[0].Header().Rrtype])
+		verified := false
+		for _, k := range keys {
+			if key := k.(*dns.DNSKEY); key.KeyTag() == sig.KeyTag {
+				assert.NoError(t, sig.Verify(key, rrset))
+				assert.True(t, sig.ValidityPeriod(time.Now()))
+				verified = true
+			}
+		}
+		assert.True(t, verified, "no key for the signature of %s", rrset[0].Header().Name)
+	}
+}
+
+func TestDNSSECSigning(t *testing.T) {
+	ksk := writeTestKey(t, 257)
+	zsk := writeTestKey(t, 256)
+	rsv := newTestSignedResolver(t, ksk, zsk)
+
+	msg := signedQuery(rsv, domain+".", dns.TypeDNSKEY)
+	require.Equal(t, dns.RcodeSuccess, msg.Rcode)
+	var keys []dns.RR
+	for _, rr := range msg.Answer {
+		if rr.Header().Rrtype == dns.TypeDNSKEY {
+			keys = append(keys, rr)
+		}
+	}
+	require.Len(t, keys, 2)
+	verify(t, msg.Answer, keys)
+	assert.Equal(t, rsv.signer.ksk[0].tag, msg.Answer[len(msg.Answer)-1].(*dns.RRSIG).KeyTag, "DNSKEY is signed by the KSK")
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		nsec  []uint16
+	}{
+		{name: domain + ".", qtype: dns.TypeA},
+		{name: domain + ".", qtype: dns.TypeSOA},
+		{name: testTokens.New("198.51.100.1") + "." + domain + ".", qtype: dns.TypeAAAA},
+		{name: "whoami." + domain + ".", qtype: dns.TypeTXT},
+		{name: "v4." + domain + ".", qtype: dns.TypeAAAA, nsec: []uint16{dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC}},
+		{name: domain + ".", qtype: dns.TypeMX, nsec: []uint16{dns.TypeA, dns.TypeNS, dns.TypeSOA, dns.TypeAAAA, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeDNSKEY}},
+		{name: "missing." + domain + ".", qtype: dns.TypeA, nsec: []uint16{dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNXNAME}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name+"/"+dns.TypeToString[tt.qtype], func(t *testing.T) {
+			msg := signedQuery(rsv, tt.name, tt.qtype)
+			require.Equal(t, dns.RcodeSuccess, msg.Rcode)
+			verify(t, msg.Answer, keys)
+			verify(t, msg.Ns, keys)
+			if tt.nsec == nil {
+				require.NotEmpty(t, msg.Answer)
+				return
+			}
+
+			assert.Empty(t, msg.Answer)
+			var nsec *dns.NSEC
+			for _, rr := range msg.Ns {
+				if n, ok := rr.(*dns.NSEC); ok {
+					nsec = n
+				}
+			}
+			require.NotNil(t, nsec)
+			assert.Equal(t, tt.name, nsec.Hdr.Name)
+			assert.Equal(t, "\\000."+tt.name, nsec.NextDomain)
+			assert.Equal(t, tt.nsec, nsec.TypeBitMap)
+		})
+	}
+
+	t.Run("no signatures without the DO bit", func(t *testing.T) {
+		msg := query(rsv, "udp", new(dns.Msg).SetQuestion("missing."+domain+".", dns.TypeA))
+		assert.Equal(t, dns.RcodeNameError, msg.Rcode)
+		for _, rr := range msg.Ns {
+			assert.NotEqual(t, dns.TypeRRSIG, rr.Header().Rrtype)
+		}
+	})
+}
+
+func TestDNSSECSignatureCache(t *testing.T) {
+	rsv := newTestSignedResolver(t, writeTestKey(t, 257))
+
+	signedQuery(rsv, domain+".", dns.TypeA)
+	cached := rsv.signer.cache.ItemCount()
+	assert.Positive(t, cached, "the static zone is cached")
+
+	for i := range 100 {
+		signedQuery(rsv, testTokens.New("198.51.100.1")+"."+domain+".", dns.TypeA)
+		signedQuery(rsv, fmt.Sprintf("missing-%d.%s.", i, domain), dns.TypeA)
+	}
+	// the SOA record of the negative answers is part of the zone
+	assert.LessOrEqual(t, rsv.signer.cache.ItemCount(), cached+1, "synthesized records are not cached")
+}
+
+func TestDNSSECCombinedKey(t *testing.T) {
+	rsv := newTestSignedResolver(t, writeTestKey(t, 257))
+
+	msg := signedQuery(rsv, domain+".", dns.TypeDNSKEY)
+	require.Equal(t, dns.RcodeSuccess, msg.Rcode)
+	require.Len(t, msg.Answer, 2)
+	verify(t, msg.Answer, msg.Answer[:1])
+
+	msg = signedQuery(rsv, domain+".", dns.TypeA)
+	verify(t, msg.Answer, []dns.RR{rsv.signer.ksk[0].key})
+}
+
+func TestDNSSECDelegation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zone")
+	zone := "sub 60 IN NS ns.sub\nns.sub 60 IN A 192.0.2.53\nsigned 60 IN NS ns.signed\nsigned 60 IN DS 12345 13 2 0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef\n"
+	require.NoError(t, os.WriteFile(path, []byte(zone), 0o600))
+	saved := setting.App.Resolver
+	t.Cleanup(func() { setting.App.Resolver = saved })
+	setting.App.Resolver.ZoneFile = path
+	rsv := newTestSignedResolver(t, writeTestKey(t, 257))
+	keys := []dns.RR{rsv.signer.ksk[0].key}
+
+	msg := signedQuery(rsv, "www.sub."+domain+".", dns.TypeA)
+	assert.False(t, msg.Authoritative)
+	require.Len(t, msg.Ns, 3)
+	assert.Equal(t, dns.TypeNS, msg.Ns[0].Header().Rrtype)
+	assert.Equal(t, []uint16{dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC}, msg.Ns[1].(*dns.NSEC).TypeBitMap)
+	verify(t, msg.Ns[1:], keys)
+
+	msg = signedQuery(rsv, "www.signed."+domain+".", dns.TypeA)
+	require.Len(t, msg.Ns, 3)
+	assert.Equal(t, dns.TypeDS, msg.Ns[1].Header().Rrtype)
+	verify(t, msg.Ns[1:], keys)
+}
+
+func TestLoadSignerErrors(t *testing.T) {
+	_, err := loadSigner(domain, []string{writeTestKey(t, 256)})
+	assert.ErrorContains(t, err, "key signing key is mandatory")
+
+	_, err = loadSigner("example.org", []string{writeTestKey(t, 257)})
+	assert.ErrorContains(t, err, "not to example.org.")
+
+	_, err = loadSigner(domain, []string{filepath.Join(t.TempDir(), "missing")})
+	assert.Error(t, err)
+}
+
+func TestDNSSECBogus(t *testing.T) {
+	u := testTokens.New("198.51.100.1")
+	bogus := "bogus-" + u + "." + domain + "."
+
+	t.Run("broken signature", func(t *testing.T) {
+		rsv := newTestSignedResolver(t, writeTestKey(t, 257))
+		key := rsv.signer.ksk[0].key
+
+		msg := signedQuery(rsv, bogus, dns.TypeA)
+		require.Equal(t, dns.RcodeSuccess, msg.Rcode)
+		require.Len(t, msg.Answer, 2)
+		sig := msg.Answer[1].(*dns.RRSIG)
+		assert.Error(t, sig.Verify(key, msg.Answer[:1]))
+		found, _ := rsv.store.Get(models.BogusQueryKey(u), new(bool))
+		assert.True(t, found)
+
+		// signatures are broken on copies, the second answer is still bogus
+		msg = signedQuery(rsv, bogus, dns.TypeA)
+		require.Len(t, msg.Answer, 2)
+		assert.Error(t, msg.Answer[1].(*dns.RRSIG).Verify(key, msg.Answer[:1]))
+	})
+
+	t.Run("no bogus names without DNSSEC", func(t *testing.T) {
+		rsv := newTestResolver(t)
+		msg := query(rsv, "udp", new(dns.Msg).SetQuestion(bogus, dns.TypeA))
+		assert.Equal(t, dns.RcodeNameError, msg.Rcode)
+		found, _ := rsv.store.Get(models.BogusQueryKey(u), new(bool))
+		assert.False(t, found)
+	})
+}
@@ -0,0 +1,51 @@
+package resolver
+
+import (
+	"net"
+
+	"github.com/dcarrillo/whatismyip/models"
+	"github.com/miekg/dns"
+)
+
+// dynHost returns the addresses a dynamic DNS client published for name
+func (rsv *Resolver) dynHost(name string) (models.DynDNSHost, bool) {
+	if rsv.dyn == nil {
+		return models.DynDNSHost{}, false
+	}
+
+	return rsv.dyn.Lookup(name)
+}
+
+// isDynHost reports whether name has been published by a dynamic DNS client
+func (rsv *Resolver) isDynHost(name string) bool {
+	_, ok := rsv.dynHost(name)
+	return ok
+}
+
+// dynIPs answers with the addresses published for the name, it has no data of
+// the family that has not been published
+func (rsv *Resolver) dynIPs(q dns.Question, msg *dns.Msg, name string) {
+	h, _ := rsv.dynHost(name)
+	var ipv4, ipv6 []net.IP
+	if h.IPv4 != nil {
+		ipv4 = []net.IP{h.IPv4}
+	}
+	if h.IPv6 != nil {
+		ipv6 = []net.IP{h.IPv6}
+	}
+	appendAddresses(q, msg, ipv4, ipv6)
+}
+
+// dynTypes returns the types of the addresses published for name
+func (rsv *Resolver) dynTypes(name string) []uint16 {
+	h, _ := rsv.dynHost(name)
+	var types []uint16
+	if h.IPv4 != nil {
+		types = append(types, dns.TypeA)
+	}
+	if h.IPv6 != nil {
+		types = append(types, dns.TypeAAAA)
+	}
+
+	return types
+}
@@ -0,0 +1,38 @@
+package resolver
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dcarrillo/whatismyip/service"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDynDNS(t *testing.T) {
+	newTestResolver(t)
+	dyn, err := service.NewDynDNS(filepath.Join(t.TempDir(), "dyndns.json"))
+	require.NoError(t, err)
+	rsv, err := Setup(Config{Store: service.NewMemoryDiscoveryStore(time.Minute, 1000, 0), Tokens: testTokens, DynDNS: dyn})
+	require.NoError(t, err)
+	name := "home." + domain + "."
+
+	msg := query(rsv, "udp", new(dns.Msg).SetQuestion(name, dns.TypeA))
+	assert.Equal(t, dns.RcodeNameError, msg.Rcode)
+
+	_, err = dyn.Update(name, []net.IP{net.ParseIP("192.0.2.10")})
+	require.NoError(t, err)
+
+	msg = query(rsv, "udp", new(dns.Msg).SetQuestion("HOME."+domain+".", dns.TypeA))
+	require.Equal(t, dns.RcodeSuccess, msg.Rcode)
+	require.Len(t, msg.Answer, 1)
+	assert.Equal(t, "192.0.2.10", msg.Answer[0].(*dns.A).A.String())
+
+	msg = query(rsv, "udp", new(dns.Msg).SetQuestion(name, dns.TypeAAAA))
+	assert.Equal(t, dns.RcodeSuccess, msg.Rcode)
+	assert.Empty(t, msg.Answer)
+	assert.NotEmpty(t, msg.Ns, "no data")
+}
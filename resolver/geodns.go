@@ -0,0 +1,131 @@
+package resolver
+
+import (
+	"net"
+	"strings"
+
+	"github.com/dcarrillo/whatismyip/internal/setting"
+	"github.com/dcarrillo/whatismyip/service"
+	"github.com/miekg/dns"
+)
+
+// geoDNS selects the addresses of the apex and the configured names by the
+// location of the client: the client subnet the resolver sent (ECS), or the
+// resolver itself
+type geoDNS struct {
+	geo       *service.Geo
+	names     map[string]struct{}
+	asn       map[uint]addresses
+	country   map[string]addresses
+	continent map[string]addresses
+	fallback  addresses
+}
+
+type addresses struct {
+	ipv4 []net.IP
+	ipv6 []net.IP
+}
+
+// newGeoDNS returns the GeoDNS configuration of domain, nil if it is not
+// enabled. The answer defaults to the addresses of the server.
+func newGeoDNS(domain string, geo *service.Geo, ipv4 []net.IP, ipv6 []net.IP) *geoDNS {
+	conf := setting.App.Resolver.GeoDNS
+	if !conf.Enabled() {
+		return nil
+	}
+
+	parse := func(ipv4 []string, ipv6 []string) addresses {
+		var a addresses
+		for _, ip := range ipv4 {
+			a.ipv4 = append(a.ipv4, net.ParseIP(ip))
+		}
+		for _, ip := range ipv6 {
+			a.ipv6 = append(a.ipv6, net.ParseIP(ip))
+		}
+		return a
+	}
+
+	g := &geoDNS{
+		geo:       geo,
+		names:     map[string]struct{}{domain: {}},
+		asn:       map[uint]addresses{},
+		country:   map[string]addresses{},
+		continent: map[string]addresses{},
+		fallback:  parse(conf.Default.Ipv4, conf.Default.Ipv6),
+	}
+	if len(g.fallback.ipv4) == 0 && len(g.fallback.ipv6) == 0 {
+		g.fallback = addresses{ipv4: ipv4, ipv6: ipv6}
+	}
+	for _, name := range conf.Names {
+		g.names[strings.ToLower(name)+"."+domain] = struct{}{}
+	}
+	for asn, a := range conf.ASN {
+		g.asn[asn] = parse(a.Ipv4, a.Ipv6)
+	}
+	for country, a := range conf.Country {
+		g.country[country] = parse(a.Ipv4, a.Ipv6)
+	}
+	for continent, a := range conf.Continent {
+		g.continent[continent] = parse(a.Ipv4, a.Ipv6)
+	}
+
+	return g
+}
+
+// isName reports whether name is answered by GeoDNS
+func (g *geoDNS) isName(name string) bool {
+	if g == nil {
+		return false
+	}
+	_, ok := g.names[strings.ToLower(name)]
+
+	return ok
+}
+
+// answers reports whether the answer to q depends on the location of the
+// client
+func (g *geoDNS) answers(q dns.Question) bool {
+	return (q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA) && g.isName(q.Name)
+}
+
+// lookup returns the addresses for a client at ip, the most specific match
+// wins: ASN, country and then continent
+func (g *geoDNS) lookup(ip net.IP) addresses {
+	if g.geo == nil || ip == nil {
+		return g.fallback
+	}
+	if record := g.geo.LookUpASN(ip); record != nil {
+		if a, ok := g.asn[record.AutonomousSystemNumber]; ok {
+			return a
+		}
+	}
+	if record := g.geo.LookUpCity(ip); record != nil {
+		if a, ok := g.country[record.Country.ISOCode]; ok {
+			return a
+		}
+		if a, ok := g.continent[record.Continent.Code]; ok {
+			return a
+		}
+	}
+
+	return g.fallback
+}
+
+// geoIPs answers with the addresses for the location of the client
+func (rsv *Resolver) geoIPs(w dns.ResponseWriter, r *dns.Msg, msg *dns.Msg) {
+	a := rsv.geo.lookup(geoClientIP(w, r))
+	appendAddresses(r.Question[0], msg, a.ipv4, a.ipv6)
+}
+
+// geoClientIP returns the address the client is located by, the client subnet
+// when the resolver sent one
+func geoClientIP(w dns.ResponseWriter, r *dns.Msg) net.IP {
+	if opt := r.IsEdns0(); opt != nil {
+		if ecs := clientSubnet(opt); ecs != nil && ecs.SourceNetmask > 0 {
+			return ecs.Address
+		}
+	}
+	host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+
+	return net.ParseIP(host)
+}
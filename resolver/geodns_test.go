@@ -0,0 +1,112 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dcarrillo/whatismyip/internal/setting"
+	"github.com/dcarrillo/whatismyip/service"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+const geoDNSConf = `
+names: [www]
+asn:
+  209: {ipv4: [192.0.2.209]}
+country:
+  GB: {ipv4: [192.0.2.44], ipv6: ["2001:db8::44"]}
+continent:
+  EU: {ipv4: [192.0.2.150]}
+  NA: {ipv4: [192.0.2.1]}
+`
+
+func newTestGeoResolver(t *testing.T) *Resolver {
+	t.Helper()
+	newTestResolver(t)
+	require.NoError(t, yaml.Unmarshal([]byte(geoDNSConf), &setting.App.Resolver.GeoDNS))
+
+	_, err := Setup(Config{Store: service.NewMemoryDiscoveryStore(time.Minute, 1000, 0), Tokens: testTokens})
+	require.ErrorContains(t, err, "geodns requires the geo databases")
+
+	geo, err := service.NewGeo(context.Background(), "../test/GeoIP2-City-Test.mmdb", "../test/GeoLite2-ASN-Test.mmdb")
+	require.NoError(t, err)
+	t.Cleanup(geo.Shutdown)
+	rsv, err := Setup(Config{Store: service.NewMemoryDiscoveryStore(time.Minute, 1000, 0), Tokens: testTokens, Geo: geo})
+	require.NoError(t, err)
+
+	return rsv
+}
+
+func TestGeoDNS(t *testing.T) {
+	rsv := newTestGeoResolver(t)
+
+	tests := []struct {
+		name     string
+		client   string
+		ecs      string
+		qname    string
+		qtype    uint16
+		expected []string
+		scope    uint8
+	}{
+		{name: "asn", client: "216.160.83.56", qname: domain, qtype: dns.TypeA, expected: []string{"192.0.2.209"}},
+		{name: "country", client: "81.2.69.192", qname: domain, qtype: dns.TypeA, expected: []string{"192.0.2.44"}},
+		{name: "country ipv6", client: "81.2.69.192", qname: "www." + domain, qtype: dns.TypeAAAA, expected: []string{"2001:db8::44"}},
+		{name: "continent", client: "89.160.20.112", qname: "WWW." + domain, qtype: dns.TypeA, expected: []string{"192.0.2.150"}},
+		{name: "no data for the family", client: "89.160.20.112", qname: domain, qtype: dns.TypeAAAA},
+		{name: "default", client: "175.16.199.1", qname: domain, qtype: dns.TypeA, expected: []string{"127.0.0.2"}},
+		{name: "client subnet", client: "175.16.199.1", ecs: "81.2.69.192/28", qname: domain, qtype: dns.TypeA, expected: []string{"192.0.2.44"}, scope: 28},
+		{name: "client subnet /0", client: "175.16.199.1", ecs: "0.0.0.0/0", qname: domain, qtype: dns.TypeA, expected: []string{"127.0.0.2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := new(dns.Msg).SetQuestion(tt.qname+".", tt.qtype)
+			if tt.ecs != "" {
+				_, subnet, err := net.ParseCIDR(tt.ecs)
+				require.NoError(t, err)
+				ones, _ := subnet.Mask.Size()
+				r.SetEdns0(1232, false)
+				r.IsEdns0().Option = append(r.IsEdns0().Option, &dns.EDNS0_SUBNET{
+					Code:          dns.EDNS0SUBNET,
+					Family:        1,
+					SourceNetmask: uint8(ones),
+					Address:       subnet.IP,
+				})
+			}
+			w := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP(tt.client), Port: 5353}}
+			rsv.Handler().ServeDNS(w, r)
+
+			require.Equal(t, dns.RcodeSuccess, w.msg.Rcode)
+			var answers []string
+			for _, rr := range w.msg.Answer {
+				switch rr := rr.(type) {
+				case *dns.A:
+					answers = append(answers, rr.A.String())
+				case *dns.AAAA:
+					answers = append(answers, rr.AAAA.String())
+				}
+			}
+			assert.Equal(t, tt.expected, answers)
+			if tt.ecs != "" {
+				ecs := clientSubnet(w.msg.IsEdns0())
+				require.NotNil(t, ecs)
+				assert.Equal(t, tt.scope, ecs.SourceScope)
+			}
+		})
+	}
+
+	t.Run("other types", func(t *testing.T) {
+		msg := query(rsv, "udp", new(dns.Msg).SetQuestion(domain+".", dns.TypeSOA))
+		assert.Len(t, msg.Answer, 1)
+
+		msg = query(rsv, "udp", new(dns.Msg).SetQuestion("www."+domain+".", dns.TypeTXT))
+		assert.Equal(t, dns.RcodeSuccess, msg.Rcode, "the name exists")
+		assert.Empty(t, msg.Answer)
+	})
+}
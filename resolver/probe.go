@@ -0,0 +1,204 @@
+package resolver
+
+import (
+	"log"
+	"net"
+	"strings"
+
+	"github.com/dcarrillo/whatismyip/models"
+	"github.com/miekg/dns"
+)
+
+// Capability probes, every probe is a name in the form <probe>-<token>.<domain>
+const (
+	// probeTC is always answered with the TC bit over UDP, the resolver should
+	// retry over TCP
+	probeTC = models.ProbeTC
+	// probeBig is the head of a chain of CNAME records with long names, the
+	// answer only fits in the EDNS buffer size of the server
+	probeBig = models.ProbeBig
+	// probeV6NS is delegated to a name server only reachable over IPv6
+	probeV6NS = models.ProbeV6NS
+	// probeQM accepts any number of labels below it, a resolver that
+	// minimises the query name (RFC 9156) asks for the intermediate names first
+	probeQM = models.ProbeQM
+)
+
+// v6nsHost is the name server (under the domain) of the IPv6-only delegation
+const v6nsHost = "v6ns"
+
+// probeToken returns the probe and the token of name, empty strings if name is
+// not a probe name
+func (rsv *Resolver) probeToken(name string) (probe string, token string) {
+	rel, found := strings.CutSuffix(name, "."+rsv.domain)
+	if !found {
+		return "", ""
+	}
+	labels := strings.Split(rel, ".")
+	probe, token, found = strings.Cut(labels[len(labels)-1], "-")
+	if !found || !rsv.tokens.Valid(token) {
+		return "", ""
+	}
+
+	switch {
+	case probe == probeQM:
+	case probe == probeBig && len(labels) > 1:
+		head := labels[len(labels)-1] + "." + rsv.domain
+		if hop, ok := rsv.bigHop(head, name); !ok || hop == 0 {
+			return "", ""
+		}
+	case len(labels) > 1:
+		return "", ""
+	case probe == probeV6NS && len(rsv.ipv6) == 0:
+		return "", ""
+	case probe != probeTC && probe != probeBig && probe != probeV6NS:
+		return "", ""
+	}
+
+	return probe, token
+}
+
+// probe answers a probe name, the returned function records what the query
+// revealed about the resolver once the reply is sent
+func (rsv *Resolver) probe(w dns.ResponseWriter, r *dns.Msg, msg *dns.Msg, probe string, token string) func(*dns.Msg) {
+	q := r.Question[0]
+	udp := transport(w) == TransportUDP
+	host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+	record := func(update func(*models.DNSProbes)) func(*dns.Msg) {
+		return func(*dns.Msg) { rsv.recordProbe(token, host, update) }
+	}
+
+	switch probe {
+	case probeTC:
+		if udp {
+			msg.Truncated = true
+			return record(func(p *models.DNSProbes) { p.Truncated = true })
+		}
+		rsv.getIP(q, msg)
+		return record(func(p *models.DNSProbes) { p.TCPRetry = true })
+	case probeBig:
+		head := probe + "-" + token + "." + rsv.domain
+		hop, _ := rsv.bigHop(head, strings.ToLower(q.Name))
+		rsv.bigChain(q, msg, head, hop)
+		// the names of the chain are only recorded when the resolver asks
+		// for them, the outcome is the one of the whole chain
+		if hop > 0 {
+			return nil
+		}
+		return func(msg *dns.Msg) {
+			rsv.recordProbe(token, host, func(p *models.DNSProbes) {
+				switch {
+				case !udp:
+					p.LargeTCP = true
+				case msg.Truncated:
+					p.LargeTruncated = true
+				default:
+					p.LargeUDP = true
+				}
+			})
+		}
+	case probeV6NS:
+		if net.ParseIP(host).To4() != nil {
+			rsv.v6nsReferral(q, msg)
+			rsv.secureDelegation(r, msg, msg.Ns)
+			return record(func(p *models.DNSProbes) { p.V6Referral = true })
+		}
+		// queries over IPv6 are sent to the delegated name server
+		rsv.getIP(q, msg)
+		return record(func(p *models.DNSProbes) { p.IPv6 = true })
+	case probeQM:
+		rsv.getIP(q, msg)
+		rel := strings.TrimSuffix(strings.ToLower(q.Name), "."+rsv.domain)
+		return record(func(p *models.DNSProbes) { p.AddQName(rel) })
+	}
+
+	return nil
+}
+
+// bigHops returns the number of CNAME records of the chain of the big probe
+// with the given head, as many as fit in the EDNS buffer size of the server
+// leaving room for the OPT record and a signature
+func (rsv *Resolver) bigHops(head string) int {
+	size := len(rsv.bigHopName(head, 1)) + 12
+	return min(max((rsv.udpSize-200)/size, 1), maxCNAMEChain)
+}
+
+// bigHopName returns the name of the hop-th name of the chain of the big
+// probe: the head itself, then names as long as a name can be, made of labels
+// of a letter that changes at every hop so that they cannot be compressed
+func (rsv *Resolver) bigHopName(head string, hop int) string {
+	if hop == 0 {
+		return head
+	}
+
+	var labels []string
+	for avail := 253 - len(head) - 1; avail > 1; {
+		n := min(avail-1, 63)
+		labels = append(labels, strings.Repeat(string(rune('a'+hop-1)), n))
+		avail -= n + 1
+	}
+
+	return strings.Join(labels, ".") + "." + head
+}
+
+// bigHop returns the position of name in the chain of the big probe
+func (rsv *Resolver) bigHop(head string, name string) (int, bool) {
+	if name == head {
+		return 0, true
+	}
+	hop := int(name[0]) - 'a' + 1
+	if hop < 1 || hop > rsv.bigHops(head) || rsv.bigHopName(head, hop) != name {
+		return 0, false
+	}
+
+	return hop, true
+}
+
+// bigChain answers with the chain of the big probe from the hop-th name, the
+// last name holds the addresses of the server and has no data of other types
+func (rsv *Resolver) bigChain(q dns.Question, msg *dns.Msg, head string, hop int) {
+	hops := rsv.bigHops(head)
+	owner := q.Name
+	for i := hop; i < hops; i++ {
+		target := rsv.bigHopName(head, i+1)
+		msg.Answer = append(msg.Answer, &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: owner, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+			Target: target,
+		})
+		owner = target
+	}
+	if q.Qtype != dns.TypeCNAME && !rsv.appendIPs(dns.Question{Name: owner, Qtype: q.Qtype}, msg, family{ipv4: true, ipv6: true}) {
+		msg.Ns = rsv.zone.Load().negative()
+	}
+}
+
+// v6nsReferral delegates the probe name to a name server that has only IPv6
+// addresses, the server itself
+func (rsv *Resolver) v6nsReferral(q dns.Question, msg *dns.Msg) {
+	ns := v6nsHost + "." + rsv.domain
+	msg.Authoritative = false
+	msg.Ns = append(msg.Ns, &dns.NS{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60},
+		Ns:  ns,
+	})
+	for _, ip := range rsv.ipv6 {
+		msg.Extra = append(msg.Extra, &dns.AAAA{
+			Hdr:  dns.RR_Header{Name: ns, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60},
+			AAAA: ip,
+		})
+	}
+}
+
+// isV6NSHost reports whether name is the name server of the IPv6-only
+// delegation, which has no IPv4 addresses
+func (rsv *Resolver) isV6NSHost(name string) bool {
+	return len(rsv.ipv6) > 0 && name == v6nsHost+"."+rsv.domain
+}
+
+// recordProbe updates the probe results of token, queried from ip
+func (rsv *Resolver) recordProbe(token string, ip string, update func(*models.DNSProbes)) {
+	probes := models.DNSProbes{}
+	if err := rsv.store.Update(models.ProbesKey(token), ip, &probes, func() { update(&probes) }); err != nil {
+		log.Printf("Error recording probes %s: %s", token, err)
+	}
+}
@@ -0,0 +1,142 @@
+package resolver
+
+import (
+	"net"
+	"testing"
+
+	"github.com/dcarrillo/whatismyip/models"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var probeToken = testTokens.New("198.51.100.1")
+
+func probes(t *testing.T, rsv *Resolver) models.DNSProbes {
+	t.Helper()
+	probes := models.DNSProbes{}
+	found, err := rsv.store.Get(models.ProbesKey(probeToken), &probes)
+	require.NoError(t, err)
+	require.True(t, found)
+
+	return probes
+}
+
+func TestProbeToken(t *testing.T) {
+	rsv := newTestResolver(t)
+
+	tests := []struct {
+		name  string
+		probe string
+	}{
+		{name: "tc-" + probeToken + "." + domain + ".", probe: probeTC},
+		{name: "big-" + probeToken + "." + domain + ".", probe: probeBig},
+		{name: "v6ns-" + probeToken + "." + domain + ".", probe: probeV6NS},
+		{name: "a.b.qm-" + probeToken + "." + domain + ".", probe: probeQM},
+		{name: "a.tc-" + probeToken + "." + domain + "."},
+		{name: "xx-" + probeToken + "." + domain + "."},
+		{name: "tc-not-uuid." + domain + "."},
+		{name: "tc-" + probeToken + ".example.org."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			probe, token := rsv.probeToken(tt.name)
+			assert.Equal(t, tt.probe, probe)
+			if tt.probe != "" {
+				assert.Equal(t, probeToken, token)
+			}
+		})
+	}
+}
+
+func TestProbeTC(t *testing.T) {
+	rsv := newTestResolver(t)
+	name := "tc-" + probeToken + "." + domain + "."
+
+	msg := query(rsv, "udp", new(dns.Msg).SetQuestion(name, dns.TypeA))
+	assert.True(t, msg.Truncated)
+	assert.Empty(t, msg.Answer)
+	assert.Empty(t, msg.Ns)
+	assert.False(t, probes(t, rsv).TCPRetry)
+
+	msg = query(rsv, "tcp", new(dns.Msg).SetQuestion(name, dns.TypeA))
+	assert.False(t, msg.Truncated)
+	assert.Len(t, msg.Answer, 1)
+	p := probes(t, rsv)
+	assert.True(t, p.Truncated)
+	assert.True(t, p.TCPRetry)
+}
+
+func TestProbeBig(t *testing.T) {
+	rsv := newTestResolver(t)
+	name := "big-" + probeToken + "." + domain + "."
+
+	msg := query(rsv, "udp", new(dns.Msg).SetQuestion(name, dns.TypeA))
+	assert.True(t, msg.Truncated)
+	assert.True(t, probes(t, rsv).LargeTruncated)
+
+	r := new(dns.Msg).SetQuestion(name, dns.TypeA)
+	r.SetEdns0(1232, false)
+	msg = query(rsv, "udp", r)
+	assert.False(t, msg.Truncated)
+	require.Greater(t, len(msg.Answer), 2)
+	assert.Greater(t, msg.Len(), dns.MinMsgSize)
+	assert.LessOrEqual(t, msg.Len(), 1232)
+	assert.True(t, probes(t, rsv).LargeUDP)
+
+	last := msg.Answer[len(msg.Answer)-2].(*dns.CNAME).Target
+	assert.Equal(t, last, msg.Answer[len(msg.Answer)-1].Header().Name)
+	assert.Equal(t, dns.TypeA, msg.Answer[len(msg.Answer)-1].Header().Rrtype, "the chain ends with the addresses")
+
+	// the names of the chain are answered when the resolver asks for them
+	hop := msg.Answer[0].(*dns.CNAME).Target
+	probe, token := rsv.probeToken(hop)
+	assert.Equal(t, probeBig, probe)
+	assert.Equal(t, probeToken, token)
+	chain := len(msg.Answer)
+	msg = query(rsv, "tcp", new(dns.Msg).SetQuestion(hop, dns.TypeAAAA))
+	require.Len(t, msg.Answer, chain-1)
+	assert.Equal(t, dns.TypeAAAA, msg.Answer[len(msg.Answer)-1].Header().Rrtype)
+	assert.False(t, probes(t, rsv).LargeTCP, "only the head of the chain is recorded")
+
+	probe, _ = rsv.probeToken("x." + hop)
+	assert.Empty(t, probe)
+	probe, _ = rsv.probeToken("z" + hop[1:])
+	assert.Empty(t, probe)
+}
+
+func TestProbeV6NS(t *testing.T) {
+	rsv := newTestResolver(t)
+	name := "v6ns-" + probeToken + "." + domain + "."
+
+	msg := query(rsv, "udp", new(dns.Msg).SetQuestion(name, dns.TypeA))
+	assert.False(t, msg.Authoritative)
+	require.Len(t, msg.Ns, 1)
+	assert.Equal(t, "v6ns."+domain+".", msg.Ns[0].(*dns.NS).Ns)
+	require.Len(t, msg.Extra, 1)
+	assert.Equal(t, dns.TypeAAAA, msg.Extra[0].Header().Rrtype)
+	assert.False(t, probes(t, rsv).IPv6)
+
+	msg = query(rsv, "udp", new(dns.Msg).SetQuestion("v6ns."+domain+".", dns.TypeA))
+	assert.Empty(t, msg.Answer, "the name server has no IPv4 address")
+
+	w := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5353}}
+	rsv.Handler().ServeDNS(w, new(dns.Msg).SetQuestion(name, dns.TypeA))
+	assert.True(t, w.msg.Authoritative)
+	assert.Len(t, w.msg.Answer, 1)
+	p := probes(t, rsv)
+	assert.True(t, p.V6Referral)
+	assert.True(t, p.IPv6)
+}
+
+func TestProbeQNameMinimisation(t *testing.T) {
+	rsv := newTestResolver(t)
+
+	for _, name := range []string{"qm-", "b.qm-", "a.b.qm-", "A.b.QM-"} {
+		msg := query(rsv, "udp", new(dns.Msg).SetQuestion(name+probeToken+"."+domain+".", dns.TypeA))
+		require.Equal(t, dns.RcodeSuccess, msg.Rcode)
+		assert.Len(t, msg.Answer, 1)
+	}
+	assert.Equal(t, []string{"qm-" + probeToken, "b.qm-" + probeToken, "a.b.qm-" + probeToken}, probes(t, rsv).QNames)
+}
@@ -1,24 +1,57 @@
 package resolver
 
 import (
+	"fmt"
 	"log"
 	"net"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/dcarrillo/whatismyip/internal/metrics"
 	"github.com/dcarrillo/whatismyip/internal/setting"
-	"github.com/dcarrillo/whatismyip/internal/validator/uuid"
+	"github.com/dcarrillo/whatismyip/internal/validator"
+	"github.com/dcarrillo/whatismyip/models"
+	"github.com/dcarrillo/whatismyip/service"
 	"github.com/miekg/dns"
-	"github.com/patrickmn/go-cache"
 )
 
+// Transports a query can be received over
+const (
+	TransportUDP   = "udp"
+	TransportTCP   = "tcp"
+	TransportTLS   = "tls"
+	TransportHTTPS = "https"
+)
+
+// anyTTL is the TTL of the answer to ANY queries
+const anyTTL = 3600
+
 type Resolver struct {
 	handler *dns.ServeMux
-	store   *cache.Cache
+	store   service.DiscoveryStore
+	tokens  *validator.Tokens
 	domain  string
-	rr      []string
+	zone    atomic.Pointer[zone]
 	ipv4    []net.IP
 	ipv6    []net.IP
+	stack   map[string]family
+	udpSize int
+	signer  *signer
+	geo     *geoDNS
+	dyn     *service.DynDNS
+	acme    *service.ACME
+	xfr     *transfer
+
+	whoamiNames map[string]struct{}
+	chaosNames  map[string]string
+	nsidValue   string
+}
+
+// family is the set of address families a name resolves to
+type family struct {
+	ipv4 bool
+	ipv6 bool
 }
 
 func ensureDotSuffix(s string) string {
@@ -28,7 +61,18 @@ func ensureDotSuffix(s string) string {
 	return s
 }
 
-func Setup(store *cache.Cache) *Resolver {
+// Config holds the services the resolver answers from. Store and Tokens are
+// mandatory, Geo is required by GeoDNS, and DynDNS and ACME are only set when
+// their services are enabled.
+type Config struct {
+	Store  service.DiscoveryStore
+	Tokens *validator.Tokens
+	Geo    *service.Geo
+	DynDNS *service.DynDNS
+	ACME   *service.ACME
+}
+
+func Setup(cfg Config) (*Resolver, error) {
 	var ipv4, ipv6 []net.IP
 	for _, ip := range setting.App.Resolver.Ipv4 {
 		ipv4 = append(ipv4, net.ParseIP(ip))
@@ -39,26 +83,148 @@ func Setup(store *cache.Cache) *Resolver {
 
 	resolver := &Resolver{
 		handler: dns.NewServeMux(),
-		store:   store,
+		store:   cfg.Store,
+		tokens:  cfg.Tokens,
 		domain:  ensureDotSuffix(setting.App.Resolver.Domain),
-		rr:      setting.App.Resolver.ResourceRecords,
 		ipv4:    ipv4,
 		ipv6:    ipv6,
+		stack:   map[string]family{},
+		dyn:     cfg.DynDNS,
+		acme:    cfg.ACME,
+		xfr:     newTransfer(),
+		udpSize: max(setting.App.Resolver.Listen.UDPSize, dns.MinMsgSize),
+
+		whoamiNames: map[string]struct{}{},
+		chaosNames:  newChaosNames(),
+		nsidValue:   setting.App.Resolver.Identity.NSID,
+	}
+	for _, name := range setting.App.Resolver.Whoami {
+		resolver.whoamiNames[strings.ToLower(name)+"."+resolver.domain] = struct{}{}
+	}
+	if st := setting.App.Resolver.StackTest; st.Enabled() {
+		resolver.stack[strings.ToLower(st.Ipv4)] = family{ipv4: true}
+		resolver.stack[strings.ToLower(st.Ipv6)] = family{ipv6: true}
+		resolver.stack[strings.ToLower(st.DualStack)] = family{ipv4: true, ipv6: true}
+	}
+	if keys := setting.App.Resolver.DNSSEC.Keys; len(keys) > 0 {
+		s, err := loadSigner(resolver.domain, keys)
+		if err != nil {
+			return nil, fmt.Errorf("error loading DNSSEC keys: %w", err)
+		}
+		// only the signatures of the static zone are cached
+		s.cacheable = func(name string) bool {
+			_, ok := resolver.zone.Load().records[name]
+			return ok
+		}
+		resolver.signer = s
+	}
+	if setting.App.Resolver.GeoDNS.Enabled() && cfg.Geo == nil {
+		return nil, fmt.Errorf("geodns requires the geo databases")
+	}
+	resolver.geo = newGeoDNS(resolver.domain, cfg.Geo, ipv4, ipv6)
+	if err := resolver.loadZone(); err != nil {
+		return nil, err
 	}
 	resolver.handler.HandleFunc(resolver.domain, resolver.resolve)
 	resolver.handler.HandleFunc(".", resolver.blackHole)
 
-	return resolver
+	return resolver, nil
 }
 
-func (rsv *Resolver) Handler() *dns.ServeMux {
-	return rsv.handler
+// Reload reads the zone file again, the current zone is kept if the new one
+// cannot be loaded. The secondaries are notified of the new zone.
+func (rsv *Resolver) Reload() {
+	if err := rsv.loadZone(); err != nil {
+		log.Printf("Error reloading zone %s: %s", rsv.domain, err)
+		return
+	}
+	log.Printf("Zone %s has been reloaded", rsv.domain)
+	rsv.notify()
 }
 
+func (rsv *Resolver) loadZone() error {
+	z, err := loadZone(rsv.domain, setting.App.Resolver.ZoneFile, setting.App.Resolver.ResourceRecords)
+	if err != nil {
+		return fmt.Errorf("error loading zone %s: %w", rsv.domain, err)
+	}
+	if rsv.xfr != nil && z.soa == nil {
+		return fmt.Errorf("error loading zone %s: zone transfers require a SOA record", rsv.domain)
+	}
+	if rsv.signer != nil {
+		for _, key := range rsv.signer.dnskeys() {
+			if err := z.add(key); err != nil {
+				return err
+			}
+		}
+	}
+	rsv.zone.Store(z)
+
+	return nil
+}
+
+func (rsv *Resolver) Handler() dns.Handler {
+	return rsv
+}
+
+// Synthesized reports whether name, in lowercase, is answered for a discovery
+// token rather than from the zone: the token, probe and DNSSEC validation test
+// names, and the stack test names prefixed by a token
+func (rsv *Resolver) Synthesized(name string) bool {
+	rel, found := strings.CutSuffix(name, "."+rsv.domain)
+	if !found {
+		return false
+	}
+	probe, _ := rsv.probeToken(name)
+	token, _, _ := strings.Cut(strings.Split(rel, ".")[0], "-")
+
+	return probe != "" || rsv.bogusToken(name) != "" || rsv.tokens.Valid(token)
+}
+
+// ServeDNS rejects the messages that are not a standard query for a single
+// question of class IN, or of class CHAOS for the identification names, before
+// handing them to the name handlers
+func (rsv *Resolver) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	rcode := dns.RcodeSuccess
+	switch {
+	case r.Response || len(r.Question) != 1:
+		rcode = dns.RcodeFormatError
+	case r.Opcode != dns.OpcodeQuery:
+		rcode = dns.RcodeNotImplemented
+	case r.Question[0].Qclass == dns.ClassCHAOS:
+		rsv.chaos(w, r)
+		return
+	case r.Question[0].Qclass != dns.ClassINET:
+		rcode = dns.RcodeRefused
+	}
+	if rcode == dns.RcodeSuccess {
+		if t := r.Question[0].Qtype; t == dns.TypeAXFR || t == dns.TypeIXFR {
+			rsv.transfer(w, r)
+			return
+		}
+		rsv.handler.ServeDNS(w, r)
+		return
+	}
+
+	msg := new(dns.Msg)
+	msg.SetRcode(r, rcode)
+	msg.Answer, msg.Ns, msg.Extra = nil, nil, nil
+	rsv.reply(w, r, msg)
+
+	q := dns.Question{}
+	if len(r.Question) > 0 {
+		q = r.Question[0]
+	}
+	logger(w, q, msg.Rcode)
+	metrics.RecordDNSQuery(dns.TypeToString[q.Qtype], dns.RcodeToString[msg.Rcode])
+}
+
+// blackHole refuses the names out of the zone, the server is not a recursive
+// resolver
 func (rsv *Resolver) blackHole(w dns.ResponseWriter, r *dns.Msg) {
 	msg := startReply(r)
+	msg.Authoritative = false
 	msg.SetRcode(r, dns.RcodeRefused)
-	w.WriteMsg(msg)
+	rsv.reply(w, r, msg)
 	logger(w, r.Question[0], msg.Rcode)
 	metrics.RecordDNSQuery(dns.TypeToString[r.Question[0].Qtype], dns.RcodeToString[msg.Rcode])
 }
@@ -66,73 +232,276 @@ func (rsv *Resolver) blackHole(w dns.ResponseWriter, r *dns.Msg) {
 func (rsv *Resolver) resolve(w dns.ResponseWriter, r *dns.Msg) {
 	msg := startReply(r)
 	q := r.Question[0]
-	ip, _, _ := net.SplitHostPort(w.RemoteAddr().String())
-
-	for _, res := range rsv.rr {
-		t := strings.Split(res, " ")[2]
-		if q.Qtype == dns.StringToType[t] {
-			brr, err := buildRR(rsv.domain + " " + res)
-			if err != nil {
-				msg.SetRcode(r, dns.RcodeServerFailure)
-				logger(w, q, msg.Rcode, err.Error())
-			} else {
-				msg.Answer = append(msg.Answer, brr)
-				logger(w, q, msg.Rcode)
-			}
-			w.WriteMsg(msg)
-			metrics.RecordDNSQuery(dns.TypeToString[q.Qtype], dns.RcodeToString[msg.Rcode])
-			return
-		}
-	}
 
 	lowerName := strings.ToLower(q.Name) // lowercase because of dns-0x20
 	subDomain := strings.Split(lowerName, ".")[0]
+	probe, token := rsv.probeToken(lowerName)
+	var observe func(*dns.Msg)
 	switch {
-	case uuid.IsValid(subDomain):
+	case rsv.isStackName(lowerName):
+		msg.SetRcode(r, rsv.getStackIP(q, msg, lowerName))
+	case rsv.isWhoami(lowerName):
+		msg.SetRcode(r, rsv.whoami(w, r, msg))
+	case rsv.signer != nil && rsv.bogusToken(lowerName) != "":
 		msg.SetRcode(r, rsv.getIP(q, msg))
-		rsv.store.Add(subDomain, ip, cache.DefaultExpiration)
-	case lowerName == rsv.domain:
+		observe = func(*dns.Msg) { rsv.recordBogus(w, rsv.bogusToken(lowerName)) }
+	case probe != "":
+		observe = rsv.probe(w, r, msg, probe, token)
+	case rsv.isV6NSHost(lowerName):
+		rsv.appendIPs(q, msg, family{ipv6: true})
+	case rsv.tokens.Valid(subDomain):
 		msg.SetRcode(r, rsv.getIP(q, msg))
+		query := newDNSQuery(w, r)
+		observe = func(*dns.Msg) { rsv.record(subDomain, query, q.Qtype) }
+	case rsv.isACMEChallenge(lowerName):
+		rsv.acmeTXT(q, msg, lowerName)
+	case rsv.isDynHost(lowerName):
+		rsv.dynIPs(q, msg, lowerName)
+	case rsv.geo.answers(q):
+		rsv.geoIPs(w, r, msg)
+	case lowerName == rsv.domain && rsv.appendIPs(q, msg, family{ipv4: true, ipv6: true}):
 	default:
-		msg.SetRcode(r, dns.RcodeRefused)
+		rsv.lookup(r, msg)
 	}
 
-	w.WriteMsg(msg)
+	if msg.Rcode == dns.RcodeSuccess && msg.Authoritative && !msg.Truncated {
+		switch {
+		case q.Qtype == dns.TypeANY:
+			msg.Answer, msg.Ns = []dns.RR{minimalAny(q)}, nil
+		case len(msg.Answer) == 0:
+			msg.Ns = rsv.zone.Load().negative()
+		}
+	}
+	rsv.secure(w, r, msg)
+
+	// the store is only written once the reply is sent, not to delay it
+	rsv.reply(w, r, msg)
+	if observe != nil {
+		observe(msg)
+	}
 	logger(w, q, msg.Rcode)
 	metrics.RecordDNSQuery(dns.TypeToString[q.Qtype], dns.RcodeToString[msg.Rcode])
 }
 
+// lookup answers the query from the static zone
+func (rsv *Resolver) lookup(r *dns.Msg, msg *dns.Msg) {
+	res := rsv.zone.Load().lookup(r.Question[0].Name, r.Question[0].Qtype)
+	// GeoDNS names exist even if they are not in the zone
+	if res.rcode == dns.RcodeNameError && rsv.geo.isName(r.Question[0].Name) {
+		res = lookupResult{rcode: dns.RcodeSuccess}
+	}
+	msg.SetRcode(r, res.rcode)
+	msg.Authoritative = !res.delegation
+	msg.Answer = append(msg.Answer, res.answer...)
+	msg.Ns = append(msg.Ns, res.ns...)
+	msg.Extra = append(msg.Extra, res.extra...)
+	if res.delegation {
+		rsv.secureDelegation(r, msg, res.ns)
+	}
+}
+
+// getIP answers with the addresses of the server, the name has no data if
+// there are no addresses of the requested family
 func (rsv *Resolver) getIP(question dns.Question, msg *dns.Msg) int {
-	if question.Qtype == dns.TypeA && len(rsv.ipv4) > 0 {
-		for _, ip := range rsv.ipv4 {
+	rsv.appendIPs(question, msg, family{ipv4: true, ipv6: true})
+
+	return dns.RcodeSuccess
+}
+
+// minimalAny is the answer to ANY queries for existing names, a synthesized
+// HINFO record as described in RFC 8482, section 4.2
+func minimalAny(q dns.Question) dns.RR {
+	return &dns.HINFO{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: anyTTL},
+		Cpu: "RFC8482",
+	}
+}
+
+// isStackName reports whether name is one of the stack test hostnames, either
+// bare (v4.<domain>) or prefixed by a token (<token>-v4.<domain>), which the
+// certificate of *.<domain> covers
+func (rsv *Resolver) isStackName(name string) bool {
+	_, ok := rsv.stackFamily(name)
+	return ok
+}
+
+func (rsv *Resolver) stackFamily(name string) (family, bool) {
+	rel, found := strings.CutSuffix(name, "."+rsv.domain)
+	if !found || strings.Contains(rel, ".") {
+		return family{}, false
+	}
+	if token, label, found := strings.Cut(rel, "-"); found && rsv.tokens.Valid(token) {
+		rel = label
+	}
+	f, ok := rsv.stack[rel]
+
+	return f, ok
+}
+
+// getStackIP answers with the addresses of the family the stack test name is
+// bound to. Asking for the other family is not an error, the name just has no
+// data of that type.
+func (rsv *Resolver) getStackIP(question dns.Question, msg *dns.Msg, name string) int {
+	f, _ := rsv.stackFamily(name)
+	rsv.appendIPs(question, msg, f)
+
+	return dns.RcodeSuccess
+}
+
+func (rsv *Resolver) appendIPs(question dns.Question, msg *dns.Msg, f family) bool {
+	var ipv4, ipv6 []net.IP
+	if f.ipv4 {
+		ipv4 = rsv.ipv4
+	}
+	if f.ipv6 {
+		ipv6 = rsv.ipv6
+	}
+
+	return appendAddresses(question, msg, ipv4, ipv6)
+}
+
+// appendAddresses answers with the addresses of the requested family, it
+// returns false if there are none
+func appendAddresses(question dns.Question, msg *dns.Msg, ipv4 []net.IP, ipv6 []net.IP) bool {
+	if question.Qtype == dns.TypeA && len(ipv4) > 0 {
+		for _, ip := range ipv4 {
 			msg.Answer = append(msg.Answer, &dns.A{
 				Hdr: setHdr(question),
 				A:   ip,
 			})
 		}
-		return dns.RcodeSuccess
+		return true
 	}
 
-	if question.Qtype == dns.TypeAAAA && len(rsv.ipv6) > 0 {
-		for _, ip := range rsv.ipv6 {
+	if question.Qtype == dns.TypeAAAA && len(ipv6) > 0 {
+		for _, ip := range ipv6 {
 			msg.Answer = append(msg.Answer, &dns.AAAA{
 				Hdr:  setHdr(question),
 				AAAA: ip,
 			})
 		}
-		return dns.RcodeSuccess
+		return true
+	}
+
+	return false
+}
+
+// reply adds the EDNS0 OPT record to msg when the query has one and truncates
+// msg to the buffer size the client advertised before writing it. Over TCP the
+// size is only limited by the DNS message size.
+func (rsv *Resolver) reply(w dns.ResponseWriter, r *dns.Msg, msg *dns.Msg) {
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil {
+		if opt.Version() != 0 {
+			msg.Answer, msg.Ns, msg.Extra = nil, nil, nil
+			msg.Rcode = dns.RcodeBadVers
+		}
+		size = min(max(int(opt.UDPSize()), dns.MinMsgSize), rsv.udpSize)
+		msg.SetEdns0(uint16(rsv.udpSize), opt.Do())
+		// the answer is the same for every client subnet (scope /0), but for
+		// GeoDNS answers, which depend on the whole subnet
+		if ecs := clientSubnet(opt); ecs != nil {
+			scope := uint8(0)
+			if len(r.Question) > 0 && rsv.geo.answers(r.Question[0]) {
+				scope = ecs.SourceNetmask
+			}
+			msg.IsEdns0().Option = append(msg.IsEdns0().Option, &dns.EDNS0_SUBNET{
+				Code:          dns.EDNS0SUBNET,
+				Family:        ecs.Family,
+				SourceNetmask: ecs.SourceNetmask,
+				SourceScope:   scope,
+				Address:       ecs.Address,
+			})
+		}
+		if nsid := rsv.nsid(opt); nsid != nil {
+			msg.IsEdns0().Option = append(msg.IsEdns0().Option, nsid)
+		}
+	}
+	if transport(w) != TransportUDP {
+		size = dns.MaxMsgSize
 	}
 
-	return dns.RcodeRefused
+	msg.Truncate(size)
+	w.WriteMsg(msg)
 }
 
-func buildRR(rrs string) (dns.RR, error) {
-	rr, err := dns.NewRR(rrs)
+// record adds the query to the discovery result of token
+func (rsv *Resolver) record(token string, query models.DNSQuery, qtype uint16) {
+	discovery := models.DNSDiscovery{}
+	err := rsv.store.Update(token, query.IP, &discovery, func() {
+		discovery = discovery.Add(query, dns.TypeToString[qtype])
+	})
 	if err != nil {
-		return nil, err
+		log.Printf("Error recording discovery %s: %s", token, err)
+	}
+}
+
+// recordBogus flags that the bogus name of token was queried
+func (rsv *Resolver) recordBogus(w dns.ResponseWriter, token string) {
+	ip, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+	if err := rsv.store.Set(models.BogusQueryKey(token), ip, true); err != nil {
+		log.Printf("Error recording DNSSEC validation test %s: %s", token, err)
+	}
+}
+
+// newDNSQuery collects the properties of the query the resolver revealed
+func newDNSQuery(w dns.ResponseWriter, r *dns.Msg) models.DNSQuery {
+	ip, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+	name := r.Question[0].Name
+	query := models.DNSQuery{
+		IP:        ip,
+		Transport: transport(w),
+		Case0x20:  name != strings.ToLower(name),
+		Time:      time.Now().UTC(),
+	}
+
+	opt := r.IsEdns0()
+	if opt == nil {
+		return query
+	}
+	if cw, ok := w.(interface{ ValidCookie() bool }); ok {
+		query.ValidCookie = cw.ValidCookie()
+	}
+	query.EDNS = true
+	query.UDPSize = opt.UDPSize()
+	query.DNSSECOK = opt.Do()
+	if ecs := clientSubnet(opt); ecs != nil {
+		query.ClientSubnet = fmt.Sprintf("%s/%d", ecs.Address, ecs.SourceNetmask)
+	}
+	for _, o := range opt.Option {
+		if c, ok := o.(*dns.EDNS0_COOKIE); ok && len(c.Cookie) >= 16 {
+			query.ClientCookie = c.Cookie[:16]
+			query.ServerCookie = c.Cookie[16:]
+		}
+	}
+
+	return query
+}
+
+func clientSubnet(opt *dns.OPT) *dns.EDNS0_SUBNET {
+	for _, o := range opt.Option {
+		if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return ecs
+		}
+	}
+
+	return nil
+}
+
+// transport returns the transport the query was received over
+func transport(w dns.ResponseWriter) string {
+	// the writers that wrap another one tell its transport, if any
+	if t, ok := w.(interface{ Transport() string }); ok && t.Transport() != "" {
+		return t.Transport()
+	}
+	if cs, ok := w.(dns.ConnectionStater); ok && cs.ConnectionState() != nil {
+		return TransportTLS
+	}
+	if w.RemoteAddr().Network() == "tcp" {
+		return TransportTCP
 	}
 
-	return rr, nil
+	return TransportUDP
 }
 
 func setHdr(q dns.Question) dns.RR_Header {
@@ -0,0 +1,413 @@
+package resolver
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dcarrillo/whatismyip/internal/setting"
+	"github.com/dcarrillo/whatismyip/internal/validator"
+	"github.com/dcarrillo/whatismyip/models"
+	"github.com/dcarrillo/whatismyip/service"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const domain = "dns.example.com"
+
+var testTokens, _ = validator.NewTokens([]byte("test-secret-test-secret"), time.Hour)
+
+type testWriter struct {
+	dns.ResponseWriter
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *testWriter) RemoteAddr() net.Addr        { return w.remote }
+func (w *testWriter) LocalAddr() net.Addr         { return w.remote }
+func (w *testWriter) WriteMsg(msg *dns.Msg) error { w.msg = msg; return nil }
+
+type cookieWriter struct {
+	testWriter
+}
+
+func (w *cookieWriter) ValidCookie() bool { return true }
+
+func newTestResolver(t *testing.T) *Resolver {
+	t.Helper()
+	saved := setting.App.Resolver
+	t.Cleanup(func() { setting.App.Resolver = saved })
+
+	setting.App.Resolver.Domain = domain
+	setting.App.Resolver.Listen.UDPSize = 1232
+	setting.App.Resolver.Ipv4 = []string{"127.0.0.2"}
+	setting.App.Resolver.Ipv6 = []string{"aaa:aaa:aaa:aaaa::1"}
+	setting.App.Resolver.ResourceRecords = []string{
+		"1800 IN SOA xns.example.com. hostmaster.example.com. 1 10000 2400 604800 1800",
+		"3600 IN NS xns.example.com.",
+	}
+	setting.App.Resolver.StackTest.Ipv4 = "v4"
+	setting.App.Resolver.StackTest.Ipv6 = "v6"
+	setting.App.Resolver.StackTest.DualStack = "ds"
+	setting.App.Resolver.Whoami = []string{"whoami", "o-o.myaddr"}
+
+	rsv, err := Setup(Config{Store: service.NewMemoryDiscoveryStore(time.Minute, 1000, 0), Tokens: testTokens})
+	require.NoError(t, err)
+
+	return rsv
+}
+
+// discovery returns the discovery result of token
+func discovery(t *testing.T, rsv *Resolver, token string) models.DNSDiscovery {
+	t.Helper()
+	d := models.DNSDiscovery{}
+	found, err := rsv.store.Get(token, &d)
+	require.NoError(t, err)
+	require.True(t, found)
+
+	return d
+}
+
+func query(rsv *Resolver, network string, r *dns.Msg) *dns.Msg {
+	var remote net.Addr = &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}
+	if network == "tcp" {
+		remote = &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}
+	}
+	w := &testWriter{remote: remote}
+	rsv.Handler().ServeDNS(w, r)
+
+	return w.msg
+}
+
+func TestStackTestNames(t *testing.T) {
+	rsv := newTestResolver(t)
+	token := testTokens.New("192.0.2.1")
+
+	tests := []struct {
+		name    string
+		qtype   uint16
+		answers int
+	}{
+		{name: "v4." + domain, qtype: dns.TypeA, answers: 1},
+		{name: "v4." + domain, qtype: dns.TypeAAAA, answers: 0},
+		{name: token + "-v6." + domain, qtype: dns.TypeAAAA, answers: 1},
+		{name: token + "-V6." + domain, qtype: dns.TypeA, answers: 0},
+		{name: "ds." + domain, qtype: dns.TypeA, answers: 1},
+		{name: "ds." + domain, qtype: dns.TypeAAAA, answers: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name+"/"+dns.TypeToString[tt.qtype], func(t *testing.T) {
+			msg := query(rsv, "udp", new(dns.Msg).SetQuestion(dns.Fqdn(tt.name), tt.qtype))
+			require.NotNil(t, msg)
+			assert.Equal(t, dns.RcodeSuccess, msg.Rcode)
+			assert.Len(t, msg.Answer, tt.answers)
+		})
+	}
+}
+
+func TestSynthesized(t *testing.T) {
+	rsv := newTestResolver(t)
+	token := testTokens.New("192.0.2.1")
+
+	for _, name := range []string{token, "tc-" + token, "a.b.qm-" + token, token + "-v4"} {
+		assert.True(t, rsv.Synthesized(name+"."+domain+"."), name)
+	}
+	for _, name := range []string{"v4." + domain, "whoami." + domain, "www." + domain, domain, token + ".example.org"} {
+		assert.False(t, rsv.Synthesized(name+"."), name)
+	}
+}
+
+func TestEDNS(t *testing.T) {
+	rsv := newTestResolver(t)
+
+	t.Run("no OPT record without EDNS", func(t *testing.T) {
+		msg := query(rsv, "udp", new(dns.Msg).SetQuestion(domain+".", dns.TypeA))
+		assert.Nil(t, msg.IsEdns0())
+	})
+
+	t.Run("OPT record with the server buffer size", func(t *testing.T) {
+		r := new(dns.Msg).SetQuestion(domain+".", dns.TypeA)
+		r.SetEdns0(4096, true)
+		msg := query(rsv, "udp", r)
+		require.NotNil(t, msg.IsEdns0())
+		assert.Equal(t, uint16(1232), msg.IsEdns0().UDPSize())
+		assert.True(t, msg.IsEdns0().Do())
+	})
+
+	t.Run("BADVERS for unknown EDNS versions", func(t *testing.T) {
+		r := new(dns.Msg).SetQuestion(domain+".", dns.TypeA)
+		r.SetEdns0(4096, false)
+		r.IsEdns0().SetVersion(1)
+		msg := query(rsv, "udp", r)
+		assert.Equal(t, dns.RcodeBadVers, msg.Rcode)
+		assert.Empty(t, msg.Answer)
+	})
+}
+
+func TestTruncation(t *testing.T) {
+	rsv := newTestResolver(t)
+	for i := range 40 {
+		rsv.ipv6 = append(rsv.ipv6, net.ParseIP("2001:db8::"+strings.Repeat("1", 1+i%4)))
+	}
+
+	r := new(dns.Msg).SetQuestion(domain+".", dns.TypeAAAA)
+	msg := query(rsv, "udp", r)
+	assert.True(t, msg.Truncated)
+	assert.LessOrEqual(t, msg.Len(), dns.MinMsgSize)
+
+	msg = query(rsv, "tcp", r)
+	assert.False(t, msg.Truncated)
+	assert.Len(t, msg.Answer, 41)
+}
+
+func TestDiscoveryQuery(t *testing.T) {
+	rsv := newTestResolver(t)
+
+	t.Run("plain query over tcp", func(t *testing.T) {
+		u := testTokens.New("198.51.100.1")
+		msg := query(rsv, "tcp", new(dns.Msg).SetQuestion(u+"."+domain+".", dns.TypeA))
+		require.Equal(t, dns.RcodeSuccess, msg.Rcode)
+
+		q := discovery(t, rsv, u).Resolvers[0]
+		assert.Equal(t, "192.0.2.1", q.IP)
+		assert.Equal(t, TransportTCP, q.Transport)
+		assert.False(t, q.EDNS)
+		assert.False(t, q.Case0x20)
+		assert.False(t, q.Time.IsZero())
+	})
+
+	t.Run("query with EDNS options and 0x20", func(t *testing.T) {
+		u := testTokens.New("198.51.100.1")
+		r := new(dns.Msg).SetQuestion(strings.ToUpper(u)+".dNs.ExAmPlE.cOm.", dns.TypeA)
+		r.SetEdns0(4096, true)
+		opt := r.IsEdns0()
+		opt.Option = append(opt.Option,
+			&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("198.51.100.0").To4()},
+			&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0011223344556677"},
+		)
+		msg := query(rsv, "udp", r)
+		require.Equal(t, dns.RcodeSuccess, msg.Rcode)
+		require.NotNil(t, msg.IsEdns0())
+		assert.Len(t, msg.IsEdns0().Option, 1, "the client subnet is echoed")
+
+		q := discovery(t, rsv, u).Resolvers[0]
+		assert.Equal(t, TransportUDP, q.Transport)
+		assert.True(t, q.EDNS)
+		assert.Equal(t, uint16(4096), q.UDPSize)
+		assert.True(t, q.DNSSECOK)
+		assert.Equal(t, "198.51.100.0/24", q.ClientSubnet)
+		assert.Equal(t, "0011223344556677", q.ClientCookie)
+		assert.False(t, q.ValidCookie)
+		assert.True(t, q.Case0x20)
+	})
+
+	t.Run("query with a valid server cookie", func(t *testing.T) {
+		u := testTokens.New("198.51.100.1")
+		r := new(dns.Msg).SetQuestion(u+"."+domain+".", dns.TypeA)
+		r.SetEdns0(1232, false)
+		w := &cookieWriter{testWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}}
+		rsv.Handler().ServeDNS(w, r)
+
+		assert.True(t, discovery(t, rsv, u).Resolvers[0].ValidCookie)
+	})
+
+	t.Run("tokens without a valid signature are not recorded", func(t *testing.T) {
+		forged, _ := validator.NewTokens([]byte("another-secret-secret"), time.Hour)
+		for _, u := range []string{"3b241101-e2bb-4255-8caf-4136c566a964", forged.New("198.51.100.1")} {
+			msg := query(rsv, "udp", new(dns.Msg).SetQuestion(u+"."+domain+".", dns.TypeA))
+			assert.Equal(t, dns.RcodeNameError, msg.Rcode)
+			found, err := rsv.store.Get(u, &models.DNSDiscovery{})
+			require.NoError(t, err)
+			assert.False(t, found)
+		}
+	})
+}
+
+func TestDiscoveryMultipleResolvers(t *testing.T) {
+	rsv := newTestResolver(t)
+	u := testTokens.New("198.51.100.1")
+
+	for _, q := range []struct {
+		ip    string
+		qtype uint16
+	}{
+		{"192.0.2.1", dns.TypeA},
+		{"192.0.2.1", dns.TypeAAAA},
+		{"192.0.2.2", dns.TypeA},
+		{"192.0.2.1", dns.TypeA},
+	} {
+		w := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP(q.ip), Port: 5353}}
+		rsv.Handler().ServeDNS(w, new(dns.Msg).SetQuestion(u+"."+domain+".", q.qtype))
+		require.Equal(t, dns.RcodeSuccess, w.msg.Rcode)
+	}
+
+	resolvers := discovery(t, rsv, u).Resolvers
+	require.Len(t, resolvers, 2)
+	assert.Equal(t, "192.0.2.1", resolvers[0].IP)
+	assert.Equal(t, 3, resolvers[0].Hits)
+	assert.Equal(t, []string{"A", "AAAA"}, resolvers[0].QueryTypes)
+	assert.Equal(t, "192.0.2.2", resolvers[1].IP)
+	assert.Equal(t, 1, resolvers[1].Hits)
+}
+
+// replyStore checks that the reply is written before the store
+type replyStore struct {
+	service.DiscoveryStore
+	t *testing.T
+	w *testWriter
+}
+
+func (s *replyStore) Set(key string, owner string, v any) error {
+	assert.NotNil(s.t, s.w.msg, "%s is written before the reply", key)
+	return s.DiscoveryStore.Set(key, owner, v)
+}
+
+func (s *replyStore) Update(key string, owner string, v any, update func()) error {
+	assert.NotNil(s.t, s.w.msg, "%s is written before the reply", key)
+	return s.DiscoveryStore.Update(key, owner, v, update)
+}
+
+func TestRecordAfterReply(t *testing.T) {
+	rsv := newTestResolver(t)
+	w := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+	rsv.store = &replyStore{DiscoveryStore: rsv.store, t: t, w: w}
+
+	u := testTokens.New("198.51.100.1")
+	for _, name := range []string{u, "tc-" + u, "a.b.qm-" + u} {
+		w.msg = nil
+		rsv.Handler().ServeDNS(w, new(dns.Msg).SetQuestion(name+"."+domain+".", dns.TypeA))
+		require.NotNil(t, w.msg)
+	}
+	assert.Len(t, discovery(t, rsv, u).Resolvers, 1)
+	found, err := rsv.store.Get(models.ProbesKey(u), &models.DNSProbes{})
+	require.NoError(t, err)
+	assert.True(t, found)
+}
+
+func TestWhoami(t *testing.T) {
+	rsv := newTestResolver(t)
+
+	tests := []struct {
+		name   string
+		remote string
+		qtype  uint16
+		ecs    bool
+		want   []string
+	}{
+		{name: "whoami", remote: "192.0.2.1", qtype: dns.TypeTXT, want: []string{`"192.0.2.1"`}},
+		{name: "o-o.myaddr", remote: "192.0.2.1", qtype: dns.TypeTXT, ecs: true, want: []string{`"192.0.2.1"`, `"edns0-client-subnet 198.51.100.0/24"`}},
+		{name: "WhoAmI", remote: "192.0.2.1", qtype: dns.TypeA, want: []string{"192.0.2.1"}},
+		{name: "whoami", remote: "192.0.2.1", qtype: dns.TypeAAAA},
+		{name: "whoami", remote: "2001:db8::1", qtype: dns.TypeAAAA, want: []string{"2001:db8::1"}},
+		{name: "whoami", remote: "2001:db8::1", qtype: dns.TypeA},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name+"/"+tt.remote+"/"+dns.TypeToString[tt.qtype], func(t *testing.T) {
+			r := new(dns.Msg).SetQuestion(tt.name+"."+domain+".", tt.qtype)
+			if tt.ecs {
+				r.SetEdns0(1232, false)
+				r.IsEdns0().Option = append(r.IsEdns0().Option, &dns.EDNS0_SUBNET{
+					Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("198.51.100.0").To4(),
+				})
+			}
+			w := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP(tt.remote), Port: 5353}}
+			rsv.Handler().ServeDNS(w, r)
+
+			require.Equal(t, dns.RcodeSuccess, w.msg.Rcode)
+			var got []string
+			for _, rr := range w.msg.Answer {
+				assert.Equal(t, uint32(0), rr.Header().Ttl)
+				got = append(got, strings.TrimPrefix(rr.String(), rr.Header().String()))
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestMalformedQueries(t *testing.T) {
+	rsv := newTestResolver(t)
+
+	notify := new(dns.Msg).SetNotify(domain + ".")
+	response := new(dns.Msg).SetQuestion(domain+".", dns.TypeA)
+	response.Response = true
+	chaos := new(dns.Msg).SetQuestion("version.bind.", dns.TypeTXT)
+	chaos.Question[0].Qclass = dns.ClassCHAOS
+	multiple := new(dns.Msg).SetQuestion(domain+".", dns.TypeA)
+	multiple.Question = append(multiple.Question, multiple.Question[0])
+
+	tests := []struct {
+		name  string
+		r     *dns.Msg
+		rcode int
+	}{
+		{name: "empty question", r: new(dns.Msg), rcode: dns.RcodeFormatError},
+		{name: "multiple questions", r: multiple, rcode: dns.RcodeFormatError},
+		{name: "response", r: response, rcode: dns.RcodeFormatError},
+		{name: "opcode", r: notify, rcode: dns.RcodeNotImplemented},
+		{name: "class", r: chaos, rcode: dns.RcodeRefused},
+		{name: "zone transfer", r: new(dns.Msg).SetAxfr(domain + "."), rcode: dns.RcodeRefused},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := query(rsv, "udp", tt.r)
+			require.NotNil(t, msg)
+			assert.Equal(t, tt.rcode, msg.Rcode)
+			assert.True(t, msg.Response)
+			assert.False(t, msg.Authoritative)
+			assert.Empty(t, msg.Answer)
+		})
+	}
+}
+
+func TestAuthoritativeResponses(t *testing.T) {
+	rsv := newTestResolver(t)
+	u := testTokens.New("198.51.100.1")
+
+	tests := []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		aa     bool
+		answer uint16
+		ns     uint16
+	}{
+		{name: domain, qtype: dns.TypeA, rcode: dns.RcodeSuccess, aa: true, answer: dns.TypeA},
+		{name: domain, qtype: dns.TypeSOA, rcode: dns.RcodeSuccess, aa: true, answer: dns.TypeSOA},
+		{name: domain, qtype: dns.TypeMX, rcode: dns.RcodeSuccess, aa: true, ns: dns.TypeSOA},
+		{name: domain, qtype: dns.TypeANY, rcode: dns.RcodeSuccess, aa: true, answer: dns.TypeHINFO},
+		{name: u + "." + domain, qtype: dns.TypeTXT, rcode: dns.RcodeSuccess, aa: true, ns: dns.TypeSOA},
+		{name: u + "." + domain, qtype: dns.TypeANY, rcode: dns.RcodeSuccess, aa: true, answer: dns.TypeHINFO},
+		{name: "v4." + domain, qtype: dns.TypeAAAA, rcode: dns.RcodeSuccess, aa: true, ns: dns.TypeSOA},
+		{name: "whoami." + domain, qtype: dns.TypeMX, rcode: dns.RcodeSuccess, aa: true, ns: dns.TypeSOA},
+		{name: "missing." + domain, qtype: dns.TypeA, rcode: dns.RcodeNameError, aa: true, ns: dns.TypeSOA},
+		{name: "missing." + domain, qtype: dns.TypeANY, rcode: dns.RcodeNameError, aa: true, ns: dns.TypeSOA},
+		{name: "example.org", qtype: dns.TypeA, rcode: dns.RcodeRefused},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name+"/"+dns.TypeToString[tt.qtype], func(t *testing.T) {
+			msg := query(rsv, "udp", new(dns.Msg).SetQuestion(tt.name+".", tt.qtype))
+			require.NotNil(t, msg)
+			assert.Equal(t, tt.rcode, msg.Rcode)
+			assert.Equal(t, tt.aa, msg.Authoritative)
+			assert.False(t, msg.Truncated)
+			if tt.answer == 0 {
+				assert.Empty(t, msg.Answer)
+			} else {
+				require.NotEmpty(t, msg.Answer)
+				assert.Equal(t, tt.answer, msg.Answer[0].Header().Rrtype)
+			}
+			if tt.ns == 0 {
+				assert.Empty(t, msg.Ns)
+			} else {
+				require.Len(t, msg.Ns, 1)
+				assert.Equal(t, tt.ns, msg.Ns[0].Header().Rrtype)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package resolver
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dcarrillo/whatismyip/internal/metrics"
+	"github.com/dcarrillo/whatismyip/internal/setting"
+	"github.com/miekg/dns"
+)
+
+const (
+	// xfrChunk is the number of records sent in every message of a transfer
+	xfrChunk = 100
+	// notifyAttempts and notifyTimeout bound the delivery of a NOTIFY message
+	notifyAttempts = 3
+	notifyTimeout  = 2 * time.Second
+	// tsigFudge is the time skew allowed for signed NOTIFY messages
+	tsigFudge = 300
+)
+
+// transfer holds who may transfer the static zone and which secondaries are
+// notified of its changes
+type transfer struct {
+	allowFrom []*net.IPNet
+	// keys maps the TSIG key names to their algorithm
+	keys   map[string]string
+	notify []string
+	// notifyKey signs the NOTIFY messages, the first configured key
+	notifyKey *tsigKey
+}
+
+type tsigKey struct {
+	name      string
+	algorithm string
+	secret    string
+}
+
+// newTransfer returns the zone transfer configuration, nil if transfers are
+// not enabled
+func newTransfer() *transfer {
+	conf := setting.App.Resolver.Transfer
+	if !conf.Enabled() {
+		return nil
+	}
+
+	x := &transfer{keys: map[string]string{}}
+	for _, cidr := range conf.AllowFrom {
+		if _, network, err := net.ParseCIDR(cidr); err == nil {
+			x.allowFrom = append(x.allowFrom, network)
+		}
+	}
+	for _, k := range conf.TSIG {
+		key := tsigKey{name: dns.CanonicalName(k.Name), algorithm: dns.CanonicalName(k.Algorithm), secret: k.Secret}
+		x.keys[key.name] = key.algorithm
+		if x.notifyKey == nil {
+			x.notifyKey = &key
+		}
+	}
+	for _, addr := range conf.Notify {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "53")
+		}
+		x.notify = append(x.notify, addr)
+	}
+
+	return x
+}
+
+// authorize returns the rcode of a transfer request: the client must belong
+// to the allowed networks and sign the request with one of the TSIG keys, if
+// any is configured
+func (x *transfer) authorize(w dns.ResponseWriter, r *dns.Msg) int {
+	// the HTTP server does not verify TSIG, transfers are only served over the
+	// DNS transports
+	if x == nil || transport(w) == TransportHTTPS {
+		return dns.RcodeRefused
+	}
+	host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+	ip := net.ParseIP(host)
+	if !slices.ContainsFunc(x.allowFrom, func(n *net.IPNet) bool { return n.Contains(ip) }) {
+		return dns.RcodeRefused
+	}
+	if len(x.keys) == 0 {
+		return dns.RcodeSuccess
+	}
+
+	t := r.IsTsig()
+	if t == nil {
+		return dns.RcodeRefused
+	}
+	algorithm, ok := x.keys[strings.ToLower(t.Hdr.Name)]
+	if !ok || !strings.EqualFold(algorithm, t.Algorithm) || w.TsigStatus() != nil {
+		return dns.RcodeNotAuth
+	}
+
+	return dns.RcodeSuccess
+}
+
+// transfer answers AXFR (RFC 5936) and IXFR (RFC 1995) requests with the
+// static zone. Incremental transfers are not kept, an outdated secondary gets
+// the whole zone. The dynamic answers are only served by the primary.
+func (rsv *Resolver) transfer(w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	z := rsv.zone.Load()
+
+	rcode := rsv.xfr.authorize(w, r)
+	switch {
+	case rcode != dns.RcodeSuccess:
+	case strings.ToLower(q.Name) != rsv.domain:
+		rcode = dns.RcodeNotAuth
+	case q.Qtype == dns.TypeAXFR && transport(w) == TransportUDP:
+		rcode = dns.RcodeRefused
+	}
+	if rcode != dns.RcodeSuccess {
+		msg := new(dns.Msg)
+		msg.SetRcode(r, rcode)
+		rsv.reply(w, r, msg)
+		logger(w, q, rcode)
+		metrics.RecordDNSQuery(dns.TypeToString[q.Qtype], dns.RcodeToString[rcode])
+		return
+	}
+
+	// an up to date secondary, or an IXFR over UDP, gets the current SOA record
+	if q.Qtype == dns.TypeIXFR && (transport(w) == TransportUDP || upToDate(r, z.soa)) {
+		msg := startReply(r)
+		msg.Answer = []dns.RR{z.soa}
+		if t := r.IsTsig(); t != nil {
+			msg.SetTsig(t.Hdr.Name, t.Algorithm, t.Fudge, time.Now().Unix())
+		}
+		w.WriteMsg(msg)
+		logger(w, q, msg.Rcode)
+		metrics.RecordDNSQuery(dns.TypeToString[q.Qtype], dns.RcodeToString[msg.Rcode])
+		return
+	}
+
+	records := z.transfer()
+	ch := make(chan *dns.Envelope, (len(records)+xfrChunk-1)/xfrChunk)
+	for chunk := range slices.Chunk(records, xfrChunk) {
+		ch <- &dns.Envelope{RR: chunk}
+	}
+	close(ch)
+	if err := new(dns.Transfer).Out(w, r, ch); err != nil {
+		logger(w, q, dns.RcodeServerFailure, err.Error())
+		metrics.RecordDNSQuery(dns.TypeToString[q.Qtype], dns.RcodeToString[dns.RcodeServerFailure])
+		return
+	}
+	logger(w, q, dns.RcodeSuccess, fmt.Sprintf("serial %d, %d records", z.soa.Serial, len(records)))
+	metrics.RecordDNSQuery(dns.TypeToString[q.Qtype], dns.RcodeToString[dns.RcodeSuccess])
+}
+
+// upToDate reports whether the serial of the SOA record of an IXFR request is
+// not older than the serial of soa (RFC 1982 arithmetic)
+func upToDate(r *dns.Msg, soa *dns.SOA) bool {
+	for _, rr := range r.Ns {
+		if client, ok := rr.(*dns.SOA); ok {
+			return int32(client.Serial-soa.Serial) >= 0
+		}
+	}
+
+	return false
+}
+
+// notify sends a NOTIFY message (RFC 1996) to every secondary so that they
+// transfer the zone again, without waiting for the answers
+func (rsv *Resolver) notify() {
+	if rsv.xfr == nil {
+		return
+	}
+	soa := rsv.zone.Load().soa
+	for _, addr := range rsv.xfr.notify {
+		go rsv.xfr.sendNotify(rsv.domain, soa, addr)
+	}
+}
+
+func (x *transfer) sendNotify(zone string, soa *dns.SOA, addr string) {
+	m := new(dns.Msg).SetNotify(zone)
+	m.Answer = []dns.RR{soa}
+	c := &dns.Client{Timeout: notifyTimeout}
+	if x.notifyKey != nil {
+		m.SetTsig(x.notifyKey.name, x.notifyKey.algorithm, tsigFudge, time.Now().Unix())
+		c.TsigSecret = map[string]string{x.notifyKey.name: x.notifyKey.secret}
+	}
+
+	var err error
+	for range notifyAttempts {
+		var resp *dns.Msg
+		resp, _, err = c.Exchange(m, addr)
+		if err == nil && resp.Rcode != dns.RcodeSuccess {
+			err = fmt.Errorf("%s", dns.RcodeToString[resp.Rcode])
+		}
+		if err == nil {
+			log.Printf("Secondary %s notified of zone %s serial %d", addr, zone, soa.Serial)
+			return
+		}
+	}
+	log.Printf("Error notifying secondary %s of zone %s: %s", addr, zone, err)
+}
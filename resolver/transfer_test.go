@@ -0,0 +1,221 @@
+package resolver
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dcarrillo/whatismyip/internal/setting"
+	"github.com/dcarrillo/whatismyip/service"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	tsigName   = "xfr.example.com."
+	tsigSecret = "c2VjcmV0LXNlY3JldC1zZWNyZXQ="
+)
+
+func newTestTransferResolver(t *testing.T, conf string) *Resolver {
+	t.Helper()
+	newTestResolver(t)
+	setting.App.Resolver.ResourceRecords = append(setting.App.Resolver.ResourceRecords, "3600 IN MX 10 mail.example.com.")
+	require.NoError(t, yaml.Unmarshal([]byte(conf), &setting.App.Resolver.Transfer))
+
+	rsv, err := Setup(Config{Store: service.NewMemoryDiscoveryStore(time.Minute, 1000, 0), Tokens: testTokens})
+	require.NoError(t, err)
+
+	return rsv
+}
+
+// serve starts handler on a local TCP and UDP port with the TSIG secrets, it
+// returns the address
+func serve(t *testing.T, handler dns.Handler, secrets map[string]string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	pc, err := net.ListenPacket("udp", l.Addr().String())
+	require.NoError(t, err)
+
+	for _, server := range []*dns.Server{
+		{Listener: l, Handler: handler, TsigSecret: secrets},
+		{PacketConn: pc, Handler: handler, TsigSecret: secrets},
+	} {
+		started := make(chan struct{})
+		server.NotifyStartedFunc = func() { close(started) }
+		go func() { _ = server.ActivateAndServe() }()
+		<-started
+		t.Cleanup(func() { _ = server.Shutdown() })
+	}
+
+	return l.Addr().String()
+}
+
+// axfr transfers the zone from addr, signed with secret if it is not empty
+func axfr(t *testing.T, addr string, r *dns.Msg, secret string) ([]dns.RR, error) {
+	t.Helper()
+	tr := new(dns.Transfer)
+	if secret != "" {
+		r.SetTsig(tsigName, dns.HmacSHA256, 300, time.Now().Unix())
+		tr.TsigSecret = map[string]string{tsigName: secret}
+	}
+	envelopes, err := tr.In(r, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var rrs []dns.RR
+	for e := range envelopes {
+		if e.Error != nil {
+			return nil, e.Error
+		}
+		rrs = append(rrs, e.RR...)
+	}
+
+	return rrs, nil
+}
+
+func TestTransfer(t *testing.T) {
+	rsv := newTestTransferResolver(t, "allow_from: [127.0.0.0/8]\n")
+	addr := serve(t, rsv, setting.App.Resolver.Transfer.TsigSecrets())
+
+	rrs, err := axfr(t, addr, new(dns.Msg).SetAxfr(domain+"."), "")
+	require.NoError(t, err)
+	require.Len(t, rrs, 4)
+	assert.Equal(t, dns.TypeSOA, rrs[0].Header().Rrtype)
+	assert.Equal(t, dns.TypeSOA, rrs[3].Header().Rrtype)
+	assert.ElementsMatch(t, []uint16{dns.TypeNS, dns.TypeMX}, []uint16{rrs[1].Header().Rrtype, rrs[2].Header().Rrtype})
+
+	t.Run("ixfr", func(t *testing.T) {
+		rrs, err := axfr(t, addr, new(dns.Msg).SetIxfr(domain+".", 0, "xns.example.com.", "hostmaster.example.com."), "")
+		require.NoError(t, err)
+		assert.Len(t, rrs, 4, "an outdated secondary gets the whole zone")
+
+		r := new(dns.Msg).SetIxfr(domain+".", 1, "xns.example.com.", "hostmaster.example.com.")
+		resp, _, err := (&dns.Client{Net: "tcp"}).Exchange(r, addr)
+		require.NoError(t, err)
+		require.Len(t, resp.Answer, 1, "an up to date secondary gets the SOA record")
+		assert.Equal(t, uint32(1), resp.Answer[0].(*dns.SOA).Serial)
+
+		r = new(dns.Msg).SetIxfr(domain+".", 0, "xns.example.com.", "hostmaster.example.com.")
+		resp, _, err = new(dns.Client).Exchange(r, addr)
+		require.NoError(t, err)
+		assert.Len(t, resp.Answer, 1, "the SOA record is the answer over UDP")
+	})
+
+	t.Run("refused", func(t *testing.T) {
+		resp, _, err := new(dns.Client).Exchange(new(dns.Msg).SetAxfr(domain+"."), addr)
+		require.NoError(t, err)
+		assert.Equal(t, dns.RcodeRefused, resp.Rcode, "AXFR over UDP")
+
+		resp, _, err = (&dns.Client{Net: "tcp"}).Exchange(new(dns.Msg).SetAxfr("www."+domain+"."), addr)
+		require.NoError(t, err)
+		assert.Equal(t, dns.RcodeNotAuth, resp.Rcode, "not the zone apex")
+
+		msg := query(rsv, "tcp", new(dns.Msg).SetAxfr(domain+"."))
+		assert.Equal(t, dns.RcodeRefused, msg.Rcode, "not an allowed network")
+	})
+}
+
+func TestTransferTSIG(t *testing.T) {
+	rsv := newTestTransferResolver(t, `
+allow_from: [127.0.0.0/8]
+tsig:
+  - name: xfr.example.com
+    algorithm: hmac-sha256
+    secret: `+tsigSecret+"\n")
+	addr := serve(t, rsv, setting.App.Resolver.Transfer.TsigSecrets())
+
+	rrs, err := axfr(t, addr, new(dns.Msg).SetAxfr(domain+"."), tsigSecret)
+	require.NoError(t, err)
+	assert.Len(t, rrs, 4)
+
+	resp, _, err := (&dns.Client{Net: "tcp"}).Exchange(new(dns.Msg).SetAxfr(domain+"."), addr)
+	require.NoError(t, err)
+	assert.Equal(t, dns.RcodeRefused, resp.Rcode, "unsigned request")
+
+	r := new(dns.Msg).SetAxfr(domain + ".")
+	r.SetTsig(tsigName, dns.HmacSHA256, 300, time.Now().Unix())
+	c := &dns.Client{Net: "tcp", TsigSecret: map[string]string{tsigName: "d3Jvbmc="}}
+	resp, _, err = c.Exchange(r, addr)
+	require.NoError(t, err)
+	assert.Equal(t, dns.RcodeNotAuth, resp.Rcode, "wrong secret")
+}
+
+// dohWriter is a DNS over HTTPS writer, which does not verify TSIG
+type dohWriter struct {
+	testWriter
+}
+
+func (w *dohWriter) Transport() string { return TransportHTTPS }
+func (w *dohWriter) TsigStatus() error { return nil }
+
+func TestTransferOverDoH(t *testing.T) {
+	rsv := newTestTransferResolver(t, `
+allow_from: [0.0.0.0/0, "::/0"]
+tsig:
+  - name: xfr.example.com
+    algorithm: hmac-sha256
+    secret: `+tsigSecret+"\n")
+
+	r := new(dns.Msg).SetAxfr(domain + ".")
+	r.SetTsig(tsigName, dns.HmacSHA256, 300, time.Now().Unix())
+	r.Extra[0].(*dns.TSIG).MAC = "deadbeef"
+	w := &dohWriter{testWriter{remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443}}}
+	rsv.ServeDNS(w, r)
+
+	require.NotNil(t, w.msg)
+	assert.Equal(t, dns.RcodeRefused, w.msg.Rcode, "forged MAC over DoH")
+	assert.Empty(t, w.msg.Answer)
+}
+
+func TestTransferDisabled(t *testing.T) {
+	rsv := newTestResolver(t)
+
+	for _, qtype := range []uint16{dns.TypeAXFR, dns.TypeIXFR} {
+		msg := query(rsv, "tcp", new(dns.Msg).SetQuestion(domain+".", qtype))
+		assert.Equal(t, dns.RcodeRefused, msg.Rcode)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	notified := make(chan *dns.Msg, 1)
+	secondary := serve(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		if w.TsigStatus() == nil {
+			notified <- r
+		}
+		msg := new(dns.Msg).SetReply(r)
+		msg.SetTsig(tsigName, dns.HmacSHA256, 300, time.Now().Unix())
+		_ = w.WriteMsg(msg)
+	}), map[string]string{tsigName: tsigSecret})
+
+	rsv := newTestTransferResolver(t, `
+allow_from: [127.0.0.0/8]
+tsig:
+  - name: xfr.example.com
+    algorithm: hmac-sha256
+    secret: `+tsigSecret+`
+notify: [`+secondary+"]\n")
+	rsv.Reload()
+
+	select {
+	case r := <-notified:
+		assert.Equal(t, dns.OpcodeNotify, r.Opcode)
+		assert.Equal(t, domain+".", r.Question[0].Name)
+		require.Len(t, r.Answer, 1)
+		assert.Equal(t, uint32(1), r.Answer[0].(*dns.SOA).Serial)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the secondary was not notified")
+	}
+}
+
+func TestTransferRequiresSOA(t *testing.T) {
+	newTestResolver(t)
+	setting.App.Resolver.ResourceRecords = []string{"3600 IN NS xns.example.com."}
+	setting.App.Resolver.Transfer.AllowFrom = []string{"127.0.0.0/8"}
+
+	_, err := Setup(Config{Store: service.NewMemoryDiscoveryStore(time.Minute, 1000, 0), Tokens: testTokens})
+	assert.ErrorContains(t, err, "zone transfers require a SOA record")
+}
@@ -0,0 +1,46 @@
+package resolver
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// whoami answers with the address of the querier, like o-o.myaddr.l.google.com
+// does: TXT holds the address (and the EDNS client subnet, if any), A or AAAA
+// the address when it belongs to the requested family. Answers are not
+// cacheable as they depend on who asks.
+func (rsv *Resolver) whoami(w dns.ResponseWriter, r *dns.Msg, msg *dns.Msg) int {
+	q := r.Question[0]
+	host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+	ip := net.ParseIP(host)
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 0}
+
+	switch q.Qtype {
+	case dns.TypeTXT:
+		msg.Answer = append(msg.Answer, &dns.TXT{Hdr: hdr, Txt: []string{ip.String()}})
+		if opt := r.IsEdns0(); opt != nil {
+			if ecs := clientSubnet(opt); ecs != nil {
+				msg.Answer = append(msg.Answer, &dns.TXT{
+					Hdr: hdr,
+					Txt: []string{"edns0-client-subnet " + newDNSQuery(w, r).ClientSubnet},
+				})
+			}
+		}
+	case dns.TypeA:
+		if ip4 := ip.To4(); ip4 != nil {
+			msg.Answer = append(msg.Answer, &dns.A{Hdr: hdr, A: ip4})
+		}
+	case dns.TypeAAAA:
+		if ip.To4() == nil {
+			msg.Answer = append(msg.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+
+	return dns.RcodeSuccess
+}
+
+func (rsv *Resolver) isWhoami(name string) bool {
+	_, ok := rsv.whoamiNames[name]
+	return ok
+}
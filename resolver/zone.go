@@ -0,0 +1,280 @@
+package resolver
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// maxCNAMEChain limits the number of CNAME records followed inside the zone
+const maxCNAMEChain = 8
+
+// zone holds the static records of the domain, indexed by lowercased owner name
+type zone struct {
+	origin  string
+	records map[string][]dns.RR
+	// names holds every owner name and every empty non-terminal, i.e. every
+	// name that exists in the zone
+	names map[string]struct{}
+	soa   *dns.SOA
+}
+
+// lookupResult is the outcome of a zone lookup, ready to be copied into a reply
+type lookupResult struct {
+	rcode      int
+	answer     []dns.RR
+	ns         []dns.RR
+	extra      []dns.RR
+	delegation bool
+}
+
+func newZone(origin string) *zone {
+	z := &zone{
+		origin:  strings.ToLower(dns.Fqdn(origin)),
+		records: map[string][]dns.RR{},
+		names:   map[string]struct{}{},
+	}
+	// the apex always exists, even without records
+	z.names[z.origin] = struct{}{}
+
+	return z
+}
+
+// loadZone builds the zone of origin from an RFC 1035 master file (if path is
+// not empty) and the legacy resource records, which are all owned by the apex
+func loadZone(origin string, path string, resourceRecords []string) (*zone, error) {
+	z := newZone(origin)
+
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if err := z.parse(f, path); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, res := range resourceRecords {
+		rr, err := dns.NewRR(z.origin + " " + res)
+		if err != nil {
+			return nil, fmt.Errorf("invalid resource record %q: %w", res, err)
+		}
+		if err := z.add(rr); err != nil {
+			return nil, err
+		}
+	}
+
+	return z, nil
+}
+
+func (z *zone) parse(r io.Reader, file string) error {
+	zp := dns.NewZoneParser(r, z.origin, file)
+	zp.SetIncludeAllowed(true)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if err := z.add(rr); err != nil {
+			return err
+		}
+	}
+
+	return zp.Err()
+}
+
+func (z *zone) add(rr dns.RR) error {
+	name := strings.ToLower(rr.Header().Name)
+	if !dns.IsSubDomain(z.origin, name) {
+		return fmt.Errorf("%s is out of zone %s", rr.Header().Name, z.origin)
+	}
+	if rr.Header().Class != dns.ClassINET {
+		return fmt.Errorf("%s has unsupported class %s", rr.Header().Name, dns.ClassToString[rr.Header().Class])
+	}
+
+	if soa, ok := rr.(*dns.SOA); ok {
+		if name != z.origin {
+			return fmt.Errorf("SOA record %s is not at the zone apex", rr.Header().Name)
+		}
+		z.soa = soa
+	}
+	z.records[name] = append(z.records[name], rr)
+	for n := name; ; {
+		z.names[n] = struct{}{}
+		if n == z.origin {
+			break
+		}
+		off, _ := dns.NextLabel(n, 0)
+		n = n[off:]
+	}
+
+	return nil
+}
+
+// lookup answers name and qtype from the zone data: delegations below the apex
+// produce a referral, CNAMEs are followed within the zone and wildcards are
+// expanded (RFC 4592). NXDOMAIN and NODATA answers carry the SOA record in the
+// authority section so that they can be cached (RFC 2308).
+func (z *zone) lookup(name string, qtype uint16) lookupResult {
+	res := lookupResult{rcode: dns.RcodeSuccess}
+	for range maxCNAMEChain {
+		if cut := z.delegation(name, qtype); cut != nil {
+			res.ns = cut
+			res.extra = z.glue(cut)
+			res.delegation = len(res.answer) == 0
+			return res
+		}
+
+		rrs, exists := z.find(name)
+		if !exists {
+			if len(res.answer) == 0 {
+				res.rcode = dns.RcodeNameError
+			}
+			res.ns = z.negative()
+			return res
+		}
+
+		matched := false
+		var cname *dns.CNAME
+		for _, rr := range rrs {
+			switch {
+			case rr.Header().Rrtype == qtype:
+				res.answer = append(res.answer, rr)
+				matched = true
+			case rr.Header().Rrtype == dns.TypeCNAME:
+				cname = rr.(*dns.CNAME)
+			}
+		}
+		if matched {
+			return res
+		}
+		if cname == nil || qtype == dns.TypeCNAME {
+			res.ns = z.negative()
+			return res
+		}
+
+		res.answer = append(res.answer, cname)
+		target := strings.ToLower(cname.Target)
+		if !dns.IsSubDomain(z.origin, target) {
+			return res
+		}
+		name = target
+	}
+
+	return res
+}
+
+// find returns the records owned by name, synthesized from a wildcard when the
+// name does not exist. exists is false when the name does not exist at all.
+func (z *zone) find(name string) (rrs []dns.RR, exists bool) {
+	name = strings.ToLower(name)
+	if _, ok := z.names[name]; ok {
+		return z.records[name], true
+	}
+	if !dns.IsSubDomain(z.origin, name) {
+		return nil, false
+	}
+
+	// the source of synthesis is the wildcard child of the closest encloser
+	for n := name; n != z.origin; {
+		off, _ := dns.NextLabel(n, 0)
+		n = n[off:]
+		if _, ok := z.names[n]; !ok {
+			continue
+		}
+		wildcard, ok := z.records["*."+n]
+		if !ok {
+			return nil, false
+		}
+		for _, rr := range wildcard {
+			rr = dns.Copy(rr)
+			rr.Header().Name = name
+			rrs = append(rrs, rr)
+		}
+		return rrs, true
+	}
+
+	return nil, false
+}
+
+// types returns the types of the records owned by name
+func (z *zone) types(name string) []uint16 {
+	rrs, _ := z.find(name)
+	types := make([]uint16, 0, len(rrs))
+	for _, rr := range rrs {
+		types = append(types, rr.Header().Rrtype)
+	}
+
+	return types
+}
+
+// delegation returns the NS records of the zone cut name is at or below, if
+// any. The NS records of the apex are not a zone cut, and the DS records of a
+// cut belong to the parent side.
+func (z *zone) delegation(name string, qtype uint16) []dns.RR {
+	name = strings.ToLower(name)
+	for n := name; n != z.origin && dns.IsSubDomain(z.origin, n); {
+		if n != name || qtype != dns.TypeDS {
+			var ns []dns.RR
+			for _, rr := range z.records[n] {
+				if rr.Header().Rrtype == dns.TypeNS {
+					ns = append(ns, rr)
+				}
+			}
+			if len(ns) > 0 {
+				return ns
+			}
+		}
+		off, _ := dns.NextLabel(n, 0)
+		n = n[off:]
+	}
+
+	return nil
+}
+
+// glue returns the in-zone addresses of the name servers of a delegation
+func (z *zone) glue(ns []dns.RR) []dns.RR {
+	var extra []dns.RR
+	for _, rr := range ns {
+		target := strings.ToLower(rr.(*dns.NS).Ns)
+		for _, a := range z.records[target] {
+			if t := a.Header().Rrtype; t == dns.TypeA || t == dns.TypeAAAA {
+				extra = append(extra, a)
+			}
+		}
+	}
+
+	return extra
+}
+
+// negative returns the authority section of negative answers, the SOA record
+// with the TTL capped to its minimum field (RFC 2308, section 3)
+func (z *zone) negative() []dns.RR {
+	if z.soa == nil {
+		return nil
+	}
+	soa := dns.Copy(z.soa).(*dns.SOA)
+	soa.Hdr.Ttl = min(soa.Hdr.Ttl, soa.Minttl)
+
+	return []dns.RR{soa}
+}
+
+// transfer returns the records of the zone in the order of a zone transfer,
+// the SOA record first and last (RFC 5936, section 2.2). The DNSKEY records are
+// left out, transfers are not allowed for a signed zone, which is only signed
+// online.
+func (z *zone) transfer() []dns.RR {
+	rrs := []dns.RR{z.soa}
+	for _, name := range slices.Sorted(maps.Keys(z.records)) {
+		for _, rr := range z.records[name] {
+			if t := rr.Header().Rrtype; t != dns.TypeSOA && t != dns.TypeDNSKEY {
+				rrs = append(rrs, rr)
+			}
+		}
+	}
+
+	return append(rrs, z.soa)
+}
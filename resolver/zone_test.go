@@ -0,0 +1,142 @@
+package resolver
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dcarrillo/whatismyip/internal/setting"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testZone = `$TTL 3600
+@               IN SOA   xns.example.com. hostmaster.example.com. 1 10000 2400 604800 1800
+@               IN NS    xns.example.com.
+@               IN CAA   0 issue "letsencrypt.org"
+_acme-challenge IN TXT   "token"
+www             IN CNAME web
+web             IN A     192.0.2.10
+alias           IN CNAME www
+external        IN CNAME example.org.
+*.wild          IN TXT   "wildcard"
+a.b.ent         IN A     192.0.2.20
+sub             IN NS    ns1.sub
+ns1.sub         IN A     192.0.2.53
+`
+
+func newTestZone(t *testing.T) *zone {
+	t.Helper()
+	z := newZone(domain)
+	require.NoError(t, z.parse(strings.NewReader(testZone), "test"))
+
+	return z
+}
+
+func TestZoneLookup(t *testing.T) {
+	z := newTestZone(t)
+
+	tests := []struct {
+		name       string
+		qtype      uint16
+		rcode      int
+		answer     []string
+		ns         uint16
+		extra      int
+		delegation bool
+	}{
+		{name: "_acme-challenge", qtype: dns.TypeTXT, answer: []string{"_acme-challenge." + domain + ".\tTXT"}},
+		{name: "", qtype: dns.TypeCAA, answer: []string{domain + ".\tCAA"}},
+		{name: "", qtype: dns.TypeNS, answer: []string{domain + ".\tNS"}},
+		{name: "WWW", qtype: dns.TypeA, answer: []string{"www." + domain + ".\tCNAME", "web." + domain + ".\tA"}},
+		{name: "alias", qtype: dns.TypeA, answer: []string{"alias." + domain + ".\tCNAME", "www." + domain + ".\tCNAME", "web." + domain + ".\tA"}},
+		{name: "www", qtype: dns.TypeCNAME, answer: []string{"www." + domain + ".\tCNAME"}},
+		{name: "external", qtype: dns.TypeA, answer: []string{"external." + domain + ".\tCNAME"}},
+		{name: "web", qtype: dns.TypeAAAA, ns: dns.TypeSOA},
+		{name: "missing", qtype: dns.TypeA, rcode: dns.RcodeNameError, ns: dns.TypeSOA},
+		{name: "b.ent", qtype: dns.TypeA, ns: dns.TypeSOA},
+		{name: "c.b.ent", qtype: dns.TypeA, rcode: dns.RcodeNameError, ns: dns.TypeSOA},
+		{name: "x.y.wild", qtype: dns.TypeTXT, answer: []string{"x.y.wild." + domain + ".\tTXT"}},
+		{name: "x.wild", qtype: dns.TypeA, ns: dns.TypeSOA},
+		{name: "sub", qtype: dns.TypeA, ns: dns.TypeNS, extra: 1, delegation: true},
+		{name: "host.sub", qtype: dns.TypeA, ns: dns.TypeNS, extra: 1, delegation: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name+"/"+dns.TypeToString[tt.qtype], func(t *testing.T) {
+			name := domain + "."
+			if tt.name != "" {
+				name = tt.name + "." + name
+			}
+			res := z.lookup(name, tt.qtype)
+
+			assert.Equal(t, tt.rcode, res.rcode)
+			assert.Equal(t, tt.delegation, res.delegation)
+			var answer []string
+			for _, rr := range res.answer {
+				answer = append(answer, rr.Header().Name+"\t"+dns.TypeToString[rr.Header().Rrtype])
+			}
+			assert.Equal(t, tt.answer, answer)
+			if tt.ns == 0 {
+				assert.Empty(t, res.ns)
+			} else {
+				require.NotEmpty(t, res.ns)
+				assert.Equal(t, tt.ns, res.ns[0].Header().Rrtype)
+			}
+			assert.Len(t, res.extra, tt.extra)
+		})
+	}
+}
+
+func TestZoneNegativeTTL(t *testing.T) {
+	z := newTestZone(t)
+
+	res := z.lookup("missing."+domain+".", dns.TypeA)
+	require.Len(t, res.ns, 1)
+	assert.Equal(t, uint32(1800), res.ns[0].Header().Ttl)
+}
+
+func TestLoadZoneErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		zone string
+		rr   []string
+	}{
+		{name: "out of zone", zone: "www.example.org. 60 IN A 192.0.2.1\n"},
+		{name: "SOA below the apex", zone: "sub 60 IN SOA ns. host. 1 2 3 4 5\n"},
+		{name: "syntax error", zone: "www 60 IN A not-an-ip\n"},
+		{name: "invalid resource record", rr: []string{"60 IN A not-an-ip"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "zone")
+			require.NoError(t, os.WriteFile(path, []byte(tt.zone), 0o600))
+			_, err := loadZone(domain, path, tt.rr)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestZoneReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zone")
+	require.NoError(t, os.WriteFile(path, []byte("www 60 IN A 192.0.2.1\n"), 0o600))
+	rsv := newTestResolver(t)
+	setting.App.Resolver.ZoneFile = path
+	rsv.Reload()
+
+	msg := query(rsv, "udp", new(dns.Msg).SetQuestion("www."+domain+".", dns.TypeA))
+	require.Len(t, msg.Answer, 1)
+	assert.Equal(t, "192.0.2.1", msg.Answer[0].(*dns.A).A.String())
+
+	// a broken zone file keeps the current zone
+	require.NoError(t, os.WriteFile(path, []byte("www 60 IN A broken\n"), 0o600))
+	rsv.Reload()
+	msg = query(rsv, "udp", new(dns.Msg).SetQuestion("www."+domain+".", dns.TypeA))
+	assert.Len(t, msg.Answer, 1)
+
+	msg = query(rsv, "udp", new(dns.Msg).SetQuestion(domain+".", dns.TypeSOA))
+	assert.Len(t, msg.Answer, 1, "legacy resource records are served at the apex")
+}
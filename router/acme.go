@@ -0,0 +1,138 @@
+package router
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/dcarrillo/whatismyip/internal/setting"
+	"github.com/dcarrillo/whatismyip/internal/validator"
+	"github.com/dcarrillo/whatismyip/service"
+	"github.com/gin-gonic/gin"
+)
+
+// acmeChallengeLabel is the label of the DNS-01 challenge records
+const acmeChallengeLabel = "_acme-challenge"
+
+// acmeTXT matches a DNS-01 challenge value, a base64url encoded SHA-256 digest
+var acmeTXT = regexp.MustCompile(`^[A-Za-z0-9_-]{43}$`)
+
+type acmeRegisterRequest struct {
+	AllowFrom []string `json:"allowfrom"`
+}
+
+type acmeRegisterResponse struct {
+	Username   string   `json:"username"`
+	Password   string   `json:"password"`
+	FullDomain string   `json:"fulldomain"`
+	Subdomain  string   `json:"subdomain"`
+	AllowFrom  []string `json:"allowfrom"`
+}
+
+type acmeUpdateRequest struct {
+	Subdomain string `json:"subdomain"`
+	TXT       string `json:"txt"`
+}
+
+// SetupACME registers the acme-dns compatible API, accounts are registered
+// with /register and update the TXT record of their challenge with /update
+func SetupACME(r *gin.Engine, acme *service.ACME) {
+	domain := strings.ToLower(strings.TrimSuffix(setting.App.Resolver.Domain, "."))
+	var registerFrom []*net.IPNet
+	for _, cidr := range setting.App.Resolver.ACME.RegisterFrom {
+		if _, network, err := net.ParseCIDR(cidr); err == nil {
+			registerFrom = append(registerFrom, network)
+		}
+	}
+
+	r.POST("/register", func(ctx *gin.Context) {
+		handleACMERegister(ctx, acme, domain, registerFrom)
+	})
+	r.POST("/update", func(ctx *gin.Context) {
+		handleACMEUpdate(ctx, acme)
+	})
+}
+
+func handleACMERegister(ctx *gin.Context, acme *service.ACME, domain string, registerFrom []*net.IPNet) {
+	if !containsIP(registerFrom, net.ParseIP(ctx.ClientIP())) {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "forbidden"})
+		return
+	}
+
+	req := acmeRegisterRequest{}
+	if err := ctx.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "malformed_json_payload"})
+		return
+	}
+	for _, cidr := range req.AllowFrom {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid_allowfrom_cidr"})
+			return
+		}
+	}
+
+	account, password, err := acme.Register(req.AllowFrom)
+	if err != nil {
+		log.Printf("Error registering ACME account: %s", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "db_error"})
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, acmeRegisterResponse{
+		Username:   account.Username,
+		Password:   password,
+		FullDomain: acmeChallengeLabel + "." + account.Subdomain + "." + domain,
+		Subdomain:  account.Subdomain,
+		AllowFrom:  append([]string{}, account.AllowFrom...),
+	})
+}
+
+func handleACMEUpdate(ctx *gin.Context, acme *service.ACME) {
+	account, ok := acme.Authenticate(ctx.GetHeader("X-Api-User"), ctx.GetHeader("X-Api-Key"))
+	if !ok || !account.Allowed(net.ParseIP(ctx.ClientIP())) {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "forbidden"})
+		return
+	}
+
+	req := acmeUpdateRequest{}
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "malformed_json_payload"})
+		return
+	}
+	// the apex account has an empty subdomain
+	if req.Subdomain != "" && !validator.IsUUID(req.Subdomain) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "bad_subdomain"})
+		return
+	}
+	if !strings.EqualFold(req.Subdomain, account.Subdomain) {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "forbidden"})
+		return
+	}
+	if !acmeTXT.MatchString(req.TXT) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "bad_txt"})
+		return
+	}
+
+	if err := acme.Update(account.Subdomain, req.TXT); err != nil {
+		log.Printf("Error updating ACME challenge of %s: %s", account.Subdomain, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "db_error"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"txt": req.TXT})
+}
+
+// containsIP reports whether ip belongs to any of networks
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,105 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dcarrillo/whatismyip/internal/setting"
+	"github.com/dcarrillo/whatismyip/service"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const acmeTestTXT = "LHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM"
+
+func acmeRequest(engine *gin.Engine, path string, remote string, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+	req.RemoteAddr = remote + ":1000"
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestACMEAPI(t *testing.T) {
+	saved := setting.App.Resolver
+	t.Cleanup(func() { setting.App.Resolver = saved })
+	setting.App.Resolver.Domain = domain
+	setting.App.Resolver.ACME.RegisterFrom = []string{"192.0.2.0/24"}
+
+	acme, err := service.NewACME(filepath.Join(t.TempDir(), "acme.json"))
+	require.NoError(t, err)
+	engine := gin.New()
+	SetupACME(engine, acme)
+
+	w := acmeRequest(engine, "/register", "198.51.100.1", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	setting.App.Resolver.ACME.RegisterFrom = nil
+	closed := gin.New()
+	SetupACME(closed, acme)
+	w = acmeRequest(closed, "/register", "192.0.2.1", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "registration is closed without register_from")
+
+	w = acmeRequest(engine, "/register", "192.0.2.1", `{"allowfrom": ["bad"]}`, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.JSONEq(t, `{"error": "invalid_allowfrom_cidr"}`, w.Body.String())
+
+	w = acmeRequest(engine, "/register", "192.0.2.1", "", nil)
+	require.Equal(t, http.StatusCreated, w.Code)
+	open := acmeRegisterResponse{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &open))
+	assert.Equal(t, "_acme-challenge."+open.Subdomain+"."+domain, open.FullDomain)
+	assert.Empty(t, open.AllowFrom)
+
+	w = acmeRequest(engine, "/register", "192.0.2.1", `{"allowfrom": ["203.0.113.0/24"]}`, nil)
+	require.Equal(t, http.StatusCreated, w.Code)
+	restricted := acmeRegisterResponse{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &restricted))
+	assert.Equal(t, []string{"203.0.113.0/24"}, restricted.AllowFrom)
+
+	auth := func(a acmeRegisterResponse) map[string]string {
+		return map[string]string{"X-Api-User": a.Username, "X-Api-Key": a.Password}
+	}
+	update := func(subdomain string, txt string) string {
+		return `{"subdomain": "` + subdomain + `", "txt": "` + txt + `"}`
+	}
+
+	tests := []struct {
+		name    string
+		remote  string
+		body    string
+		headers map[string]string
+		status  int
+		resp    string
+	}{
+		{name: "no credentials", remote: "198.51.100.1", body: update(open.Subdomain, acmeTestTXT), status: http.StatusUnauthorized, resp: `{"error": "forbidden"}`},
+		{name: "wrong password", remote: "198.51.100.1", body: update(open.Subdomain, acmeTestTXT), headers: map[string]string{"X-Api-User": open.Username, "X-Api-Key": "wrong"}, status: http.StatusUnauthorized, resp: `{"error": "forbidden"}`},
+		{name: "not allowed from", remote: "198.51.100.1", body: update(restricted.Subdomain, acmeTestTXT), headers: auth(restricted), status: http.StatusUnauthorized, resp: `{"error": "forbidden"}`},
+		{name: "another subdomain", remote: "198.51.100.1", body: update(restricted.Subdomain, acmeTestTXT), headers: auth(open), status: http.StatusUnauthorized, resp: `{"error": "forbidden"}`},
+		{name: "bad subdomain", remote: "198.51.100.1", body: update("bad", acmeTestTXT), headers: auth(open), status: http.StatusBadRequest, resp: `{"error": "bad_subdomain"}`},
+		{name: "bad txt", remote: "198.51.100.1", body: update(open.Subdomain, "short"), headers: auth(open), status: http.StatusBadRequest, resp: `{"error": "bad_txt"}`},
+		{name: "update", remote: "198.51.100.1", body: update(open.Subdomain, acmeTestTXT), headers: auth(open), status: http.StatusOK, resp: `{"txt": "` + acmeTestTXT + `"}`},
+		{name: "update allowed from", remote: "203.0.113.1", body: update(strings.ToUpper(restricted.Subdomain), acmeTestTXT), headers: auth(restricted), status: http.StatusOK, resp: `{"txt": "` + acmeTestTXT + `"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := acmeRequest(engine, "/update", tt.remote, tt.body, tt.headers)
+			assert.Equal(t, tt.status, w.Code)
+			assert.JSONEq(t, tt.resp, w.Body.String())
+		})
+	}
+
+	records, _ := acme.TXT(open.Subdomain)
+	assert.Equal(t, []string{acmeTestTXT}, records)
+}
@@ -2,96 +2,435 @@ package router
 
 import (
 	"fmt"
+	"html/template"
+	"log"
 	"net"
 	"net/http"
+	"slices"
 	"strings"
+	"time"
 
-	validator "github.com/dcarrillo/whatismyip/internal/validator/uuid"
+	"github.com/dcarrillo/whatismyip/internal/validator"
+	"github.com/dcarrillo/whatismyip/models"
+	"github.com/dcarrillo/whatismyip/service"
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
-	"github.com/patrickmn/go-cache"
+	"github.com/gin-gonic/gin/render"
+	"github.com/miekg/dns"
 )
 
 type DNSJSONResponse struct {
-	DNS dnsData `json:"dns"`
+	DNS              []dnsData   `json:"dns"`
+	DNSSECValidation string      `json:"dnssec_validation"`
+	Probes           *probesData `json:"probes,omitempty"`
 }
+
+// Results of the resolver capability probes
+const (
+	ProbeSupported    = "supported"
+	ProbeNotSupported = "not-supported"
+	ProbeUntested     = "untested"
+	// the large response was received over UDP, truncated or over TCP
+	ProbeLargeUDP       = "udp"
+	ProbeLargeTruncated = "truncated"
+	ProbeLargeTCP       = "tcp"
+)
+
+type probesData struct {
+	TCPFallback       string   `json:"tcp_fallback"`
+	LargeResponse     string   `json:"large_response"`
+	IPv6Transport     string   `json:"ipv6_transport"`
+	QNameMinimisation string   `json:"qname_minimisation"`
+	QNames            []string `json:"qnames,omitempty"`
+}
+
+// DNSSEC validation results, a client whose resolver validates signatures can
+// not reach the bogus host
+const (
+	DNSSECValidating    = "validating"
+	DNSSECNotValidating = "not-validating"
+	DNSSECUntested      = "untested"
+)
+
+type dnsPageData struct {
+	DNSJSONResponse
+	BogusURL  string
+	ProbeURLs []string
+}
+
+var dnsTemplate = template.Must(template.New("dns").Parse(dnsPage))
+
+// DiscoveryIssuer issues the tokens of the discovery run by the landing page,
+// a nil issuer means that the DNS discovery is not set up
+type DiscoveryIssuer struct {
+	tokens   *validator.Tokens
+	domain   string
+	redirect DiscoveryRedirect
+}
+
+func NewDiscoveryIssuer(tokens *validator.Tokens, domain string, redirect DiscoveryRedirect) *DiscoveryIssuer {
+	return &DiscoveryIssuer{tokens: tokens, domain: normalizeHost(domain), redirect: redirect}
+}
+
+// beacon is a transparent 1x1 GIF image
+var beacon = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
 type dnsGeoData struct {
 	Country         string `json:"country,omitempty"`
 	AsnOrganization string `json:"provider,omitempty"`
 }
 
 type dnsData struct {
-	IP string `json:"ip"`
+	IP                string    `json:"ip"`
+	Hits              int       `json:"hits"`
+	QueryTypes        []string  `json:"query_types"`
+	Transport         string    `json:"transport,omitempty"`
+	ClientSubnet      string    `json:"client_subnet,omitempty"`
+	EDNS              bool      `json:"edns"`
+	UDPSize           uint16    `json:"udp_size,omitempty"`
+	DNSSECOK          bool      `json:"dnssec_ok"`
+	ClientCookie      bool      `json:"client_cookie"`
+	ServerCookie      bool      `json:"server_cookie"`
+	CaseRandomization bool      `json:"case_randomization"`
+	Time              time.Time `json:"time,omitzero"`
 	dnsGeoData
 }
 
-// TODO
-// Implement a proper vhost manager instead of using a middleware
-func GetDNSDiscoveryHandler(store *cache.Cache, domain string, redirectPort string) gin.HandlerFunc {
-	return func(ctx *gin.Context) {
-		if !strings.HasSuffix(ctx.Request.Host, domain) {
-			ctx.Next()
-			return
+// DiscoveryRedirect holds the scheme (http or https) and the port (:8000) of
+// the redirect to a new token, the ones the request arrived on are used when
+// they are empty. The port of the request is only kept along with its scheme,
+// a configured scheme uses its default port unless the port is configured too.
+type DiscoveryRedirect struct {
+	Scheme string
+	Port   string
+}
+
+// url returns the URL of host for the redirect of req
+func (d DiscoveryRedirect) url(req *http.Request, host string) string {
+	scheme, port := d.Scheme, d.Port
+	if scheme == "" {
+		scheme = "http"
+		if req.TLS != nil {
+			scheme = "https"
+		}
+		if _, p, err := net.SplitHostPort(req.Host); port == "" && err == nil {
+			port = ":" + p
 		}
+	}
 
-		if ctx.Request.Host == domain && ctx.Request.URL.Path == "/" {
-			ctx.Redirect(http.StatusFound, fmt.Sprintf("http://%s.%s%s", uuid.New().String(), domain, redirectPort))
-			ctx.Abort()
+	return fmt.Sprintf("%s://%s%s", scheme, host, port)
+}
+
+// SetupDNSDiscovery registers the DNS discovery routes on r, meant to be
+// served by the virtual hosts <domain> and *.<domain>. A request to the bare
+// domain is redirected to a new <token>.<domain> whose DNS query is tracked by
+// the resolver. Tokens are signed and bound to the network of the client they
+// are issued to, only that network can read the result. The stack test
+// hostnames, if stack is not nil, are served as well. Every path is served but
+// the routes registered on r, such as the DNS over HTTPS endpoint.
+func SetupDNSDiscovery(r *gin.Engine, store service.DiscoveryStore, discovery *DiscoveryIssuer, stack *StackTestHosts) {
+	tokens, domain, redirect := discovery.tokens, discovery.domain, discovery.redirect
+	r.NoRoute(func(ctx *gin.Context) {
+		if ctx.Request.Method != http.MethodGet {
+			ctx.String(http.StatusNotFound, http.StatusText(http.StatusNotFound))
+			return
+		}
+		if normalizeHost(ctx.Request.Host) == domain && ctx.Request.URL.Path == "/" {
+			ctx.Redirect(http.StatusFound, redirect.url(ctx.Request, tokens.New(ctx.ClientIP())+"."+domain))
+			return
+		}
+		if label, token, ok := stack.match(ctx.Request.Host, tokens); ok {
+			handleStackHost(ctx, store, *stack, label, token)
+			return
+		}
+		if token, found := strings.CutPrefix(strings.Split(normalizeHost(ctx.Request.Host), ".")[0], models.BogusPrefix); found {
+			handleBogus(ctx, store, tokens, token)
+			return
+		}
+		if token, found := probeToken(normalizeHost(ctx.Request.Host), domain); found {
+			handleProbe(ctx, tokens, token)
 			return
 		}
 
-		handleDNS(ctx, store)
-		ctx.Abort()
+		handleDNS(ctx, store, tokens)
+	})
+}
+
+// url returns the URL of a new token for the client of ctx, empty if the DNS
+// discovery is not set up
+func (d *DiscoveryIssuer) url(ctx *gin.Context) string {
+	if d == nil {
+		return ""
 	}
+	host := d.tokens.New(ctx.ClientIP()) + "." + d.domain
+
+	return d.redirect.url(ctx.Request, host) + "/"
 }
 
-func handleDNS(ctx *gin.Context, store *cache.Cache) {
-	d := strings.Split(ctx.Request.Host, ".")[0]
-	if !validator.IsValid(d) {
+func handleDNS(ctx *gin.Context, store service.DiscoveryStore, tokens *validator.Tokens) {
+	// the landing page fetches the result from another origin, only the
+	// network the token was issued to can read it
+	ctx.Header("Access-Control-Allow-Origin", "*")
+	ctx.Header("Cache-Control", "no-store")
+	d := strings.Split(normalizeHost(ctx.Request.Host), ".")[0]
+	if !tokens.ValidFor(d, ctx.ClientIP()) {
 		ctx.String(http.StatusNotFound, http.StatusText(http.StatusNotFound))
 		return
 	}
+	// the discovery page tells when its request to the bogus host failed
+	if ctx.Query("bogus") == "failed" {
+		if err := store.Set(models.BogusFailKey(d), ctx.ClientIP(), true); err != nil {
+			log.Printf("Error recording DNSSEC validation test %s: %s", d, err)
+		}
+	}
 
-	v, found := store.Get(d)
+	discovery := models.DNSDiscovery{}
+	found, err := store.Get(d, &discovery)
+	if err != nil {
+		log.Printf("Error reading discovery %s: %s", d, err)
+		ctx.String(http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable))
+		return
+	}
 	if !found {
 		ctx.String(http.StatusNotFound, http.StatusText(http.StatusNotFound))
 		return
 	}
 
-	ipStr, ok := v.(string)
-	if !ok {
+	j := DNSJSONResponse{DNSSECValidation: dnssecValidation(store, d)}
+	probes := models.DNSProbes{}
+	if found, _ := store.Get(models.ProbesKey(d), &probes); found {
+		j.Probes = newProbesData(probes)
+	}
+	for _, resolver := range discovery.Resolvers {
+		if data, ok := newDNSData(resolver); ok {
+			j.DNS = append(j.DNS, data)
+		}
+	}
+	if len(j.DNS) == 0 {
 		ctx.String(http.StatusNotFound, http.StatusText(http.StatusNotFound))
 		return
 	}
 
-	ip := net.ParseIP(ipStr)
-	if ip == nil {
+	switch ctx.NegotiateFormat(gin.MIMEPlain, gin.MIMEHTML, gin.MIMEJSON) {
+	case gin.MIMEJSON:
+		ctx.JSON(http.StatusOK, j)
+	case gin.MIMEHTML:
+		ctx.Render(http.StatusOK, render.HTML{
+			Template: dnsTemplate,
+			Name:     "dns",
+			Data: dnsPageData{
+				DNSJSONResponse: j,
+				BogusURL:        "//" + models.BogusPrefix + ctx.Request.Host + "/",
+				ProbeURLs:       probeURLs(ctx.Request.Host, d),
+			},
+		})
+	default:
+		output := make([]string, 0, len(j.DNS))
+		for _, d := range j.DNS {
+			output = append(output, dnsToString(d))
+		}
+		if j.DNSSECValidation != DNSSECUntested {
+			output = append(output, "DNSSEC validation: "+j.DNSSECValidation+"\n")
+		}
+		if j.Probes != nil {
+			output = append(output, probesToString(*j.Probes))
+		}
+		ctx.String(http.StatusOK, strings.Join(output, "\n"))
+	}
+}
+
+// handleBogus records that the client reached the host of the DNSSEC
+// validation test, bogus-<token>.<domain>, meant to be requested as an image
+func handleBogus(ctx *gin.Context, store service.DiscoveryStore, tokens *validator.Tokens, token string) {
+	if !tokens.ValidFor(token, ctx.ClientIP()) {
 		ctx.String(http.StatusNotFound, http.StatusText(http.StatusNotFound))
 		return
 	}
 
+	if err := store.Set(models.BogusFetchKey(token), ctx.ClientIP(), true); err != nil {
+		log.Printf("Error recording DNSSEC validation test %s: %s", token, err)
+	}
+	ctx.Header("Access-Control-Allow-Origin", "*")
+	ctx.Header("Cache-Control", "no-store")
+	ctx.Data(http.StatusOK, "image/gif", beacon)
+}
+
+// handleProbe answers the hostnames of the capability probes, requested as
+// images by the discovery page. The probes are run by the resolver when it
+// resolves them, the request itself records nothing.
+func handleProbe(ctx *gin.Context, tokens *validator.Tokens, token string) {
+	if !tokens.Valid(token) {
+		ctx.String(http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		return
+	}
+
+	ctx.Header("Access-Control-Allow-Origin", "*")
+	ctx.Header("Cache-Control", "no-store")
+	ctx.Data(http.StatusOK, "image/gif", beacon)
+}
+
+// probeToken returns the token of a capability probe hostname,
+// <probe>-<token>.<domain> or a name below it
+func probeToken(host string, domain string) (string, bool) {
+	rel, found := strings.CutSuffix(host, "."+domain)
+	if !found {
+		return "", false
+	}
+	labels := strings.Split(rel, ".")
+	probe, token, found := strings.Cut(labels[len(labels)-1], "-")
+	if !found || !slices.Contains([]string{models.ProbeTC, models.ProbeBig, models.ProbeV6NS, models.ProbeQM}, probe) {
+		return "", false
+	}
+
+	return token, true
+}
+
+// probeURLs returns the URLs of the capability probes of token, on the host
+// (<token>.<domain>[:port]) of the discovery page
+func probeURLs(host string, token string) []string {
+	suffix := host[len(token):]
+	urls := []string{}
+	for _, h := range models.ProbeHosts(token) {
+		urls = append(urls, "//"+h+suffix+"/")
+	}
+
+	return urls
+}
+
+// dnssecValidation returns the result of the DNSSEC validation test of token:
+// the resolver queried the bogus name but the request of the client to its host
+// failed when the resolver rejected the broken signature. A request that did
+// not complete in time leaves the test untested.
+func dnssecValidation(store service.DiscoveryStore, token string) string {
+	fetched, _ := store.Get(models.BogusFetchKey(token), new(bool))
+	queried, _ := store.Get(models.BogusQueryKey(token), new(bool))
+	failed, _ := store.Get(models.BogusFailKey(token), new(bool))
+	switch {
+	case fetched:
+		return DNSSECNotValidating
+	case queried && failed:
+		return DNSSECValidating
+	default:
+		return DNSSECUntested
+	}
+}
+
+func newProbesData(p models.DNSProbes) *probesData {
+	data := &probesData{
+		TCPFallback:       ProbeUntested,
+		LargeResponse:     ProbeUntested,
+		IPv6Transport:     ProbeUntested,
+		QNameMinimisation: ProbeUntested,
+		QNames:            p.QNames,
+	}
+
+	switch {
+	case p.Truncated && p.TCPRetry:
+		data.TCPFallback = ProbeSupported
+	case p.Truncated:
+		data.TCPFallback = ProbeNotSupported
+	}
+
+	switch {
+	case p.LargeUDP:
+		data.LargeResponse = ProbeLargeUDP
+	case p.LargeTCP:
+		data.LargeResponse = ProbeLargeTCP
+	case p.LargeTruncated:
+		data.LargeResponse = ProbeLargeTruncated
+	}
+
+	switch {
+	case p.IPv6:
+		data.IPv6Transport = ProbeSupported
+	case p.V6Referral:
+		data.IPv6Transport = ProbeNotSupported
+	}
+
+	// a minimising resolver queries the names between the probe label and the
+	// full name first, so not every name has the same number of labels
+	if len(p.QNames) > 0 {
+		data.QNameMinimisation = ProbeNotSupported
+		for _, name := range p.QNames {
+			if dns.CountLabel(name) != dns.CountLabel(p.QNames[0]) {
+				data.QNameMinimisation = ProbeSupported
+			}
+		}
+	}
+
+	return data
+}
+
+func newDNSData(resolver models.DNSResolver) (dnsData, bool) {
+	ip := net.ParseIP(resolver.IP)
+	if ip == nil {
+		return dnsData{}, false
+	}
+
 	geoResp := dnsGeoData{}
 	if geoSvc != nil {
-		cityRecord := geoSvc.LookUpCity(ip)
-		asnRecord := geoSvc.LookUpASN(ip)
-
-		geoResp = dnsGeoData{
-			Country:         cityRecord.Country.Names["en"],
-			AsnOrganization: asnRecord.AutonomousSystemOrganization,
+		if cityRecord := geoSvc.LookUpCity(ip); cityRecord != nil {
+			geoResp.Country = cityRecord.Country.Names["en"]
+		}
+		if asnRecord := geoSvc.LookUpASN(ip); asnRecord != nil {
+			geoResp.AsnOrganization = asnRecord.AutonomousSystemOrganization
 		}
 	}
 
-	j := DNSJSONResponse{
-		DNS: dnsData{
-			IP:         ipStr,
-			dnsGeoData: geoResp,
-		},
+	return dnsData{
+		IP:                resolver.IP,
+		Hits:              resolver.Hits,
+		QueryTypes:        resolver.QueryTypes,
+		Transport:         resolver.Transport,
+		ClientSubnet:      resolver.ClientSubnet,
+		EDNS:              resolver.EDNS,
+		UDPSize:           resolver.UDPSize,
+		DNSSECOK:          resolver.DNSSECOK,
+		ClientCookie:      resolver.ClientCookie != "",
+		ServerCookie:      resolver.ValidCookie,
+		CaseRandomization: resolver.Case0x20,
+		Time:              resolver.Time,
+		dnsGeoData:        geoResp,
+	}, true
+}
+
+func probesToString(p probesData) string {
+	output := "TCP fallback: " + p.TCPFallback + "\n"
+	output += "Large response: " + p.LargeResponse + "\n"
+	output += "IPv6 transport: " + p.IPv6Transport + "\n"
+	output += "QNAME minimisation: " + p.QNameMinimisation + "\n"
+	if len(p.QNames) > 0 {
+		output += "Queried names: " + strings.Join(p.QNames, ", ") + "\n"
 	}
 
-	switch ctx.NegotiateFormat(gin.MIMEPlain, gin.MIMEHTML, gin.MIMEJSON) {
-	case gin.MIMEJSON:
-		ctx.JSON(http.StatusOK, j)
-	default:
-		ctx.String(http.StatusOK, fmt.Sprintf("%s (%s / %s)\n", j.DNS.IP, j.DNS.Country, j.DNS.AsnOrganization))
+	return output
+}
+
+func dnsToString(d dnsData) string {
+	subnet := d.ClientSubnet
+	if subnet == "" {
+		subnet = "not sent"
+	}
+	udpSize := "no EDNS"
+	if d.EDNS {
+		udpSize = fmt.Sprintf("%d", d.UDPSize)
 	}
+
+	output := fmt.Sprintf("%s (%s / %s)\n", d.IP, d.Country, d.AsnOrganization)
+	output += fmt.Sprintf("Hits: %d (%s)\n", d.Hits, strings.Join(d.QueryTypes, ", "))
+	output += "Transport: " + d.Transport + "\n"
+	output += "Client Subnet: " + subnet + "\n"
+	output += "EDNS Buffer Size: " + udpSize + "\n"
+	output += fmt.Sprintf("DNSSEC OK: %t\n", d.DNSSECOK)
+	output += fmt.Sprintf("Client Cookie: %t\n", d.ClientCookie)
+	output += fmt.Sprintf("Server Cookie: %t\n", d.ServerCookie)
+	output += fmt.Sprintf("Case Randomization (0x20): %t\n", d.CaseRandomization)
+	if !d.Time.IsZero() {
+		output += "Time: " + d.Time.Format(time.RFC3339) + "\n"
+	}
+
+	return output
 }
@@ -1,119 +1,220 @@
 package router
 
 import (
+	"crypto/tls"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 
-	validator "github.com/dcarrillo/whatismyip/internal/validator/uuid"
+	"github.com/dcarrillo/whatismyip/models"
+	"github.com/dcarrillo/whatismyip/service"
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
-	"github.com/patrickmn/go-cache"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
-func TestGetDNSDiscoveryHandler(t *testing.T) {
-	store := cache.New(cache.NoExpiration, cache.NoExpiration)
-	handler := GetDNSDiscoveryHandler(store, domain, "")
+func TestSetupDNSDiscovery(t *testing.T) {
+	store := service.NewMemoryDiscoveryStore(time.Minute, 1000, 0)
+	engine := gin.New()
+	SetupDNSDiscovery(engine, store, NewDiscoveryIssuer(testTokens, domain, DiscoveryRedirect{}), nil)
 
-	t.Run("calls next if host does not have domain suffix", func(t *testing.T) {
-		req, _ := http.NewRequest("GET", "/", nil)
-		req.Header.Set(trustedHeader, testIP.ipv4)
-		req.Host = "example.com"
+	t.Run("return 404 if there is a path", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/path", nil)
+		req.Host = domain
 
 		w := httptest.NewRecorder()
-		c, _ := gin.CreateTestContext(w)
-		c.Request = req
-		handler(c)
-		app.ServeHTTP(w, req)
+		engine.ServeHTTP(w, req)
 
-		assert.Equal(t, http.StatusOK, w.Code)
-		assert.Equal(t, testIP.ipv4+"\n", w.Body.String())
+		assert.Equal(t, http.StatusNotFound, w.Code)
 	})
 
-	t.Run("return 404 if there is a path", func(t *testing.T) {
-		req, _ := http.NewRequest("GET", "/path", nil)
-		req.Host = domain
+	for _, host := range []string{domain, strings.ToUpper(domain), domain + ":8000"} {
+		t.Run("redirects if host is "+host, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Host = host
+
+			w := httptest.NewRecorder()
+			engine.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusFound, w.Code)
+			r, err := url.Parse(w.Header().Get("Location"))
+			assert.NoError(t, err)
+			assert.Equal(t, "http", r.Scheme)
+			assert.True(t, testTokens.ValidFor(strings.Split(r.Hostname(), ".")[0], "192.0.2.1"))
+			assert.Equal(t, domain, strings.Join(strings.Split(r.Hostname(), ".")[1:], "."))
+			if _, port, err := net.SplitHostPort(host); err == nil {
+				assert.Equal(t, port, r.Port(), "the port the request arrived on is kept")
+			}
+		})
+	}
+
+	t.Run("returns the resolver of a known token", func(t *testing.T) {
+		u := testTokens.New("192.0.2.1")
+		store.Set(u, testIP.ipv4, testDiscovery)
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = u + "." + domain + ":8000"
 
 		w := httptest.NewRecorder()
-		c, _ := gin.CreateTestContext(w)
-		c.Request = req
-		handler(c)
-		app.ServeHTTP(w, req)
+		engine.ServeHTTP(w, req)
 
-		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, plainDNSIPv4, w.Body.String())
+		assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"), "the landing page reads the result")
 	})
 
-	t.Run("redirects if host is domain", func(t *testing.T) {
-		req, _ := http.NewRequest("GET", "/", nil)
-		req.Host = domain
+	t.Run("returns the resolver to another address of the client", func(t *testing.T) {
+		u := testTokens.New("2001:db8:0:1:aaaa::1")
+		store.Set(u, testIP.ipv4, testDiscovery)
+
+		// a temporary address of the same network, or the IPv4 address of a
+		// dual-stack client
+		for _, addr := range []string{"[2001:db8:0:1:bbbb::2]:1234", "192.0.2.1:1234"} {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Host = u + "." + domain
+			req.RemoteAddr = addr
+
+			w := httptest.NewRecorder()
+			engine.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code, addr)
+			assert.Equal(t, plainDNSIPv4, w.Body.String())
+		}
+	})
+
+	t.Run("returns 404 to another client", func(t *testing.T) {
+		u := testTokens.New("192.0.2.1")
+		store.Set(u, testIP.ipv4, testDiscovery)
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = u + "." + domain
+		req.RemoteAddr = "198.51.100.1:1234"
 
 		w := httptest.NewRecorder()
-		c, _ := gin.CreateTestContext(w)
-		c.Request = req
-		handler(c)
-
-		assert.Equal(t, http.StatusFound, w.Code)
-		r, err := url.Parse(w.Header().Get("Location"))
-		assert.NoError(t, err)
-		assert.True(t, validator.IsValid(strings.Split(r.Host, ".")[0]))
-		assert.Equal(t, domain, strings.Join(strings.Split(r.Host, ".")[1:], "."))
+		engine.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
 	})
 }
 
+func TestHomeDiscovery(t *testing.T) {
+	discovery := NewDiscoveryIssuer(testTokens, domain, DiscoveryRedirect{Scheme: "https"})
+
+	engine := gin.New()
+	SetupTemplate(engine)
+	engine.GET("/", func(ctx *gin.Context) { getRoot(ctx, "home", discovery) })
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "text/html")
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	start := strings.Index(w.Body.String(), `fetch("https:\/\/`)
+	require.NotEqual(t, -1, start, "the landing page fetches a discovery url")
+	token := w.Body.String()[start+len(`fetch("https:\/\/`):][:32]
+	assert.True(t, testTokens.ValidFor(token, "192.0.2.1"))
+	assert.Contains(t, w.Body.String(), token+"."+domain+`\/"`)
+}
+
+func TestDiscoveryRedirect(t *testing.T) {
+	tests := []struct {
+		name     string
+		redirect DiscoveryRedirect
+		host     string
+		tls      bool
+		want     string
+	}{
+		{name: "plain request", host: domain, want: "http://t." + domain},
+		{name: "tls request", host: domain, tls: true, want: "https://t." + domain},
+		{name: "tls request to a port", host: domain + ":8443", tls: true, want: "https://t." + domain + ":8443"},
+		{name: "configured scheme", redirect: DiscoveryRedirect{Scheme: "https"}, host: domain, want: "https://t." + domain},
+		{
+			name:     "configured scheme from a port",
+			redirect: DiscoveryRedirect{Scheme: "https"},
+			host:     domain + ":8000",
+			want:     "https://t." + domain,
+		},
+		{name: "configured port", redirect: DiscoveryRedirect{Port: ":8001"}, host: domain + ":8000", want: "http://t." + domain + ":8001"},
+		{
+			name:     "configured scheme and port",
+			redirect: DiscoveryRedirect{Scheme: "https", Port: ":8001"},
+			host:     domain + ":8000",
+			want:     "https://t." + domain + ":8001",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Host = tt.host
+			if tt.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			assert.Equal(t, tt.want, tt.redirect.url(req, "t."+domain))
+		})
+	}
+}
+
 func TestHandleDNS(t *testing.T) {
-	store := cache.New(cache.NoExpiration, cache.NoExpiration)
-	u := uuid.New().String()
+	store := service.NewMemoryDiscoveryStore(time.Minute, 1000, 0)
+	u := testTokens.New("192.0.2.1")
 
 	tests := []struct {
 		name      string
 		subDomain string
 		stored    any
+		code      int
 	}{
 		{
-			name:      "not found if the subdomain is not a valid uuid",
-			subDomain: "not-uuid",
+			name:      "not found if the subdomain is not a valid token",
+			subDomain: "not-a-token",
 			stored:    "",
+			code:      http.StatusNotFound,
 		},
 		{
 			name:      "not found if the ip is not found in the store",
 			subDomain: u,
 			stored:    "",
+			code:      http.StatusNotFound,
 		},
 		{
 			name:      "not found if the ip is in store but is not valid",
 			subDomain: u,
-			stored:    "bogus",
+			stored:    models.DNSDiscovery{}.Add(models.DNSQuery{IP: "bogus"}, "A"),
+			code:      http.StatusNotFound,
 		},
 		{
-			name:      "not found if the store contains no string",
+			name:      "unavailable if the store contains no discovery",
 			subDomain: u,
-			stored:    20,
+			stored:    testIP.ipv4,
+			code:      http.StatusServiceUnavailable,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			req, _ := http.NewRequest("GET", "/", nil)
+			req := httptest.NewRequest("GET", "/", nil)
 			req.Host = tt.subDomain + "." + domain
 
 			if tt.stored != "" {
-				store.Add(tt.subDomain, tt.stored, cache.DefaultExpiration)
+				store.Set(tt.subDomain, testIP.ipv4, tt.stored)
 			}
 
 			w := httptest.NewRecorder()
 			c, _ := gin.CreateTestContext(w)
 			c.Request = req
-			handleDNS(c, store)
-			assert.Equal(t, http.StatusNotFound, w.Code)
+			handleDNS(c, store, testTokens)
+			assert.Equal(t, tt.code, w.Code)
 		})
 	}
 }
 
 func TestAcceptDNSRequest(t *testing.T) {
-	store := cache.New(cache.NoExpiration, cache.NoExpiration)
+	store := service.NewMemoryDiscoveryStore(time.Minute, 1000, 0)
 
 	tests := []struct {
 		name   string
@@ -134,8 +235,8 @@ func TestAcceptDNSRequest(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			req, _ := http.NewRequest("GET", "/", nil)
-			u := uuid.New().String()
+			req := httptest.NewRequest("GET", "/", nil)
+			u := testTokens.New("192.0.2.1")
 			req.Host = u + "." + domain
 			req.Header.Add("Accept", tt.accept)
 
@@ -143,11 +244,203 @@ func TestAcceptDNSRequest(t *testing.T) {
 			c, _ := gin.CreateTestContext(w)
 			c.Request = req
 
-			store.Add(u, testIP.ipv4, cache.DefaultExpiration)
-			handleDNS(c, store)
+			store.Set(u, testIP.ipv4, testDiscovery)
+			handleDNS(c, store, testTokens)
 
 			assert.Equal(t, http.StatusOK, w.Code)
 			assert.Equal(t, tt.want, w.Body.String())
 		})
 	}
 }
+
+var testDiscovery = models.DNSDiscovery{}.Add(testDNSQuery, "A").Add(testDNSQuery, "AAAA")
+
+var testDNSQuery = models.DNSQuery{
+	IP:           testIP.ipv4,
+	Transport:    "udp",
+	ClientSubnet: "192.0.2.0/24",
+	EDNS:         true,
+	UDPSize:      1232,
+	DNSSECOK:     true,
+	ClientCookie: "0011223344556677",
+	ServerCookie: "01000000659d8a00a1b2c3d4e5f60718",
+	ValidCookie:  true,
+	Case0x20:     true,
+	Time:         time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+}
+
+func TestDNSSECValidation(t *testing.T) {
+	store := service.NewMemoryDiscoveryStore(time.Minute, 1000, 0)
+	engine := gin.New()
+	SetupDNSDiscovery(engine, store, NewDiscoveryIssuer(testTokens, domain, DiscoveryRedirect{}), nil)
+
+	get := func(host, path, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Host = host
+		req.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		return w
+	}
+
+	tests := []struct {
+		name    string
+		queried bool
+		fetched bool
+		failed  bool
+		want    string
+	}{
+		{name: "untested", want: DNSSECUntested},
+		{name: "timed out", queried: true, want: DNSSECUntested},
+		{name: "failed without a query", failed: true, want: DNSSECUntested},
+		{name: "validating", queried: true, failed: true, want: DNSSECValidating},
+		{name: "not validating", queried: true, fetched: true, want: DNSSECNotValidating},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := testTokens.New("192.0.2.1")
+			store.Set(u, testIP.ipv4, testDiscovery)
+			if tt.queried {
+				store.Set(models.BogusQueryKey(u), testIP.ipv4, true)
+			}
+			if tt.fetched {
+				w := get(models.BogusPrefix+u+"."+domain, "/", "image/*")
+				assert.Equal(t, http.StatusOK, w.Code)
+				assert.Equal(t, "image/gif", w.Header().Get("Content-Type"))
+			}
+			path := "/"
+			if tt.failed {
+				path = "/?bogus=failed"
+			}
+
+			w := get(u+"."+domain, path, "application/json")
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Contains(t, w.Body.String(), `"dnssec_validation":"`+tt.want+`"`)
+
+			w = get(u+"."+domain, "/", "text/plain")
+			if tt.want == DNSSECUntested {
+				assert.NotContains(t, w.Body.String(), "DNSSEC validation")
+			} else {
+				assert.Contains(t, w.Body.String(), "DNSSEC validation: "+tt.want+"\n")
+			}
+		})
+	}
+
+	t.Run("html page requests the bogus host", func(t *testing.T) {
+		u := testTokens.New("192.0.2.1")
+		store.Set(u, testIP.ipv4, testDiscovery)
+
+		w := get(u+"."+domain+":8000", "/", "text/html")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), testIP.ipv4)
+		assert.Contains(t, w.Body.String(), `"//bogus-`+u+`.`+domain+`:8000/"`)
+	})
+
+	t.Run("bogus host with an invalid token", func(t *testing.T) {
+		w := get(models.BogusPrefix+"not-a-token."+domain, "/", "image/*")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("bogus host requested from another network", func(t *testing.T) {
+		u := testTokens.New("198.51.100.1")
+		w := get(models.BogusPrefix+u+"."+domain, "/", "image/*")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		found, err := store.Get(models.BogusFetchKey(u), new(bool))
+		require.NoError(t, err)
+		assert.False(t, found)
+	})
+}
+
+func TestDNSProbes(t *testing.T) {
+	tests := []struct {
+		name   string
+		probes models.DNSProbes
+		want   probesData
+	}{
+		{
+			name:   "untested",
+			probes: models.DNSProbes{},
+			want:   probesData{TCPFallback: ProbeUntested, LargeResponse: ProbeUntested, IPv6Transport: ProbeUntested, QNameMinimisation: ProbeUntested},
+		},
+		{
+			name: "capable resolver",
+			probes: models.DNSProbes{
+				Truncated: true, TCPRetry: true, LargeUDP: true, V6Referral: true, IPv6: true,
+				QNames: []string{"qm-x", "b.qm-x", "a.b.qm-x"},
+			},
+			want: probesData{
+				TCPFallback: ProbeSupported, LargeResponse: ProbeLargeUDP, IPv6Transport: ProbeSupported, QNameMinimisation: ProbeSupported,
+				QNames: []string{"qm-x", "b.qm-x", "a.b.qm-x"},
+			},
+		},
+		{
+			name: "limited resolver",
+			probes: models.DNSProbes{
+				Truncated: true, LargeTruncated: true, V6Referral: true, QNames: []string{"a.b.qm-x"},
+			},
+			want: probesData{
+				TCPFallback: ProbeNotSupported, LargeResponse: ProbeLargeTruncated, IPv6Transport: ProbeNotSupported, QNameMinimisation: ProbeNotSupported,
+				QNames: []string{"a.b.qm-x"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, *newProbesData(tt.probes))
+		})
+	}
+
+	t.Run("probes are part of the discovery result", func(t *testing.T) {
+		store := service.NewMemoryDiscoveryStore(time.Minute, 1000, 0)
+		engine := gin.New()
+		SetupDNSDiscovery(engine, store, NewDiscoveryIssuer(testTokens, domain, DiscoveryRedirect{}), nil)
+		u := testTokens.New("192.0.2.1")
+		store.Set(u, testIP.ipv4, testDiscovery)
+		store.Set(models.ProbesKey(u), testIP.ipv4, models.DNSProbes{Truncated: true, TCPRetry: true})
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = u + "." + domain
+		req.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		assert.Contains(t, w.Body.String(), `"probes":{"tcp_fallback":"supported","large_response":"untested"`)
+
+		req.Header.Set("Accept", "text/plain")
+		w = httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		assert.Contains(t, w.Body.String(), "TCP fallback: supported\n")
+	})
+
+	t.Run("html page requests the probe hosts", func(t *testing.T) {
+		store := service.NewMemoryDiscoveryStore(time.Minute, 1000, 0)
+		engine := gin.New()
+		SetupDNSDiscovery(engine, store, NewDiscoveryIssuer(testTokens, domain, DiscoveryRedirect{}), nil)
+		u := testTokens.New("192.0.2.1")
+		store.Set(u, testIP.ipv4, testDiscovery)
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = u + "." + domain + ":8000"
+		req.Header.Set("Accept", "text/html")
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		for _, host := range models.ProbeHosts(u) {
+			assert.Contains(t, w.Body.String(), `"//`+host+`.`+domain+`:8000/"`)
+		}
+
+		for _, host := range append(models.ProbeHosts(u), "xx-"+u, "tc-not-a-token") {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Host = host + "." + domain
+			w := httptest.NewRecorder()
+			engine.ServeHTTP(w, req)
+			if strings.HasPrefix(host, "xx-") || strings.HasSuffix(host, "not-a-token") {
+				assert.Equal(t, http.StatusNotFound, w.Code, host)
+				continue
+			}
+			assert.Equal(t, http.StatusOK, w.Code, host)
+			assert.Equal(t, "image/gif", w.Header().Get("Content-Type"))
+		}
+	})
+}
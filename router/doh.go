@@ -0,0 +1,138 @@
+package router
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/dcarrillo/whatismyip/resolver"
+	"github.com/gin-gonic/gin"
+	"github.com/miekg/dns"
+)
+
+const dohContentType = "application/dns-message"
+
+// dohWriter implements dns.ResponseWriter for DNS queries received over HTTPS
+// (RFC 8484)
+type dohWriter struct {
+	local  net.Addr
+	remote net.Addr
+	msg    *dns.Msg
+	// tsig is set when the query is signed, its signature is never verified
+	tsig bool
+}
+
+func (w *dohWriter) LocalAddr() net.Addr  { return w.local }
+func (w *dohWriter) RemoteAddr() net.Addr { return w.remote }
+func (w *dohWriter) Transport() string    { return resolver.TransportHTTPS }
+
+func (w *dohWriter) WriteMsg(msg *dns.Msg) error {
+	w.msg = msg
+	return nil
+}
+
+func (w *dohWriter) Write(b []byte) (int, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = msg
+
+	return len(b), nil
+}
+
+func (w *dohWriter) Close() error        { return nil }
+func (w *dohWriter) TsigTimersOnly(bool) {}
+func (w *dohWriter) Hijack()             {}
+
+// TsigStatus fails for every signed query, as the signature is not verified
+func (w *dohWriter) TsigStatus() error {
+	if w.tsig {
+		return dns.ErrAuth
+	}
+
+	return nil
+}
+
+// SetupDoH registers the DNS over HTTPS endpoint, queries are answered by handler
+func SetupDoH(r *gin.Engine, handler dns.Handler) {
+	serve := func(ctx *gin.Context) {
+		handleDoH(ctx, handler)
+	}
+	r.GET("/dns-query", serve)
+	r.POST("/dns-query", serve)
+}
+
+func handleDoH(ctx *gin.Context, handler dns.Handler) {
+	var wire []byte
+	var err error
+	switch ctx.Request.Method {
+	case http.MethodGet:
+		wire, err = base64.RawURLEncoding.DecodeString(ctx.Query("dns"))
+	default:
+		if ctx.ContentType() != dohContentType {
+			ctx.String(http.StatusUnsupportedMediaType, http.StatusText(http.StatusUnsupportedMediaType))
+			return
+		}
+		wire, err = io.ReadAll(io.LimitReader(ctx.Request.Body, dns.MaxMsgSize+1))
+	}
+	if err == nil && (len(wire) == 0 || len(wire) > dns.MaxMsgSize) {
+		err = fmt.Errorf("invalid DNS message size %d", len(wire))
+	}
+
+	r := new(dns.Msg)
+	if err == nil {
+		err = r.Unpack(wire)
+	}
+	if err != nil {
+		ctx.String(http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	_, port, _ := net.SplitHostPort(ctx.Request.RemoteAddr)
+	p, _ := strconv.Atoi(port)
+	w := &dohWriter{
+		remote: &net.TCPAddr{IP: net.ParseIP(ctx.ClientIP()), Port: p},
+		tsig:   r.IsTsig() != nil,
+	}
+	if local, ok := ctx.Request.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		w.local = local
+	}
+	handler.ServeDNS(w, r)
+	if w.msg == nil {
+		ctx.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	resp, err := w.msg.Pack()
+	if err != nil {
+		ctx.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	ctx.Header("Cache-Control", fmt.Sprintf("max-age=%d", minTTL(w.msg)))
+	ctx.Data(http.StatusOK, dohContentType, resp)
+}
+
+// minTTL returns the lowest TTL of the records in msg, used as the freshness
+// lifetime of the HTTP response
+func minTTL(msg *dns.Msg) uint32 {
+	var ttl uint32
+	first := true
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if first || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				first = false
+			}
+		}
+	}
+
+	return ttl
+}
@@ -0,0 +1,112 @@
+package router
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dcarrillo/whatismyip/resolver"
+	"github.com/dcarrillo/whatismyip/service"
+	"github.com/gin-gonic/gin"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoH(t *testing.T) {
+	var transport string
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		transport = w.(interface{ Transport() string }).Transport()
+		msg := new(dns.Msg).SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 127.0.0.2")
+		msg.Answer = append(msg.Answer, rr)
+		_ = w.WriteMsg(msg)
+	})
+	engine := gin.New()
+	SetupDoH(engine, handler)
+
+	query, err := new(dns.Msg).SetQuestion(domain+".", dns.TypeA).Pack()
+	require.NoError(t, err)
+
+	get, _ := http.NewRequest("GET", "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(query), nil)
+	post, _ := http.NewRequest("POST", "/dns-query", bytes.NewReader(query))
+	post.Header.Set("Content-Type", dohContentType)
+
+	for _, req := range []*http.Request{get, post} {
+		t.Run(req.Method, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			engine.ServeHTTP(w, req)
+
+			require.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, dohContentType, w.Header().Get("Content-Type"))
+			assert.Equal(t, "max-age=60", w.Header().Get("Cache-Control"))
+			assert.Equal(t, resolver.TransportHTTPS, transport)
+
+			msg := new(dns.Msg)
+			require.NoError(t, msg.Unpack(w.Body.Bytes()))
+			assert.Len(t, msg.Answer, 1)
+		})
+	}
+
+	badRequests := []struct {
+		name        string
+		method      string
+		url         string
+		contentType string
+		want        int
+	}{
+		{name: "missing dns parameter", method: "GET", url: "/dns-query", want: http.StatusBadRequest},
+		{name: "invalid base64", method: "GET", url: "/dns-query?dns=***", want: http.StatusBadRequest},
+		{name: "invalid message", method: "GET", url: "/dns-query?dns=AAAA", want: http.StatusBadRequest},
+		{name: "wrong content type", method: "POST", url: "/dns-query", contentType: "text/plain", want: http.StatusUnsupportedMediaType},
+	}
+
+	for _, tt := range badRequests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, tt.url, bytes.NewReader(query))
+			req.Header.Set("Content-Type", tt.contentType)
+			w := httptest.NewRecorder()
+			engine.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.want, w.Code)
+		})
+	}
+}
+
+func TestDoHOnDiscoveryHosts(t *testing.T) {
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		_ = w.WriteMsg(new(dns.Msg).SetReply(r))
+	})
+	store := service.NewMemoryDiscoveryStore(time.Minute, 1000, 0)
+	engine := gin.New()
+	SetupDNSDiscovery(engine, store, NewDiscoveryIssuer(testTokens, domain, DiscoveryRedirect{}), &stackHosts)
+	SetupDoH(engine, handler)
+
+	query, err := new(dns.Msg).SetQuestion(domain+".", dns.TypeA).Pack()
+	require.NoError(t, err)
+	for _, host := range []string{domain, "v4." + domain} {
+		t.Run(host, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(query), nil)
+			req.Host = host
+			w := httptest.NewRecorder()
+			engine.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, dohContentType, w.Header().Get("Content-Type"))
+
+			req, _ = http.NewRequest("GET", "/", nil)
+			req.Host = host
+			w = httptest.NewRecorder()
+			engine.ServeHTTP(w, req)
+			assert.NotEqual(t, http.StatusNotFound, w.Code, "the other paths are still served")
+
+			req, _ = http.NewRequest("POST", "/", nil)
+			req.Host = host
+			w = httptest.NewRecorder()
+			engine.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusNotFound, w.Code)
+		})
+	}
+}
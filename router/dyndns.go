@@ -0,0 +1,99 @@
+package router
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/dcarrillo/whatismyip/internal/setting"
+	"github.com/dcarrillo/whatismyip/service"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dyndns2 return codes
+const (
+	dynDNSGood    = "good"
+	dynDNSNoChg   = "nochg"
+	dynDNSBadAuth = "badauth"
+	dynDNSNotFQDN = "notfqdn"
+	dynDNSNoHost  = "nohost"
+	dynDNSBadIP   = "badip"
+	dynDNSError   = "911"
+)
+
+type dynDNSUser struct {
+	passwordHash []byte
+	hostnames    map[string]struct{}
+}
+
+// SetupDynDNS registers the dyndns2 compatible update endpoint, authenticated
+// users publish the addresses of their hostnames under the resolver domain
+func SetupDynDNS(r *gin.Engine, dyn *service.DynDNS) {
+	domain := strings.ToLower(strings.TrimSuffix(setting.App.Resolver.Domain, "."))
+	users := map[string]dynDNSUser{}
+	for _, u := range setting.App.Resolver.DynDNS.Users {
+		user := dynDNSUser{passwordHash: []byte(u.PasswordHash), hostnames: map[string]struct{}{}}
+		for _, h := range u.Hostnames {
+			user.hostnames[strings.ToLower(h)+"."+domain] = struct{}{}
+		}
+		users[u.Username] = user
+	}
+
+	r.GET("/nic/update", func(ctx *gin.Context) {
+		handleDynDNSUpdate(ctx, dyn, users, domain)
+	})
+}
+
+func handleDynDNSUpdate(ctx *gin.Context, dyn *service.DynDNS, users map[string]dynDNSUser, domain string) {
+	ctx.Header("Cache-Control", "no-store")
+
+	username, password, ok := ctx.Request.BasicAuth()
+	user, found := users[username]
+	if !ok || !found || bcrypt.CompareHashAndPassword(user.passwordHash, []byte(password)) != nil {
+		ctx.Header("WWW-Authenticate", `Basic realm="dyndns"`)
+		ctx.String(http.StatusUnauthorized, dynDNSBadAuth+"\n")
+		return
+	}
+
+	myip := ctx.Query("myip")
+	if myip == "" {
+		myip = ctx.ClientIP()
+	}
+	var ips []net.IP
+	for _, s := range strings.Split(myip, ",") {
+		ip := net.ParseIP(strings.TrimSpace(s))
+		if ip == nil {
+			ctx.String(http.StatusBadRequest, dynDNSBadIP+"\n")
+			return
+		}
+		ips = append(ips, ip)
+	}
+
+	var output []string
+	for _, hostname := range strings.Split(ctx.Query("hostname"), ",") {
+		hostname = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(hostname), "."))
+		if !strings.HasSuffix(hostname, "."+domain) {
+			output = append(output, dynDNSNotFQDN)
+			continue
+		}
+		if _, ok := user.hostnames[hostname]; !ok {
+			output = append(output, dynDNSNoHost)
+			continue
+		}
+
+		changed, err := dyn.Update(hostname, ips)
+		switch {
+		case err != nil:
+			log.Printf("Error updating dynamic DNS host %s: %s", hostname, err)
+			output = append(output, dynDNSError)
+		case changed:
+			output = append(output, dynDNSGood+" "+myip)
+		default:
+			output = append(output, dynDNSNoChg+" "+myip)
+		}
+	}
+
+	ctx.String(http.StatusOK, strings.Join(output, "\n")+"\n")
+}
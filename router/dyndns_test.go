@@ -0,0 +1,81 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/dcarrillo/whatismyip/internal/setting"
+	"github.com/dcarrillo/whatismyip/service"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+func TestDynDNSUpdate(t *testing.T) {
+	saved := setting.App.Resolver
+	t.Cleanup(func() { setting.App.Resolver = saved })
+	setting.App.Resolver.Domain = domain
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	require.NoError(t, yaml.Unmarshal([]byte(`
+users:
+  - username: alice
+    password_hash: `+string(hash)+`
+    hostnames: [home, office]
+`), &setting.App.Resolver.DynDNS))
+
+	dyn, err := service.NewDynDNS(filepath.Join(t.TempDir(), "dyndns.json"))
+	require.NoError(t, err)
+	engine := gin.New()
+	SetupDynDNS(engine, dyn)
+
+	tests := []struct {
+		name     string
+		query    string
+		user     string
+		password string
+		status   int
+		body     string
+	}{
+		{name: "no credentials", query: "hostname=home." + domain, status: http.StatusUnauthorized, body: "badauth\n"},
+		{name: "wrong password", query: "hostname=home." + domain, user: "alice", password: "wrong", status: http.StatusUnauthorized, body: "badauth\n"},
+		{name: "unknown user", query: "hostname=home." + domain, user: "bob", password: "secret", status: http.StatusUnauthorized, body: "badauth\n"},
+		{name: "client address", query: "hostname=home." + domain, user: "alice", password: "secret", status: http.StatusOK, body: "good 192.0.2.1\n"},
+		{name: "no change", query: "hostname=HOME." + domain + ".&myip=192.0.2.1", user: "alice", password: "secret", status: http.StatusOK, body: "nochg 192.0.2.1\n"},
+		{
+			name:     "several hosts and addresses",
+			query:    "hostname=home." + domain + ",office." + domain + "&myip=192.0.2.1,2001:db8::1",
+			user:     "alice",
+			password: "secret",
+			status:   http.StatusOK,
+			body:     "good 192.0.2.1,2001:db8::1\ngood 192.0.2.1,2001:db8::1\n",
+		},
+		{name: "host of another domain", query: "hostname=home.example.org", user: "alice", password: "secret", status: http.StatusOK, body: "notfqdn\n"},
+		{name: "host of another user", query: "hostname=lab." + domain, user: "alice", password: "secret", status: http.StatusOK, body: "nohost\n"},
+		{name: "bad address", query: "hostname=home." + domain + "&myip=bad", user: "alice", password: "secret", status: http.StatusBadRequest, body: "badip\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/nic/update?"+tt.query, nil)
+			req.RemoteAddr = "192.0.2.1:1000"
+			if tt.user != "" {
+				req.SetBasicAuth(tt.user, tt.password)
+			}
+			w := httptest.NewRecorder()
+			engine.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.status, w.Code)
+			assert.Equal(t, tt.body, w.Body.String())
+		})
+	}
+
+	h, ok := dyn.Lookup("office." + domain)
+	require.True(t, ok)
+	assert.Equal(t, "192.0.2.1", h.IPv4.String())
+	assert.Equal(t, "2001:db8::1", h.IPv6.String())
+}
@@ -3,7 +3,6 @@ package router
 import (
 	"net"
 	"net/http"
-	"path/filepath"
 
 	"github.com/dcarrillo/whatismyip/internal/httputils"
 	"github.com/dcarrillo/whatismyip/internal/setting"
@@ -22,6 +21,13 @@ type GeoResponse struct {
 	ASNOrganization string  `json:"asn_organization,omitempty"`
 }
 
+// homePageData is the data of the landing page template, DNSDiscoveryURL is the
+// URL of a new discovery token, fetched by the page to find out the resolver
+type homePageData struct {
+	JSONResponse
+	DNSDiscoveryURL string
+}
+
 type JSONResponse struct {
 	IP         string      `json:"ip"`
 	IPVersion  byte        `json:"ip_version"`
@@ -31,14 +37,13 @@ type JSONResponse struct {
 	GeoResponse
 }
 
-func getRoot(ctx *gin.Context) {
+func getRoot(ctx *gin.Context, templateName string, discovery *DiscoveryIssuer) {
 	switch ctx.NegotiateFormat(gin.MIMEPlain, gin.MIMEHTML, gin.MIMEJSON) {
 	case gin.MIMEHTML:
-		name := "home"
-		if setting.App.TemplatePath != "" {
-			name = filepath.Base(setting.App.TemplatePath)
-		}
-		ctx.HTML(http.StatusOK, name, jsonOutput(ctx))
+		ctx.HTML(http.StatusOK, templateName, homePageData{
+			JSONResponse:    jsonOutput(ctx),
+			DNSDiscoveryURL: discovery.url(ctx),
+		})
 	case gin.MIMEJSON:
 		getJSON(ctx)
 	default:
@@ -3,6 +3,7 @@ package router
 import (
 	"html/template"
 	"log"
+	"path/filepath"
 
 	"github.com/dcarrillo/whatismyip/internal/setting"
 	"github.com/dcarrillo/whatismyip/service"
@@ -11,29 +12,65 @@ import (
 
 var geoSvc *service.Geo
 
+// Features enables or disables groups of routes on a virtual host
+type Features struct {
+	DisableTCPScan bool
+	DisableGeo     bool
+	DisableHeaders bool
+}
+
 func SetupTemplate(r *gin.Engine) {
-	if setting.App.TemplatePath == "" {
-		t, _ := template.New("home").Parse(home)
-		r.SetHTMLTemplate(t)
+	setupTemplate(r, setting.App.TemplatePath)
+}
+
+// Setup registers the routes of the default host, its landing page runs the
+// DNS discovery of discovery unless it is nil
+func Setup(r *gin.Engine, geo *service.Geo, discovery *DiscoveryIssuer) {
+	setupRoutes(r, geo, setting.App.TemplatePath, Features{DisableTCPScan: setting.App.DisableTCPScan}, discovery)
+}
+
+// SetupVirtualHost loads the template and registers the routes of a virtual
+// host with its own template and feature set
+func SetupVirtualHost(r *gin.Engine, geo *service.Geo, templatePath string, features Features, discovery *DiscoveryIssuer) {
+	setupTemplate(r, templatePath)
+	setupRoutes(r, geo, templatePath, features, discovery)
+}
+
+func setupTemplate(r *gin.Engine, path string) {
+	var t *template.Template
+	if path == "" {
+		t = template.Must(template.New("home").Parse(home))
 	} else {
-		log.Printf("Template %s has been loaded", setting.App.TemplatePath)
-		r.LoadHTMLFiles(setting.App.TemplatePath)
+		t = template.Must(template.ParseFiles(path))
+		log.Printf("Template %s has been loaded", path)
 	}
+	r.SetHTMLTemplate(template.Must(t.New("stack").Parse(stack)))
 }
 
-func Setup(r *gin.Engine, geo *service.Geo) {
+func setupRoutes(r *gin.Engine, geo *service.Geo, templatePath string, features Features, discovery *DiscoveryIssuer) {
 	geoSvc = geo
-	r.GET("/", getRoot)
-	if !setting.App.DisableTCPScan {
+
+	templateName := "home"
+	if templatePath != "" {
+		templateName = filepath.Base(templatePath)
+	}
+	r.GET("/", func(ctx *gin.Context) {
+		getRoot(ctx, templateName, discovery)
+	})
+	if !features.DisableTCPScan {
 		r.GET("/scan/tcp/:port", scanTCPPort)
 	}
 	r.GET("/client-port", getClientPortAsString)
-	r.GET("/geo", getGeoAsString)
-	r.GET("/geo/:field", getGeoAsString)
-	r.GET("/asn", getASNAsString)
-	r.GET("/asn/:field", getASNAsString)
-	r.GET("/headers", getHeadersAsSortedString)
+	if !features.DisableGeo {
+		r.GET("/geo", getGeoAsString)
+		r.GET("/geo/:field", getGeoAsString)
+		r.GET("/asn", getASNAsString)
+		r.GET("/asn/:field", getASNAsString)
+	}
 	r.GET("/all", getAllAsString)
 	r.GET("/json", getJSON)
-	r.GET("/:header", getHeaderAsString)
+	if !features.DisableHeaders {
+		r.GET("/headers", getHeadersAsSortedString)
+		r.GET("/:header", getHeaderAsString)
+	}
 }
@@ -4,7 +4,9 @@ import (
 	"context"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/dcarrillo/whatismyip/internal/validator"
 	"github.com/dcarrillo/whatismyip/service"
 	"github.com/gin-gonic/gin"
 )
@@ -23,8 +25,9 @@ type contentTypes struct {
 }
 
 var (
-	app    *gin.Engine
-	testIP = testIPs{
+	app           *gin.Engine
+	testTokens, _ = validator.NewTokens([]byte("test-secret-test-secret"), time.Hour)
+	testIP        = testIPs{
 		ipv4:    "81.2.69.192",
 		ipv4ASN: "82.99.17.64",
 		ipv6:    "2a02:9000::1",
@@ -37,8 +40,18 @@ var (
 	}
 	jsonIPv4     = `{"client_port":"1001","ip":"81.2.69.192","ip_version":4,"country":"United Kingdom","country_code":"GB","city":"London","latitude":51.5142,"longitude":-0.0931,"time_zone":"Europe/London","host":"test", "headers": {}}`
 	jsonIPv6     = `{"asn":3352,"asn_organization":"TELEFONICA DE ESPANA","client_port":"1001","host":"test","ip":"2a02:9000::1","ip_version":6,"headers": {}}`
-	jsonDNSIPv4  = `{"dns":{"ip":"81.2.69.192","country":"United Kingdom"}}`
-	plainDNSIPv4 = "81.2.69.192 (United Kingdom / )\n"
+	jsonDNSIPv4  = `{"dns":[{"ip":"81.2.69.192","hits":2,"query_types":["A","AAAA"],"transport":"udp","client_subnet":"192.0.2.0/24","edns":true,"udp_size":1232,"dnssec_ok":true,"client_cookie":true,"server_cookie":true,"case_randomization":true,"time":"2025-01-01T00:00:00Z","country":"United Kingdom"}],"dnssec_validation":"untested"}`
+	plainDNSIPv4 = `81.2.69.192 (United Kingdom / )
+Hits: 2 (A, AAAA)
+Transport: udp
+Client Subnet: 192.0.2.0/24
+EDNS Buffer Size: 1232
+DNSSEC OK: true
+Client Cookie: true
+Server Cookie: true
+Case Randomization (0x20): true
+Time: 2025-01-01T00:00:00Z
+`
 )
 
 const (
@@ -51,7 +64,7 @@ func TestMain(m *testing.M) {
 	app = gin.Default()
 	app.TrustedPlatform = trustedHeader
 	svc, _ := service.NewGeo(context.Background(), "../test/GeoIP2-City-Test.mmdb", "../test/GeoLite2-ASN-Test.mmdb")
-	Setup(app, svc)
+	Setup(app, svc, nil)
 
 	os.Exit(m.Run())
 }
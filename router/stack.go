@@ -0,0 +1,272 @@
+package router
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dcarrillo/whatismyip/internal/validator"
+	"github.com/dcarrillo/whatismyip/service"
+	"github.com/gin-gonic/gin"
+)
+
+// StackTestHosts holds the hostnames (labels under Domain) used by the
+// dual-stack connectivity test, their URLs are built as the ones of the DNS
+// discovery redirect
+type StackTestHosts struct {
+	Domain    string
+	Redirect  DiscoveryRedirect
+	IPv4      string
+	IPv6      string
+	DualStack string
+}
+
+type StackJSONResponse struct {
+	Stack stackData `json:"stack"`
+}
+
+type stackData struct {
+	Token       string       `json:"token"`
+	IPv4        string       `json:"ipv4,omitempty"`
+	IPv6        string       `json:"ipv6,omitempty"`
+	DualStack   string       `json:"dual_stack,omitempty"`
+	PrefersIPv6 bool         `json:"prefers_ipv6"`
+	Timing      *stackTiming `json:"timing,omitempty"`
+}
+
+// stackTiming is measured by the client (the browser) and sent along with the
+// result request, the server cannot see the connection attempts that failed or
+// were discarded by Happy Eyeballs
+type stackTiming struct {
+	IPv4               float64 `json:"ipv4_ms,omitempty"`
+	IPv6               float64 `json:"ipv6_ms,omitempty"`
+	DualStack          float64 `json:"dual_stack_ms,omitempty"`
+	HappyEyeballsDelay float64 `json:"happy_eyeballs_delay_ms"`
+}
+
+type stackResult struct {
+	IPv4      string
+	IPv6      string
+	DualStack string
+}
+
+type stackPageData struct {
+	Token        string
+	IPv4URL      string
+	IPv6URL      string
+	DualStackURL string
+}
+
+const stackKeyPrefix = "stack-"
+
+// handleStackHost records the address a client used to reach one of the stack
+// test hostnames, served along with the DNS discovery under *.<domain>.
+// Requests to <token>-<label>.<domain> are correlated by the token so that a
+// single result holds both addresses. They come from another address than the
+// one the token was issued to, so only its signature is checked.
+func handleStackHost(ctx *gin.Context, store service.DiscoveryStore, hosts StackTestHosts, label string, token string) {
+	ctx.Header("Access-Control-Allow-Origin", "*")
+	ctx.Header("Cache-Control", "no-store")
+	ip := ctx.ClientIP()
+	if token != "" {
+		recordStackObservation(store, token, label, hosts, ip)
+	}
+
+	switch ctx.NegotiateFormat(gin.MIMEPlain, gin.MIMEJSON) {
+	case gin.MIMEJSON:
+		ctx.JSON(http.StatusOK, gin.H{"ip": ip, "ip_version": ipVersion(net.ParseIP(ip))})
+	default:
+		ctx.String(http.StatusOK, ip+"\n")
+	}
+}
+
+// SetupStackTest registers the landing page of the test, which hands out a
+// token, and the result endpoint, which is only served to the client the
+// token was issued to
+func SetupStackTest(r *gin.Engine, store service.DiscoveryStore, tokens *validator.Tokens, hosts StackTestHosts) {
+	r.GET("/stack", func(ctx *gin.Context) {
+		getStackPage(ctx, tokens, hosts)
+	})
+	r.GET("/stack/:token", func(ctx *gin.Context) {
+		getStackResult(ctx, store, tokens)
+	})
+}
+
+// match reports whether host is one of the stack test hostnames, either bare
+// (<label>.<domain>) or prefixed by a token (<token>-<label>.<domain>) so that
+// the certificate of *.<domain> covers it
+func (h *StackTestHosts) match(host string, tokens *validator.Tokens) (label string, token string, ok bool) {
+	if h == nil {
+		return "", "", false
+	}
+	rel, found := strings.CutSuffix(normalizeHost(host), "."+normalizeHost(h.Domain))
+	if !found || strings.Contains(rel, ".") {
+		return "", "", false
+	}
+
+	label = rel
+	if t, l, found := strings.Cut(rel, "-"); found && tokens.Valid(t) {
+		label, token = l, t
+	}
+	for _, l := range []string{h.IPv4, h.IPv6, h.DualStack} {
+		if label == strings.ToLower(l) {
+			return label, token, true
+		}
+	}
+
+	return "", "", false
+}
+
+// url returns the URL of the hostname of label prefixed by token, for req
+func (h StackTestHosts) url(req *http.Request, token string, label string) string {
+	return h.Redirect.url(req, token+"-"+label+"."+h.Domain) + "/"
+}
+
+func recordStackObservation(store service.DiscoveryStore, token, label string, hosts StackTestHosts, ip string) {
+	result := stackResult{}
+	err := store.Update(stackKeyPrefix+token, ip, &result, func() {
+		switch label {
+		case strings.ToLower(hosts.IPv4):
+			result.IPv4 = ip
+		case strings.ToLower(hosts.IPv6):
+			result.IPv6 = ip
+		case strings.ToLower(hosts.DualStack):
+			result.DualStack = ip
+		}
+	})
+	if err != nil {
+		log.Printf("Error recording stack test %s: %s", token, err)
+	}
+}
+
+func getStackPage(ctx *gin.Context, tokens *validator.Tokens, hosts StackTestHosts) {
+	token := tokens.New(ctx.ClientIP())
+	page := stackPageData{
+		Token:        token,
+		IPv4URL:      hosts.url(ctx.Request, token, hosts.IPv4),
+		IPv6URL:      hosts.url(ctx.Request, token, hosts.IPv6),
+		DualStackURL: hosts.url(ctx.Request, token, hosts.DualStack),
+	}
+
+	switch ctx.NegotiateFormat(gin.MIMEPlain, gin.MIMEHTML, gin.MIMEJSON) {
+	case gin.MIMEHTML:
+		ctx.HTML(http.StatusOK, "stack", page)
+	case gin.MIMEJSON:
+		ctx.JSON(http.StatusOK, gin.H{
+			"token": token,
+			"urls": gin.H{
+				"ipv4":       page.IPv4URL,
+				"ipv6":       page.IPv6URL,
+				"dual_stack": page.DualStackURL,
+			},
+		})
+	default:
+		ctx.String(http.StatusOK, fmt.Sprintf(
+			"curl %s\ncurl %s\ncurl %s\ncurl %s/stack/%s\n",
+			page.IPv4URL, page.IPv6URL, page.DualStackURL,
+			hosts.Redirect.url(ctx.Request, normalizeHost(ctx.Request.Host)), token,
+		))
+	}
+}
+
+func getStackResult(ctx *gin.Context, store service.DiscoveryStore, tokens *validator.Tokens) {
+	token := strings.ToLower(ctx.Params.ByName("token"))
+	if !tokens.ValidFor(token, ctx.ClientIP()) {
+		ctx.String(http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		return
+	}
+
+	result := stackResult{}
+	found, err := store.Get(stackKeyPrefix+token, &result)
+	if err != nil {
+		log.Printf("Error reading stack test %s: %s", token, err)
+		ctx.String(http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable))
+		return
+	}
+	if !found {
+		ctx.String(http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		return
+	}
+
+	j := StackJSONResponse{
+		Stack: stackData{
+			Token:       token,
+			IPv4:        result.IPv4,
+			IPv6:        result.IPv6,
+			DualStack:   result.DualStack,
+			PrefersIPv6: ipVersion(net.ParseIP(result.DualStack)) == 6,
+			Timing:      parseStackTiming(ctx),
+		},
+	}
+
+	switch ctx.NegotiateFormat(gin.MIMEPlain, gin.MIMEHTML, gin.MIMEJSON) {
+	case gin.MIMEJSON:
+		ctx.JSON(http.StatusOK, j)
+	default:
+		ctx.String(http.StatusOK, stackToString(j.Stack))
+	}
+}
+
+func parseStackTiming(ctx *gin.Context) *stackTiming {
+	parse := func(key string) float64 {
+		v, err := strconv.ParseFloat(ctx.Query(key), 64)
+		if err != nil || v < 0 {
+			return 0
+		}
+		return v
+	}
+
+	t := &stackTiming{
+		IPv4:      parse("ipv4_ms"),
+		IPv6:      parse("ipv6_ms"),
+		DualStack: parse("dual_stack_ms"),
+	}
+	if t.IPv4 == 0 && t.IPv6 == 0 && t.DualStack == 0 {
+		return nil
+	}
+
+	// the dual-stack request should take as long as the fastest family, any
+	// extra time is spent racing or falling back between families
+	fastest := t.IPv4
+	if fastest == 0 || (t.IPv6 > 0 && t.IPv6 < fastest) {
+		fastest = t.IPv6
+	}
+	if t.DualStack > fastest && fastest > 0 {
+		t.HappyEyeballsDelay = t.DualStack - fastest
+	}
+
+	return t
+}
+
+func stackToString(s stackData) string {
+	none := func(v string) string {
+		if v == "" {
+			return "not reachable"
+		}
+		return v
+	}
+
+	output := "IPv4: " + none(s.IPv4) + "\n"
+	output += "IPv6: " + none(s.IPv6) + "\n"
+	output += "Dual stack: " + none(s.DualStack) + "\n"
+	output += fmt.Sprintf("Prefers IPv6: %t\n", s.PrefersIPv6)
+	if s.Timing != nil {
+		output += fmt.Sprintf("Happy Eyeballs delay: %.1fms\n", s.Timing.HappyEyeballsDelay)
+	}
+
+	return output
+}
+
+func ipVersion(ip net.IP) byte {
+	switch {
+	case ip == nil:
+		return 0
+	case ip.To4() != nil:
+		return 4
+	default:
+		return 6
+	}
+}
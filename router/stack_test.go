@@ -0,0 +1,157 @@
+package router
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dcarrillo/whatismyip/service"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var stackHosts = StackTestHosts{
+	Domain:    domain,
+	IPv4:      "v4",
+	IPv6:      "v6",
+	DualStack: "ds",
+}
+
+func TestStackHostsMatch(t *testing.T) {
+	u := testTokens.New(testIP.ipv4)
+
+	tests := []struct {
+		host  string
+		label string
+		token string
+		ok    bool
+	}{
+		{host: "v4." + domain, label: "v4", ok: true},
+		{host: u + "-v6." + domain + ":8000", label: "v6", token: u, ok: true},
+		{host: u + "-DS." + domain, label: "ds", token: u, ok: true},
+		{host: u + ".v4." + domain},
+		{host: "not-a-token-v4." + domain},
+		{host: u + "-v5." + domain},
+		{host: "v5." + domain},
+		{host: domain},
+		{host: "v4.example.org"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			label, token, ok := stackHosts.match(tt.host, testTokens)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.label, label)
+			assert.Equal(t, tt.token, token)
+		})
+	}
+}
+
+func TestStackTestFlow(t *testing.T) {
+	store := service.NewMemoryDiscoveryStore(time.Minute, 1000, 0)
+	hostsEngine := gin.New()
+	SetupDNSDiscovery(hostsEngine, store, NewDiscoveryIssuer(testTokens, domain, DiscoveryRedirect{}), &stackHosts)
+	u := testTokens.New(testIP.ipv4)
+
+	for _, obs := range []struct {
+		label string
+		ip    string
+	}{
+		{"v4", testIP.ipv4},
+		{"v6", testIP.ipv6},
+		{"ds", testIP.ipv6},
+	} {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Host = u + "-" + obs.label + "." + domain
+		req.RemoteAddr = net.JoinHostPort(obs.ip, "1000")
+
+		w := httptest.NewRecorder()
+		hostsEngine.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, obs.ip+"\n", w.Body.String())
+		assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+	}
+
+	engine := gin.New()
+	SetupStackTest(engine, store, testTokens, stackHosts)
+
+	req, _ := http.NewRequest("GET", "/stack/"+u+"?ipv4_ms=30&ipv6_ms=20&dual_stack_ms=25", nil)
+	req.Header.Set("Accept", "application/json")
+	req.RemoteAddr = net.JoinHostPort(testIP.ipv4, "1000")
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	j := StackJSONResponse{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &j))
+	assert.Equal(t, testIP.ipv4, j.Stack.IPv4)
+	assert.Equal(t, testIP.ipv6, j.Stack.IPv6)
+	assert.Equal(t, testIP.ipv6, j.Stack.DualStack)
+	assert.True(t, j.Stack.PrefersIPv6)
+	require.NotNil(t, j.Stack.Timing)
+	assert.Equal(t, 5.0, j.Stack.Timing.HappyEyeballsDelay)
+
+	req, _ = http.NewRequest("GET", "/stack/"+u, nil)
+	req.RemoteAddr = net.JoinHostPort("198.51.100.1", "1000")
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code, "the result is only served to the network the token was issued to")
+
+	req, _ = http.NewRequest("GET", "/stack/"+testTokens.New(testIP.ipv4), nil)
+	req.RemoteAddr = net.JoinHostPort(testIP.ipv4, "1000")
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestStackPage(t *testing.T) {
+	engine := gin.New()
+	SetupTemplate(engine)
+	SetupStackTest(engine, service.NewMemoryDiscoveryStore(time.Minute, 1000, 0), testTokens, stackHosts)
+
+	req, _ := http.NewRequest("GET", "/stack", nil)
+	req.Header.Set("Accept", "text/html")
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "-v6."+domain)
+}
+
+func TestStackPageURLs(t *testing.T) {
+	hosts := stackHosts
+	hosts.Redirect = DiscoveryRedirect{Scheme: "https"}
+	engine := gin.New()
+	SetupStackTest(engine, service.NewMemoryDiscoveryStore(time.Minute, 1000, 0), testTokens, hosts)
+
+	req, _ := http.NewRequest("GET", "/stack", nil)
+	req.Host = "ifconfig.example.com:8080"
+	req.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	j := struct {
+		Token string            `json:"token"`
+		URLs  map[string]string `json:"urls"`
+	}{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &j))
+	assert.Equal(t, map[string]string{
+		"ipv4":       "https://" + j.Token + "-v4." + domain + "/",
+		"ipv6":       "https://" + j.Token + "-v6." + domain + "/",
+		"dual_stack": "https://" + j.Token + "-ds." + domain + "/",
+	}, j.URLs)
+
+	req.Header.Set("Accept", "text/plain")
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Regexp(t, "^curl https://[a-z0-9]+-v4."+domain+"/\n", w.Body.String())
+	assert.Regexp(t, "\ncurl https://ifconfig.example.com/stack/[a-z0-9]+\n$", w.Body.String())
+}
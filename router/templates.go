@@ -40,6 +40,157 @@ const home = `
     {{- end}}
 {{- end }}
     </table>
+{{- if .DNSDiscoveryURL }}
+    <h3> DNS Resolver </h3>
+    <table id="dns">
+        <tr> <td> testing... </td> </tr>
+    </table>
+    <script>
+        function render(resolvers) {
+            const table = document.getElementById("dns");
+            table.replaceChildren();
+            for (const r of resolvers) {
+                for (const [k, v] of [["IP", r.ip], ["Country", r.country], ["Provider", r.provider]]) {
+                    const row = table.insertRow();
+                    row.insertCell().textContent = k;
+                    row.insertCell().textContent = v || "";
+                }
+            }
+        }
+        async function discover(attempt) {
+            try {
+                const resp = await fetch("{{ .DNSDiscoveryURL }}", { headers: { Accept: "application/json" }, cache: "no-store" });
+                if (resp.ok) {
+                    render((await resp.json()).dns);
+                    return;
+                }
+            } catch (e) {}
+            if (attempt < 5) {
+                setTimeout(() => discover(attempt + 1), 1000);
+            } else {
+                document.getElementById("dns").rows[0].cells[0].textContent = "not available";
+            }
+        }
+        discover(0);
+    </script>
+{{- end }}
+</body>
+</html>
+`
+
+const stack = `
+<!DOCTYPE html>
+<html>
+
+<head>
+    <meta charset="utf-8">
+    <title>IPv4 / IPv6 connectivity test</title>
+</head>
+
+<body>
+    <h1>IPv4 / IPv6 connectivity test</h1>
+    <hr />
+    <table>
+        <tr> <td> IPv4             </td> <td id="ipv4"> testing... </td> </tr>
+        <tr> <td> IPv6             </td> <td id="ipv6"> testing... </td> </tr>
+        <tr> <td> Dual stack       </td> <td id="dual_stack"> testing... </td> </tr>
+        <tr> <td> Prefers IPv6     </td> <td id="prefers_ipv6"> </td> </tr>
+        <tr> <td> Happy Eyeballs   </td> <td id="happy_eyeballs"> </td> </tr>
+    </table>
+    <script>
+        const token = "{{ .Token }}";
+        async function probe(url) {
+            const start = performance.now();
+            try {
+                await fetch(url, { cache: "no-store" });
+                return performance.now() - start;
+            } catch (e) {
+                return null;
+            }
+        }
+        (async () => {
+            const [ipv4, ipv6, dualStack] = await Promise.all([
+                probe("{{ .IPv4URL }}"), probe("{{ .IPv6URL }}"), probe("{{ .DualStackURL }}")
+            ]);
+            const query = new URLSearchParams();
+            for (const [k, v] of [["ipv4_ms", ipv4], ["ipv6_ms", ipv6], ["dual_stack_ms", dualStack]]) {
+                if (v !== null) query.set(k, v.toFixed(1));
+            }
+            const resp = await fetch("/stack/" + token + "?" + query, { headers: { Accept: "application/json" } });
+            const result = resp.ok ? (await resp.json()).stack : {};
+            for (const k of ["ipv4", "ipv6", "dual_stack"]) {
+                document.getElementById(k).textContent = result[k] || "not reachable";
+            }
+            document.getElementById("prefers_ipv6").textContent = result.prefers_ipv6 ? "yes" : "no";
+            if (result.timing) {
+                document.getElementById("happy_eyeballs").textContent = result.timing.happy_eyeballs_delay_ms.toFixed(1) + " ms";
+            }
+        })();
+    </script>
+</body>
+</html>
+`
+
+const dnsPage = `
+<!DOCTYPE html>
+<html>
+
+<head>
+    <meta charset="utf-8">
+    <title>What is my DNS resolver ?</title>
+</head>
+
+<body>
+    <h1>What is my DNS resolver ?</h1>
+    <hr />
+{{- range .DNS }}
+    <h3> {{ .IP }} </h3>
+    <table>
+        <tr> <td> Country          </td> <td> {{ .Country }} </td> </tr>
+        <tr> <td> Provider         </td> <td> {{ .AsnOrganization }} </td> </tr>
+        <tr> <td> Hits             </td> <td> {{ .Hits }} ({{ range $i, $t := .QueryTypes }}{{ if $i }}, {{ end }}{{ $t }}{{ end }}) </td> </tr>
+        <tr> <td> Transport        </td> <td> {{ .Transport }} </td> </tr>
+        <tr> <td> Client Subnet    </td> <td> {{ .ClientSubnet }} </td> </tr>
+        <tr> <td> EDNS Buffer Size </td> <td> {{ .UDPSize }} </td> </tr>
+        <tr> <td> DNSSEC OK        </td> <td> {{ .DNSSECOK }} </td> </tr>
+    </table>
+{{- end }}
+    <h3> DNSSEC validation </h3>
+    <p id="dnssec_validation"> testing... </p>
+    <h3> Resolver capabilities </h3>
+    <table>
+        <tr> <td> TCP fallback       </td> <td id="tcp_fallback"> testing... </td> </tr>
+        <tr> <td> Large response     </td> <td id="large_response"> testing... </td> </tr>
+        <tr> <td> IPv6 transport     </td> <td id="ipv6_transport"> testing... </td> </tr>
+        <tr> <td> QNAME minimisation </td> <td id="qname_minimisation"> testing... </td> </tr>
+    </table>
+    <script>
+        // the probes and the bogus host are requested as images, the resolver
+        // records what it learns when it resolves them
+        function load(url) {
+            return new Promise((resolve) => {
+                const img = new Image();
+                img.onload = () => resolve("loaded");
+                img.onerror = () => resolve("failed");
+                img.src = url;
+                setTimeout(() => resolve("timeout"), 5000);
+            });
+        }
+        function show(j) {
+            document.getElementById("dnssec_validation").textContent = j.dnssec_validation || "untested";
+            for (const k of ["tcp_fallback", "large_response", "ipv6_transport", "qname_minimisation"]) {
+                document.getElementById(k).textContent = (j.probes || {})[k] || "untested";
+            }
+        }
+        // only a failed request to the bogus host, not a timeout, tells
+        // that the resolver rejected it
+        Promise.all({{ .ProbeURLs }}.concat([{{ .BogusURL }}]).map(load))
+            .then((results) => results.pop() === "failed" ? "/?bogus=failed" : "/")
+            .then((url) => fetch(url, { headers: { Accept: "application/json" }, cache: "no-store" }))
+            .then((resp) => resp.json())
+            .then(show)
+            .catch(() => show({}));
+    </script>
 </body>
 </html>
 `
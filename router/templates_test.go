@@ -81,8 +81,22 @@ func TestDefaultTemplate(t *testing.T) {
 	}
 
 	buf := &bytes.Buffer{}
-	err := tmpl.Execute(buf, response)
+	err := tmpl.Execute(buf, homePageData{JSONResponse: response})
 
 	assert.Nil(t, err)
 	assert.Equal(t, expectedHome, buf.String())
 }
+
+func TestDefaultTemplateDNSDiscovery(t *testing.T) {
+	tmpl, _ := template.New("home").Parse(home)
+
+	buf := &bytes.Buffer{}
+	err := tmpl.Execute(buf, homePageData{
+		JSONResponse:    JSONResponse{IP: "127.0.0.1", IPVersion: 4},
+		DNSDiscoveryURL: "https://token.dns.example.com/",
+	})
+
+	assert.Nil(t, err)
+	assert.Contains(t, buf.String(), `<table id="dns">`)
+	assert.Contains(t, buf.String(), `fetch("https:\/\/token.dns.example.com\/"`)
+}
@@ -0,0 +1,92 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// VirtualHosts dispatches every request to the handler registered for its Host
+// header. Hostnames are matched exactly first, then against wildcards
+// (*.example.com), the most specific wildcard wins. Requests matching no host
+// are served by the fallback handler.
+type VirtualHosts struct {
+	exact     map[string]http.Handler
+	wildcards []wildcardHost
+	fallback  http.Handler
+}
+
+type wildcardHost struct {
+	suffix  string
+	handler http.Handler
+}
+
+func NewVirtualHosts(fallback http.Handler) *VirtualHosts {
+	return &VirtualHosts{
+		exact:    map[string]http.Handler{},
+		fallback: fallback,
+	}
+}
+
+// Add registers handler for pattern, either a hostname or a wildcard in the
+// form *.example.com. A wildcard matches any number of labels but not the
+// bare domain.
+func (v *VirtualHosts) Add(pattern string, handler http.Handler) error {
+	host := normalizeHost(pattern)
+	if suffix, found := strings.CutPrefix(host, "*."); found {
+		if suffix == "" || strings.Contains(suffix, "*") {
+			return fmt.Errorf("invalid virtual host %q", pattern)
+		}
+		for _, w := range v.wildcards {
+			if w.suffix == "."+suffix {
+				return fmt.Errorf("virtual host %q already registered", pattern)
+			}
+		}
+		v.wildcards = append(v.wildcards, wildcardHost{suffix: "." + suffix, handler: handler})
+		sort.SliceStable(v.wildcards, func(i, j int) bool {
+			return len(v.wildcards[i].suffix) > len(v.wildcards[j].suffix)
+		})
+		return nil
+	}
+
+	if host == "" || strings.Contains(host, "*") {
+		return fmt.Errorf("invalid virtual host %q", pattern)
+	}
+	if _, ok := v.exact[host]; ok {
+		return fmt.Errorf("virtual host %q already registered", pattern)
+	}
+	v.exact[host] = handler
+
+	return nil
+}
+
+// Match returns the handler that serves host
+func (v *VirtualHosts) Match(host string) http.Handler {
+	host = normalizeHost(host)
+	if h, ok := v.exact[host]; ok {
+		return h
+	}
+	for _, w := range v.wildcards {
+		if len(host) > len(w.suffix) && strings.HasSuffix(host, w.suffix) {
+			return w.handler
+		}
+	}
+
+	return v.fallback
+}
+
+func (v *VirtualHosts) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v.Match(r.Host).ServeHTTP(w, r)
+}
+
+// normalizeHost strips the port and the trailing dot (if any) from host and
+// lowercases it
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
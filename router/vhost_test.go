@@ -0,0 +1,68 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func namedHandler(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(name))
+	})
+}
+
+func TestVirtualHosts(t *testing.T) {
+	vhosts := NewVirtualHosts(namedHandler("default"))
+	require.NoError(t, vhosts.Add(domain, namedHandler("apex")))
+	require.NoError(t, vhosts.Add("*."+domain, namedHandler("wildcard")))
+	require.NoError(t, vhosts.Add("*.v4."+domain, namedHandler("v4")))
+	require.NoError(t, vhosts.Add("ifconfig.es", namedHandler("ifconfig")))
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{host: domain, want: "apex"},
+		{host: "DNS.Example.com:8000", want: "apex"},
+		{host: domain + ".", want: "apex"},
+		{host: "uuid." + domain, want: "wildcard"},
+		{host: "a.b." + domain + ":8080", want: "wildcard"},
+		{host: "uuid.v4." + domain, want: "v4"},
+		{host: "v4." + domain, want: "wildcard"},
+		{host: "evildns.example.com", want: "default"},
+		{host: "evil" + domain, want: "default"},
+		{host: domain + ".evil.com", want: "default"},
+		{host: "ifconfig.es:443", want: "ifconfig"},
+		{host: "127.0.0.1:8080", want: "default"},
+		{host: "[::1]:8080", want: "default"},
+		{host: "", want: "default"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/", nil)
+			req.Host = tt.host
+
+			w := httptest.NewRecorder()
+			vhosts.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.want, w.Body.String())
+		})
+	}
+}
+
+func TestVirtualHostsAddErrors(t *testing.T) {
+	vhosts := NewVirtualHosts(namedHandler("default"))
+	require.NoError(t, vhosts.Add(domain, namedHandler("apex")))
+	require.NoError(t, vhosts.Add("*."+domain, namedHandler("wildcard")))
+
+	for _, pattern := range []string{domain, "*." + domain, "", "*.", "a.*.example.com", "*.*.example.com"} {
+		t.Run(pattern, func(t *testing.T) {
+			assert.Error(t, vhosts.Add(pattern, namedHandler("error")))
+		})
+	}
+}
@@ -2,47 +2,204 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"log"
+	"net"
 	"strconv"
+	"time"
 
+	"github.com/dcarrillo/whatismyip/internal/cookie"
+	"github.com/dcarrillo/whatismyip/internal/dnstap"
+	"github.com/dcarrillo/whatismyip/internal/rrl"
+	"github.com/dcarrillo/whatismyip/internal/setting"
 	"github.com/miekg/dns"
 )
 
-const port = 53
+const (
+	port    = 53
+	tlsPort = 853
+)
 
 type DNS struct {
-	server  *dns.Server
-	handler *dns.Handler
+	servers []*dns.Server
+	handler dns.Handler
+	tap     *dnstap.Tap
 	ctx     context.Context
 }
 
+type dnsListener struct {
+	network   string
+	address   string
+	tlsConfig *tls.Config
+}
+
+// NewDNSServer wraps handler with the response rate limiting, the cookies and
+// dnstap. The wrapped handler is built once, it is kept across reloads and
+// shared with DNS over HTTPS.
 func NewDNSServer(ctx context.Context, handler dns.Handler) *DNS {
-	return &DNS{
-		handler: &handler,
-		ctx:     ctx,
+	d := &DNS{ctx: ctx}
+	d.handler = d.wrap(handler)
+
+	return d
+}
+
+// Handler returns the wrapped handler that answers the queries
+func (d *DNS) Handler() dns.Handler {
+	return d.handler
+}
+
+func (d *DNS) wrap(handler dns.Handler) dns.Handler {
+	if rl := setting.App.Resolver.RRL; rl.Enabled() {
+		// the names the handler synthesizes, if it tells them, share a rate
+		var synthesized func(string) bool
+		if s, ok := handler.(interface{ Synthesized(string) bool }); ok {
+			synthesized = s.Synthesized
+		}
+		handler = rrl.Handler(handler, rrl.New(rrl.Config{
+			ResponsesPerSecond: rl.ResponsesPerSecond,
+			NodataPerSecond:    rl.NodataPerSecond,
+			NXDomainsPerSecond: rl.NXDomainsPerSecond,
+			ReferralsPerSecond: rl.ReferralsPerSecond,
+			ErrorsPerSecond:    rl.ErrorsPerSecond,
+			Window:             rl.Window,
+			Slip:               rl.SlipRate(),
+			IPv4PrefixLength:   rl.IPv4PrefixLength,
+			IPv6PrefixLength:   rl.IPv6PrefixLength,
+			Zone:               setting.App.Resolver.Domain,
+			Synthesized:        synthesized,
+			MaxBuckets:         rl.MaxTableSize,
+		}))
+		log.Printf("DNS response rate limiting enabled, %d responses per second", rl.ResponsesPerSecond)
+	}
+
+	// the cookies wrap the rate limiter, which does not limit the clients that
+	// sent a valid server cookie
+	cookies, err := cookie.New(cookie.Config{
+		Secret:   setting.App.Resolver.Cookies.SecretBytes(),
+		Rotation: time.Duration(setting.App.Resolver.Cookies.Rotation) * time.Second,
+	})
+	if err != nil {
+		log.Fatal(err)
 	}
+	handler = cookie.Handler(handler, cookies)
+
+	// dnstap wraps the other handlers so that it logs the responses actually
+	// sent. Its output is opened once, opening the file again would truncate it.
+	if dt := setting.App.Resolver.Dnstap; dt.Enabled() {
+		tap, err := dnstap.New(dnstap.Config{
+			Socket:   dt.Socket,
+			File:     dt.File,
+			Identity: dt.Identity,
+			Zone:     setting.App.Resolver.Domain,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		d.tap = tap
+		handler = tap.Handler(handler)
+		log.Printf("DNS dnstap output enabled to %s%s", dt.Socket, dt.File)
+	}
+
+	return handler
 }
 
 func (d *DNS) Start() {
-	d.server = &dns.Server{
-		Addr:    ":" + strconv.Itoa(port),
-		Net:     "udp",
-		Handler: *d.handler,
-		// UDPSize:   65535,
-		// ReusePort: true,
-	}
+	conf := setting.App.Resolver.Listen
+	sockets := max(conf.ReusePort, 1)
 
-	log.Printf("Starting DNS server listening on :%d (udp)", port)
-	go func() {
-		if err := d.server.ListenAndServe(); err != nil {
+	listeners := dnsListeners(conf.Ipv4, conf.Ipv6)
+	if len(conf.DoT) > 0 {
+		certs, err := certificates()
+		if err != nil {
 			log.Fatal(err)
 		}
-	}()
+		listeners = append(listeners, dotListeners(conf.DoT, &tls.Config{
+			Certificates: certs,
+			MinVersion:   tls.VersionTLS12,
+		})...)
+	}
+
+	d.servers = nil
+	for _, l := range listeners {
+		for range sockets {
+			server := &dns.Server{
+				Addr:       l.address,
+				Net:        l.network,
+				Handler:    d.handler,
+				UDPSize:    conf.UDPSize,
+				ReusePort:  conf.ReusePort > 0,
+				TLSConfig:  l.tlsConfig,
+				TsigSecret: setting.App.Resolver.Transfer.TsigSecrets(),
+			}
+			d.servers = append(d.servers, server)
+
+			go func() {
+				if err := server.ListenAndServe(); err != nil {
+					log.Fatal(err)
+				}
+			}()
+		}
+		log.Printf("Starting DNS server listening on %s (%s, %d sockets)", l.address, l.network, sockets)
+	}
 }
 
 func (d *DNS) Stop() {
 	log.Print("Stopping DNS server...")
-	if err := d.server.Shutdown(); err != nil {
-		log.Printf("DNS server forced to shutdown: %s", err)
+	for _, server := range d.servers {
+		if err := server.Shutdown(); err != nil {
+			log.Printf("DNS server forced to shutdown: %s", err)
+		}
+	}
+}
+
+// Close flushes and closes the dnstap output on shutdown
+func (d *DNS) Close() {
+	if d.tap != nil {
+		d.tap.Close()
+		d.tap = nil
+	}
+}
+
+// dnsListeners returns a UDP and a TCP listener for every address. When no
+// address is configured, the server listens on all interfaces of both families.
+func dnsListeners(ipv4 []string, ipv6 []string) []dnsListener {
+	var listeners []dnsListener
+	add := func(family string, addresses []string) {
+		for _, address := range addresses {
+			address = withDefaultPort(address, port)
+			for _, network := range []string{"udp", "tcp"} {
+				listeners = append(listeners, dnsListener{network: network + family, address: address})
+			}
+		}
+	}
+
+	if len(ipv4) == 0 && len(ipv6) == 0 {
+		add("", []string{""})
+	}
+	add("4", ipv4)
+	add("6", ipv6)
+
+	return listeners
+}
+
+// dotListeners returns a DNS over TLS (RFC 7858) listener for every address
+func dotListeners(addresses []string, tlsConfig *tls.Config) []dnsListener {
+	var listeners []dnsListener
+	for _, address := range addresses {
+		listeners = append(listeners, dnsListener{
+			network:   "tcp-tls",
+			address:   withDefaultPort(address, tlsPort),
+			tlsConfig: tlsConfig,
+		})
 	}
+
+	return listeners
+}
+
+func withDefaultPort(address string, port int) string {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return net.JoinHostPort(address, strconv.Itoa(port))
+	}
+
+	return address
 }
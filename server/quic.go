@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"log"
 	"net/http"
@@ -24,9 +25,14 @@ func NewQuicServer(ctx context.Context, tlsServer *TLS) *Quic {
 }
 
 func (q *Quic) Start() {
+	certs, err := certificates()
+	if err != nil {
+		log.Fatal(err)
+	}
 	q.server = &http3.Server{
-		Addr:    setting.App.TLSAddress,
-		Handler: q.tlsServer.server.Handler,
+		Addr:      setting.App.TLSAddress,
+		Handler:   q.tlsServer.server.Handler,
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: certs}),
 	}
 
 	parentHandler := q.tlsServer.server.Handler
@@ -40,7 +46,7 @@ func (q *Quic) Start() {
 
 	log.Printf("Starting QUIC server listening on %s (udp)", setting.App.TLSAddress)
 	go func() {
-		if err := q.server.ListenAndServeTLS(setting.App.TLSCrtPath, setting.App.TLSKeyPath); err != nil &&
+		if err := q.server.ListenAndServe(); err != nil &&
 			!errors.Is(err, http.ErrServerClosed) {
 			log.Fatal(err)
 		}
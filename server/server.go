@@ -14,9 +14,21 @@ type Server interface {
 	Stop()
 }
 
+// Reloader is implemented by the services that reload their data on SIGHUP
+type Reloader interface {
+	Reload()
+}
+
+// Closer is implemented by the servers that keep resources across reloads,
+// they are released on shutdown
+type Closer interface {
+	Close()
+}
+
 type Manager struct {
-	servers []Server
-	geoSvc  *service.Geo
+	servers   []Server
+	geoSvc    *service.Geo
+	reloaders []Reloader
 }
 
 func Setup(servers []Server, geoSvc *service.Geo) *Manager {
@@ -26,6 +38,11 @@ func Setup(servers []Server, geoSvc *service.Geo) *Manager {
 	}
 }
 
+// AddReloader registers r to be reloaded on SIGHUP
+func (m *Manager) AddReloader(r Reloader) {
+	m.reloaders = append(m.reloaders, r)
+}
+
 func (m *Manager) Run() {
 	m.start()
 
@@ -40,6 +57,9 @@ func (m *Manager) Run() {
 			if m.geoSvc != nil {
 				m.geoSvc.Reload()
 			}
+			for _, r := range m.reloaders {
+				r.Reload()
+			}
 			m.start()
 		} else {
 			log.Print("Shutting down...")
@@ -47,6 +67,11 @@ func (m *Manager) Run() {
 				m.geoSvc.Shutdown()
 			}
 			m.stop()
+			for _, s := range m.servers {
+				if c, ok := s.(Closer); ok {
+					c.Close()
+				}
+			}
 			break
 		}
 	}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"log"
 	"net/http"
@@ -23,16 +24,21 @@ func NewTLSServer(ctx context.Context, handler *http.Handler) *TLS {
 }
 
 func (t *TLS) Start() {
+	certs, err := certificates()
+	if err != nil {
+		log.Fatal(err)
+	}
 	t.server = &http.Server{
 		Addr:         setting.App.TLSAddress,
 		Handler:      *t.handler,
 		ReadTimeout:  setting.App.Server.ReadTimeout,
 		WriteTimeout: setting.App.Server.WriteTimeout,
+		TLSConfig:    &tls.Config{Certificates: certs},
 	}
 
 	log.Printf("Starting TLS server listening on %s", setting.App.TLSAddress)
 	go func() {
-		if err := t.server.ListenAndServeTLS(setting.App.TLSCrtPath, setting.App.TLSKeyPath); err != nil &&
+		if err := t.server.ListenAndServeTLS("", ""); err != nil &&
 			!errors.Is(err, http.ErrServerClosed) {
 			log.Fatal(err)
 		}
@@ -45,3 +51,23 @@ func (t *TLS) Stop() {
 		log.Printf("TLS server forced to shutdown: %s", err)
 	}
 }
+
+// certificates loads the certificate of the TLS listener and the one of the
+// discovery hosts, if any. The first one matching the server name requested by
+// the client is served, the listener one by default.
+func certificates() ([]tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(setting.App.TLSCrtPath, setting.App.TLSKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	certs := []tls.Certificate{cert}
+	if conf := setting.App.Resolver.TLS; conf.Enabled() {
+		cert, err := tls.LoadX509KeyPair(conf.Crt, conf.Key)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+
+	return certs, nil
+}
@@ -0,0 +1,189 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/dcarrillo/whatismyip/models"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrACMEAccountNotFound = errors.New("acme account not found")
+
+// ACME holds the acme-dns accounts and the TXT records of their DNS-01
+// challenges, and persists them to a JSON file
+type ACME struct {
+	path       string
+	mu         sync.RWMutex
+	accounts   map[string]models.ACMEAccount
+	subdomains map[string]string
+}
+
+// NewACME loads the accounts saved in path, which does not need to exist yet
+func NewACME(path string) (*ACME, error) {
+	a := &ACME{
+		path:       path,
+		accounts:   map[string]models.ACMEAccount{},
+		subdomains: map[string]string{},
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &a.accounts); err != nil {
+		return nil, err
+	}
+	for username, account := range a.accounts {
+		a.subdomains[account.Subdomain] = username
+	}
+
+	return a, nil
+}
+
+// Register creates an account with a random subdomain and password, which is
+// returned as only its hash is kept
+func (a *ACME) Register(allowFrom []string) (models.ACMEAccount, string, error) {
+	secret := make([]byte, 30)
+	if _, err := rand.Read(secret); err != nil {
+		return models.ACMEAccount{}, "", err
+	}
+	password := base64.RawURLEncoding.EncodeToString(secret)
+	account := models.ACMEAccount{
+		Username:     uuid.NewString(),
+		PasswordHash: hashPassword(password),
+		Subdomain:    uuid.NewString(),
+		AllowFrom:    allowFrom,
+	}
+
+	return account, password, a.put(account)
+}
+
+// SetAccount creates or replaces an account with a known password, e.g. the
+// one of a static configuration. The password is chosen by the operator, so it
+// is hashed with bcrypt.
+func (a *ACME) SetAccount(username string, password string, subdomain string) error {
+	a.mu.RLock()
+	account, ok := a.accounts[username]
+	a.mu.RUnlock()
+	if ok && account.Subdomain == subdomain && isBcrypt(account.PasswordHash) && checkPassword(account.PasswordHash, password) {
+		return nil
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	return a.put(models.ACMEAccount{
+		Username:     username,
+		PasswordHash: string(hash),
+		Subdomain:    subdomain,
+		TXT:          account.TXT,
+	})
+}
+
+// Authenticate returns the account of username if password is its password
+func (a *ACME) Authenticate(username string, password string) (models.ACMEAccount, bool) {
+	a.mu.RLock()
+	account, ok := a.accounts[username]
+	a.mu.RUnlock()
+
+	if !ok || !checkPassword(account.PasswordHash, password) {
+		return models.ACMEAccount{}, false
+	}
+
+	return account, true
+}
+
+// Update adds txt to the TXT records of the account of subdomain
+func (a *ACME) Update(subdomain string, txt string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	username, ok := a.subdomains[strings.ToLower(subdomain)]
+	if !ok {
+		return ErrACMEAccountNotFound
+	}
+	previous := a.accounts[username]
+	a.accounts[username] = previous.AddTXT(txt)
+	if err := writeJSON(a.path, a.accounts); err != nil {
+		a.accounts[username] = previous
+		return err
+	}
+
+	return nil
+}
+
+// TXT returns the TXT records of subdomain, and whether there is an account
+// for it
+func (a *ACME) TXT(subdomain string) ([]string, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	username, ok := a.subdomains[strings.ToLower(subdomain)]
+	if !ok {
+		return nil, false
+	}
+
+	return a.accounts[username].TXT, true
+}
+
+func (a *ACME) put(account models.ACMEAccount) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if username, ok := a.subdomains[account.Subdomain]; ok && username != account.Username {
+		return fmt.Errorf("acme subdomain %s belongs to another account", account.Subdomain)
+	}
+	previous, exists := a.accounts[account.Username]
+	a.accounts[account.Username] = account
+	if err := writeJSON(a.path, a.accounts); err != nil {
+		if exists {
+			a.accounts[account.Username] = previous
+		} else {
+			delete(a.accounts, account.Username)
+		}
+		return err
+	}
+	if exists {
+		delete(a.subdomains, previous.Subdomain)
+	}
+	a.subdomains[account.Subdomain] = account.Username
+
+	return nil
+}
+
+// hashPassword hashes the random passwords of the registered accounts, their
+// entropy makes a slow hash unnecessary
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkPassword reports whether password matches hash, either a bcrypt hash
+// or the hash of a random password
+func checkPassword(hash string, password string) bool {
+	if isBcrypt(hash) {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(hashPassword(password))) == 1
+}
+
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2")
+}
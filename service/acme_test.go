@@ -0,0 +1,56 @@
+package service
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestACME(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acme.json")
+	acme, err := NewACME(path)
+	require.NoError(t, err)
+
+	account, password, err := acme.Register([]string{"192.0.2.0/24"})
+	require.NoError(t, err)
+	assert.Len(t, password, 40)
+	assert.NotEqual(t, password, account.PasswordHash)
+
+	_, ok := acme.Authenticate(account.Username, "wrong")
+	assert.False(t, ok)
+	authenticated, ok := acme.Authenticate(account.Username, password)
+	require.True(t, ok)
+	assert.Equal(t, account.Subdomain, authenticated.Subdomain)
+
+	records, ok := acme.TXT(account.Subdomain)
+	assert.True(t, ok)
+	assert.Empty(t, records)
+	require.NoError(t, acme.Update(account.Subdomain, "first"))
+	require.NoError(t, acme.Update(account.Subdomain, "second"))
+	assert.ErrorIs(t, acme.Update("missing", "txt"), ErrACMEAccountNotFound)
+
+	require.NoError(t, acme.SetAccount("apex", "secret", ""))
+	apex, ok := acme.Authenticate("apex", "secret")
+	require.True(t, ok)
+	assert.True(t, strings.HasPrefix(apex.PasswordHash, "$2"), "the apex password is hashed with bcrypt")
+	require.NoError(t, acme.Update("", "apex"))
+	assert.Error(t, acme.SetAccount("other", "secret", ""), "the subdomain belongs to the apex account")
+
+	// the accounts are loaded again from the file
+	acme, err = NewACME(path)
+	require.NoError(t, err)
+	records, ok = acme.TXT(account.Subdomain)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"first", "second"}, records)
+	_, ok = acme.Authenticate(account.Username, password)
+	assert.True(t, ok)
+
+	require.NoError(t, acme.SetAccount("apex", "changed", ""))
+	_, ok = acme.Authenticate("apex", "secret")
+	assert.False(t, ok)
+	records, _ = acme.TXT("")
+	assert.Equal(t, []string{"apex"}, records, "the records are kept when the password changes")
+}
@@ -0,0 +1,98 @@
+package service
+
+import (
+	"encoding/json"
+	"reflect"
+	"time"
+
+	"github.com/dcarrillo/whatismyip/internal/metrics"
+	"github.com/dcarrillo/whatismyip/internal/ttlcache"
+)
+
+// DiscoveryStore holds the results of the discovery tests for a while: the DNS
+// server records them and the HTTP server reads them, possibly on another
+// replica. Values are stored encoded as JSON. The owner of the writes is the
+// address of the client the entry is created for, stores may bound the entries
+// of every client network.
+type DiscoveryStore interface {
+	// Get decodes the value of key into v and reports whether it was found
+	Get(key string, v any) (bool, error)
+	Set(key string, owner string, v any) error
+	// Update decodes the value of key into v, the zero value if it is not
+	// found, and stores v once update has modified it. The whole operation is
+	// atomic, update may be called again if the value changed meanwhile.
+	Update(key string, owner string, v any, update func()) error
+	Close() error
+}
+
+// MemoryDiscoveryStore is a DiscoveryStore local to the process, bounded so
+// that floods of random tokens can not exhaust the memory
+type MemoryDiscoveryStore struct {
+	cache *ttlcache.Cache
+}
+
+// NewMemoryDiscoveryStore returns an in-memory store of at most maxEntries
+// values, which expire after expiration. The clients of a network prefix can
+// create up to quota entries, 0 disables the quota.
+func NewMemoryDiscoveryStore(expiration time.Duration, maxEntries int, quota int) *MemoryDiscoveryStore {
+	return &MemoryDiscoveryStore{cache: ttlcache.New(ttlcache.Config{
+		Expiration: expiration,
+		MaxEntries: maxEntries,
+		Quota:      quota,
+	})}
+}
+
+func (s *MemoryDiscoveryStore) Get(key string, v any) (bool, error) {
+	b, found := s.cache.Get(key)
+	var err error
+	if found {
+		err = json.Unmarshal(b, v)
+	}
+	recordLookup(found, err)
+
+	return found, err
+}
+
+func (s *MemoryDiscoveryStore) Set(key string, owner string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return s.cache.Update(key, owner, func([]byte) ([]byte, error) { return b, nil })
+}
+
+func (s *MemoryDiscoveryStore) Update(key string, owner string, v any, update func()) error {
+	return s.cache.Update(key, owner, func(b []byte) ([]byte, error) {
+		reset(v)
+		if b != nil {
+			if err := json.Unmarshal(b, v); err != nil {
+				return nil, err
+			}
+		}
+		update()
+
+		return json.Marshal(v)
+	})
+}
+
+func (s *MemoryDiscoveryStore) Close() error {
+	return nil
+}
+
+// reset sets the value v points to to its zero value, JSON decoding merges
+// into existing values
+func reset(v any) {
+	reflect.ValueOf(v).Elem().SetZero()
+}
+
+func recordLookup(found bool, err error) {
+	switch {
+	case err != nil:
+		metrics.RecordDiscoveryStoreLookup("error")
+	case found:
+		metrics.RecordDiscoveryStoreLookup("hit")
+	default:
+		metrics.RecordDiscoveryStoreLookup("miss")
+	}
+}
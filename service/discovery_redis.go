@@ -0,0 +1,122 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// redisTimeout bounds every operation, the DNS server waits for them
+	redisTimeout = 2 * time.Second
+	// redisUpdateAttempts bounds the retries of an update that raced another
+	// replica, they back off for a random time up to a millisecond per attempt
+	redisUpdateAttempts = 10
+)
+
+// RedisDiscoveryStore is a DiscoveryStore shared by the replicas through a
+// server speaking the Redis protocol (Redis, Valkey, KeyDB...)
+type RedisDiscoveryStore struct {
+	client     *redis.Client
+	prefix     string
+	expiration time.Duration
+}
+
+// NewRedisDiscoveryStore connects to the server at url (redis://, rediss:// or
+// unix://), keys are prefixed with prefix and expire after expiration
+func NewRedisDiscoveryStore(url string, prefix string, expiration time.Duration) (*RedisDiscoveryStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %w", err)
+	}
+	client := redis.NewClient(opts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("error connecting to redis: %w", err)
+	}
+
+	return &RedisDiscoveryStore{client: client, prefix: prefix, expiration: expiration}, nil
+}
+
+func (s *RedisDiscoveryStore) Get(key string, v any) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	found, err := decode(s.client.Get(ctx, s.prefix+key), v)
+	recordLookup(found, err)
+
+	return found, err
+}
+
+// Set stores v, the entries are not bounded by owner: the server evicts keys
+// according to its own policy
+func (s *RedisDiscoveryStore) Set(key string, _ string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	return s.client.Set(ctx, s.prefix+key, b, s.expiration).Err()
+}
+
+// Update runs an optimistic transaction: it is retried when another replica
+// modifies the key between the read and the write
+func (s *RedisDiscoveryStore) Update(key string, _ string, v any, update func()) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	key = s.prefix + key
+	txf := func(tx *redis.Tx) error {
+		reset(v)
+		if _, err := decode(tx.Get(ctx, key), v); err != nil {
+			return err
+		}
+		update()
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, b, s.expiration)
+			return nil
+		})
+		return err
+	}
+
+	for i := range redisUpdateAttempts {
+		if err := s.client.Watch(ctx, txf, key); !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+		time.Sleep(rand.N(time.Duration(i+1) * time.Millisecond))
+	}
+
+	return fmt.Errorf("error updating %s: too many concurrent updates", key)
+}
+
+func (s *RedisDiscoveryStore) Close() error {
+	return s.client.Close()
+}
+
+// decode decodes the result of a GET command into v, a missing key is not an
+// error
+func decode(cmd *redis.StringCmd, v any) (bool, error) {
+	b, err := cmd.Bytes()
+	switch {
+	case errors.Is(err, redis.Nil):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+
+	return true, json.Unmarshal(b, v)
+}
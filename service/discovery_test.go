@@ -0,0 +1,109 @@
+package service
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testDiscovery struct {
+	IPs   []string `json:"ips"`
+	Count int      `json:"count"`
+}
+
+func testStores(t *testing.T) map[string]DiscoveryStore {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	redisStore, err := NewRedisDiscoveryStore("redis://"+mr.Addr(), "whatismyip:", time.Minute)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = redisStore.Close() })
+
+	return map[string]DiscoveryStore{
+		"memory": NewMemoryDiscoveryStore(time.Minute, 1000, 0),
+		"redis":  redisStore,
+	}
+}
+
+func TestDiscoveryStore(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			var v testDiscovery
+			found, err := store.Get("token", &v)
+			require.NoError(t, err)
+			assert.False(t, found)
+
+			require.NoError(t, store.Set("token", "192.0.2.1", testDiscovery{IPs: []string{"192.0.2.1"}, Count: 1}))
+			found, err = store.Get("token", &v)
+			require.NoError(t, err)
+			assert.True(t, found)
+			assert.Equal(t, testDiscovery{IPs: []string{"192.0.2.1"}, Count: 1}, v)
+
+			require.NoError(t, store.Update("token", "192.0.2.1", &v, func() {
+				v.IPs = append(v.IPs, "2001:db8::1")
+				v.Count++
+			}))
+			var updated testDiscovery
+			_, err = store.Get("token", &updated)
+			require.NoError(t, err)
+			assert.Equal(t, testDiscovery{IPs: []string{"192.0.2.1", "2001:db8::1"}, Count: 2}, updated)
+
+			require.NoError(t, store.Update("another", "192.0.2.1", &v, func() { v.Count++ }))
+			assert.Equal(t, testDiscovery{Count: 1}, v, "updates start from the zero value")
+
+			require.NoError(t, store.Set("invalid", "192.0.2.1", "not a discovery"))
+			_, err = store.Get("invalid", &v)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestDiscoveryStoreConcurrentUpdates(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			for range 4 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					var v testDiscovery
+					for range 10 {
+						assert.NoError(t, store.Update("token", "192.0.2.1", &v, func() { v.Count++ }))
+					}
+				}()
+			}
+			wg.Wait()
+
+			var v testDiscovery
+			_, err := store.Get("token", &v)
+			require.NoError(t, err)
+			assert.Equal(t, 40, v.Count)
+		})
+	}
+}
+
+func TestRedisDiscoveryStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	store, err := NewRedisDiscoveryStore("redis://"+mr.Addr(), "whatismyip:", time.Minute)
+	require.NoError(t, err)
+	defer store.Close()
+
+	require.NoError(t, store.Set("token", "192.0.2.1", true))
+	assert.True(t, mr.Exists("whatismyip:token"), "keys are prefixed")
+	assert.Equal(t, time.Minute, mr.TTL("whatismyip:token"))
+
+	mr.FastForward(time.Minute)
+	found, err := store.Get("token", new(bool))
+	require.NoError(t, err)
+	assert.False(t, found, "keys expire")
+
+	addr := mr.Addr()
+	mr.Close()
+	_, err = NewRedisDiscoveryStore("redis://"+addr, "", time.Minute)
+	assert.Error(t, err, "unreachable server")
+	_, err = NewRedisDiscoveryStore("http://127.0.0.1", "", time.Minute)
+	assert.Error(t, err, "invalid url")
+}
@@ -0,0 +1,146 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dcarrillo/whatismyip/models"
+)
+
+// DynDNS holds the addresses published by the dynamic DNS clients, indexed by
+// fully qualified hostname, and persists them to a JSON file
+type DynDNS struct {
+	path  string
+	mu    sync.RWMutex
+	hosts map[string]models.DynDNSHost
+}
+
+// NewDynDNS loads the hosts saved in path, which does not need to exist yet
+func NewDynDNS(path string) (*DynDNS, error) {
+	d := &DynDNS{
+		path:  path,
+		hosts: map[string]models.DynDNSHost{},
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &d.hosts); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// Lookup returns the addresses published for host
+func (d *DynDNS) Lookup(host string) (models.DynDNSHost, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	h, ok := d.hosts[canonicalHost(host)]
+
+	return h, ok
+}
+
+// Update publishes ips for host and saves the hosts when any address changed
+func (d *DynDNS) Update(host string, ips []net.IP) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	host = canonicalHost(host)
+	h, changed := d.hosts[host].Update(ips)
+	if !changed {
+		return false, nil
+	}
+	h.Updated = time.Now().UTC()
+
+	previous, exists := d.hosts[host]
+	d.hosts[host] = h
+	if err := d.save(); err != nil {
+		if exists {
+			d.hosts[host] = previous
+		} else {
+			delete(d.hosts, host)
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Prune removes the hosts that are not in hosts, e.g. the ones that are no
+// longer configured, and saves the hosts when any was removed
+func (d *DynDNS) Prune(hosts []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	keep := map[string]struct{}{}
+	for _, host := range hosts {
+		keep[canonicalHost(host)] = struct{}{}
+	}
+	pruned := map[string]models.DynDNSHost{}
+	for host, h := range d.hosts {
+		if _, ok := keep[host]; ok {
+			pruned[host] = h
+		}
+	}
+	if len(pruned) == len(d.hosts) {
+		return nil
+	}
+
+	previous := d.hosts
+	d.hosts = pruned
+	if err := d.save(); err != nil {
+		d.hosts = previous
+		return err
+	}
+
+	return nil
+}
+
+func (d *DynDNS) save() error {
+	return writeJSON(d.path, d.hosts)
+}
+
+// writeJSON writes v to a temporary file that replaces path, so that the file
+// is never left half written
+func writeJSON(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func canonicalHost(host string) string {
+	host = strings.ToLower(host)
+	if !strings.HasSuffix(host, ".") {
+		host += "."
+	}
+
+	return host
+}
@@ -0,0 +1,75 @@
+package service
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDynDNS(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dyndns.json")
+	dyn, err := NewDynDNS(path)
+	require.NoError(t, err)
+
+	_, ok := dyn.Lookup("home.dns.example.com")
+	assert.False(t, ok)
+
+	changed, err := dyn.Update("Home.dns.example.com", []net.IP{net.ParseIP("192.0.2.1")})
+	require.NoError(t, err)
+	assert.True(t, changed)
+	changed, err = dyn.Update("home.dns.example.com.", []net.IP{net.ParseIP("192.0.2.1")})
+	require.NoError(t, err)
+	assert.False(t, changed)
+	changed, err = dyn.Update("home.dns.example.com", []net.IP{net.ParseIP("2001:db8::1")})
+	require.NoError(t, err)
+	assert.True(t, changed)
+
+	// the hosts are loaded again from the file
+	dyn, err = NewDynDNS(path)
+	require.NoError(t, err)
+	h, ok := dyn.Lookup("HOME.dns.example.com.")
+	require.True(t, ok)
+	assert.Equal(t, "192.0.2.1", h.IPv4.String())
+	assert.Equal(t, "2001:db8::1", h.IPv6.String())
+	assert.False(t, h.Updated.IsZero())
+
+	require.NoError(t, os.WriteFile(path, []byte("{"), 0o600))
+	_, err = NewDynDNS(path)
+	assert.Error(t, err)
+}
+
+func TestDynDNSPrune(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dyndns.json")
+	dyn, err := NewDynDNS(path)
+	require.NoError(t, err)
+	for _, host := range []string{"home.dns.example.com", "lab.dns.example.com"} {
+		_, err = dyn.Update(host, []net.IP{net.ParseIP("192.0.2.1")})
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, dyn.Prune([]string{"Home.dns.example.com"}))
+	_, ok := dyn.Lookup("lab.dns.example.com")
+	assert.False(t, ok, "the host is no longer configured")
+
+	// the pruned hosts are saved
+	dyn, err = NewDynDNS(path)
+	require.NoError(t, err)
+	_, ok = dyn.Lookup("home.dns.example.com")
+	assert.True(t, ok)
+	_, ok = dyn.Lookup("lab.dns.example.com")
+	assert.False(t, ok)
+}
+
+func TestDynDNSSaveError(t *testing.T) {
+	dyn, err := NewDynDNS(filepath.Join(t.TempDir(), "missing", "dyndns.json"))
+	require.NoError(t, err)
+
+	_, err = dyn.Update("home.dns.example.com", []net.IP{net.ParseIP("192.0.2.1")})
+	assert.Error(t, err)
+	_, ok := dyn.Lookup("home.dns.example.com")
+	assert.False(t, ok, "the update is discarded when it cannot be saved")
+}